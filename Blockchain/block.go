@@ -4,18 +4,34 @@ import (
 	"bytes"
 	"encoding/gob"
 	"log"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Params"
 )
 
 type Block struct {
+	Timestamp    int64 //unix time the block was created, used for timestamp based lock times
 	Hash         []byte
 	Transactions []*Transaction
 	PrevHash     []byte
 	Nonce        int
+	Height       int //number of blocks before this one, the genesis block has height 0
+}
+
+// Everything the proof of work commits to, minus the transactions which are represented by their merkle root.
+// A header is enough to check the work of a block and to check merkle proofs against it.
+type BlockHeader struct {
+	Timestamp  int64
+	Hash       []byte
+	PrevHash   []byte
+	MerkleRoot []byte
+	Nonce      int
+	Height     int
 }
 
 // Method for creating the block(Retuns a block pointer), A block can contain multiple transactions(atleast one)
-func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	var block Block = Block{[]byte{}, txs, prevHash, 0} //Create a block with the data and the previous hash
+func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
+	var block Block = Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height} //Create a block with the data and the previous hash
 	var proof *ProofOfWork = NewProof(&block)           //Derive the hash of the block
 	var nonce int                                       //Run the proof of work algorithm
 	var hash []byte
@@ -25,20 +41,38 @@ func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
 	return &block //Return the block
 }
 
-// Creates the genesis block -- the first block in the blockchain
+// Creates the genesis block -- the first block in the blockchain, at the network's genesis time if it has one
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+	if Params.Active.GenesisTime == 0 {
+		return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
+	}
+	var block Block = Block{Params.Active.GenesisTime, []byte{}, []*Transaction{coinbase}, []byte{}, 0, 0}
+	block.Mine(nil)
+	return &block
 }
 
 func (block *Block) HashTransactions() []byte {
+	return block.MerkleTree().RootNode.Data
+}
+
+// The leaves are the signed hashes of the transactions, unlike the ids they cover the unlocking scripts.
+func (block *Block) MerkleTree() *MerkleTree {
 	var txHashes [][]byte
 	for _, tx := range block.Transactions {
-		// txHashes = append(txHashes, tx.HashTransaction()) //append the hashed version of the transaction to the slice of hashes
-		txHashes = append(txHashes, tx.Serialize()) //append the serialized version of the transaction to the slice of hashes
+		txHashes = append(txHashes, tx.SignedHash()) //append the hash of the transaction to the slice of hashes
 	}
-	var tree *MerkleTree = NewMerkleTree(txHashes) //create a new merkle tree with the hashes of the transactions
+	return NewMerkleTree(txHashes) //create a new merkle tree with the hashes of the transactions
+}
 
-	return tree.RootNode.Data
+func (block *Block) Header() BlockHeader {
+	return BlockHeader{
+		Timestamp:  block.Timestamp,
+		Hash:       block.Hash,
+		PrevHash:   block.PrevHash,
+		MerkleRoot: block.HashTransactions(),
+		Nonce:      block.Nonce,
+		Height:     block.Height,
+	}
 }
 
 // encodes the block into a byte slice
@@ -52,14 +86,22 @@ func (block *Block) Serialize() []byte {
 	return result.Bytes()
 }
 
-// decodes the byte slice into a block pointer
+// decodes the byte slice into a block pointer, for blocks from our own database
 func Deserialize(data []byte) *Block {
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return block
+}
 
+// decodes a block received from someone else, malformed data is an error instead of a panic
+func DeserializeBlock(data []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	return &block
+	return &block, nil
 }
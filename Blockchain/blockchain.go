@@ -9,20 +9,45 @@ import (
 	"log"
 	"math/big"
 	"os"
-	"runtime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/pred695/golang-blockchain/Params"
 )
 
-const (
-	dbPath      = "./temp/blocks"
-	dbFile      = "./temp/blocks/MANIFEST"
-	genesisData = "First Transaction from Genesis"
-)
+/*
+	The files of the node are found when they are used, as the network is only selected at start up (see
+	Params.Select). Setting one of the paths puts its file somewhere else, tests do.
+*/
+var dbPath string
+
+// the directory of the blocks
+func blocksPath() string {
+	return nodePath(dbPath, "./temp/blocks")
+}
+
+// The path if it is set, otherwise the file in the directory of the network. Several nodes on one machine keep
+// their files apart by setting NODE_ID, e.g. NODE_ID=3001 uses ./temp/blocks_3001
+func nodePath(path string, file string) string {
+	if path != "" {
+		return path
+	}
+	path = Params.DataPath(file)
+	var nodeID string = os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return path
+	}
+	var ext string = filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + nodeID + ext
+}
 
 type Blockchain struct {
 	LastHash []byte     //The hash of the previous block
 	Database *badger.DB //pointer to the database.
+	Events   *EventBus  //tells subscribers about new blocks and pool changes, see events.go
 }
 
 type PrivateKey struct {
@@ -37,36 +62,89 @@ type BlockchainIterator struct {
 	Database    *badger.DB
 }
 
+/*
+	The version of the stored format, kept under the key "version". Chains stored before the key existed locked
+	outputs without scripts and had transaction ids and merkle leaves of another kind, none of it validates under
+	the current rules, so such a chain is refused rather than read. Changes to the format bump the version.
+*/
+const storageVersion = 2
+
+// stamps a new database with the current version, fails for one stored in another format
+func checkStorageVersion(db *badger.DB) error {
+	return db.Update(func(txn *badger.Txn) error {
+		var found int = 1 //no version key, from before it existed
+		item, err := txn.Get([]byte("version"))
+		if err == badger.ErrKeyNotFound {
+			_, err = txn.Get([]byte("lh"))
+			if err == badger.ErrKeyNotFound {
+				return txn.Set([]byte("version"), []byte(strconv.Itoa(storageVersion))) //nothing stored yet
+			}
+		} else if err == nil {
+			var value []byte
+			value, err = item.ValueCopy(nil)
+			if err == nil {
+				found, err = strconv.Atoi(string(value))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if found != storageVersion {
+			return fmt.Errorf("reindex required: the chain in %s is stored in format %d, this version uses format %d, delete it and sync or create the chain again", blocksPath(), found, storageVersion)
+		}
+		return nil
+	})
+}
+
+// a chain stored in another format is not used
+func openedStorage(db *badger.DB) {
+	var err error = checkStorageVersion(db)
+	if err != nil {
+		db.Close()
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
 func DBexists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(blocksPath(), "MANIFEST")); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
+// creates the chain with its genesis block, the network's genesis address (if it has one) takes the place of address
 func InitBlockChain(address string) *Blockchain {
 	var lastHash []byte
+	if Params.Active.GenesisAddress != "" {
+		address = Params.Active.GenesisAddress
+	}
 
 	if DBexists() {
 		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+		os.Exit(1)
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	err := os.MkdirAll(blocksPath(), 0755)
+	Handle(err)
+	opts := badger.DefaultOptions(blocksPath())
+	opts.Dir = blocksPath()
+	opts.ValueDir = blocksPath()
 
 	db, err := badger.Open(opts)
 	Handle(err)
+	openedStorage(db)
 
 	err = db.Update(func(txn *badger.Txn) error {
 		//Create a coinbase transaction, the first transaction in the blockchain
-		cbtx := CoinbaseTx(address, genesisData)
+		cbtx := CoinbaseTx(address, Params.Active.GenesisMessage, 0)
 		genesis := Genesis(cbtx)
 		fmt.Println("Genesis created")
 
 		err = txn.Set(genesis.Hash, genesis.Serialize())
 		Handle(err)
+		err = storeBlockFilter(txn, genesis)
+		Handle(err)
 
 		err = txn.Set([]byte("lh"), genesis.Hash) //setting the value of genesis.Hash = []byte("lh"), the last hash.
 		lastHash = genesis.Hash
@@ -74,24 +152,25 @@ func InitBlockChain(address string) *Blockchain {
 	})
 	Handle(err)
 
-	blockchain := Blockchain{LastHash: lastHash, Database: db}
+	blockchain := Blockchain{LastHash: lastHash, Database: db, Events: NewEventBus()}
 	return &blockchain
 }
 
 func ContinueBlockchain(address string) *Blockchain {
 	if DBexists() == false {
 		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+		os.Exit(1)
 	}
 
 	var lastHash []byte
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	opts := badger.DefaultOptions(blocksPath())
+	opts.Dir = blocksPath()
+	opts.ValueDir = blocksPath()
 
 	db, err := badger.Open(opts)
 	Handle(err)
+	openedStorage(db)
 
 	err = db.Update(func(txn *badger.Txn) error {
 		//find the lastHash
@@ -103,26 +182,69 @@ func ContinueBlockchain(address string) *Blockchain {
 	})
 	Handle(err)
 
-	blockchain := Blockchain{LastHash: lastHash, Database: db}
+	blockchain := Blockchain{LastHash: lastHash, Database: db, Events: NewEventBus()}
 	return &blockchain
 }
 
+// Opens the chain for a node, a node without a chain starts out empty and gets the genesis block from its peers
+func OpenBlockchain() *Blockchain {
+	var lastHash []byte
+
+	err := os.MkdirAll(blocksPath(), 0755)
+	Handle(err)
+	opts := badger.DefaultOptions(blocksPath())
+	opts.Dir = blocksPath()
+	opts.ValueDir = blocksPath()
+
+	db, err := badger.Open(opts)
+	Handle(err)
+	openedStorage(db)
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err == badger.ErrKeyNotFound {
+			return nil //empty chain
+		}
+		if err != nil {
+			return err
+		}
+		lastHash, err = item.ValueCopy([]byte{})
+		return err
+	})
+	Handle(err)
+
+	return &Blockchain{LastHash: lastHash, Database: db, Events: NewEventBus()}
+}
+
 func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
+	var lastHeight int
 	//View function allows to read transactions from the database.
 	err := chain.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh")) //get the current last hash
 		Handle(err)
 		lastHash, err = item.ValueCopy([]byte{})
+		Handle(err)
+		item, err = txn.Get(lastHash)
+		Handle(err)
+		encodedBlock, err := item.ValueCopy([]byte{})
+		lastHeight = Deserialize(encodedBlock).Height
 		return err
 	})
+	Handle(err)
 
+	//reject the transactions before spending the work on mining them
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	err = UTXO.ValidateBlockTransactions(transactions, lastHeight+1, time.Now().Unix())
 	Handle(err)
-	newBlock := CreateBlock(transactions, lastHash) //create a new block with the data and the last hash
+
+	newBlock := CreateBlock(transactions, lastHash, lastHeight+1) //create a new block with the data and the last hash
 	//new block created, perform read and write operations --> use Update function.
 	err = chain.Database.Update(func(txn *badger.Txn) error {
 		err := txn.Set(newBlock.Hash, newBlock.Serialize()) //set the hash of the new block to the serialized version of the new block.
 		Handle(err)
+		err = storeBlockFilter(txn, newBlock)
+		Handle(err)
 		err = txn.Set([]byte("lh"), newBlock.Hash) //set the last hash to the hash of the new block.
 		chain.LastHash = newBlock.Hash
 		return err
@@ -131,6 +253,195 @@ func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
 	return newBlock
 }
 
+func (chain *Blockchain) GetBlock(hash []byte) (Block, error) {
+	var block Block
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(hash)
+		if err != nil {
+			return errors.New("Block is not found")
+		}
+		encodedBlock, err := item.ValueCopy([]byte{})
+		if err != nil {
+			return err
+		}
+		block = *Deserialize(encodedBlock)
+		return nil
+	})
+	return block, err
+}
+
+// walks back from the tip, so recent blocks are found fastest
+func (chain *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	if height < 0 || height > chain.GetBestHeight() {
+		return Block{}, fmt.Errorf("no block at height %d", height)
+	}
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		if block.Height == height {
+			return *block, nil
+		}
+	}
+}
+
+// whether the block is stored, on the chain or on a side branch
+func (chain *Blockchain) HasBlock(hash []byte) bool {
+	_, err := chain.GetBlock(hash)
+	return err == nil
+}
+
+/*
+	Validates a block mined somewhere else (by a peer) and adds it to the chain. A block on the tip extends it,
+	including the UTXO set and the filter index. A block on any other known block is kept on a side branch, which
+	replaces the tip once it has more work (see reorg.go). An empty chain only accepts a genesis block.
+*/
+func (chain *Blockchain) ConnectBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("block has no transactions")
+	}
+	var header BlockHeader = block.Header()
+	if !header.Validate() {
+		return errors.New("block hash does not match its contents or misses the proof of work target")
+	}
+	if block.Timestamp > time.Now().Add(2*time.Hour).Unix() {
+		return contextErrorf("block timestamp is too far in the future") //our clock may be wrong
+	}
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+			return fmt.Errorf("transaction id %x does not match its contents", tx.ID)
+		}
+	}
+	if len(chain.LastHash) == 0 {
+		if block.Height != 0 || len(block.PrevHash) != 0 {
+			return contextErrorf("the chain is empty, expected a genesis block")
+		}
+		err := checkGenesis(block)
+		if err != nil {
+			return err
+		}
+		return chain.connectTip(block)
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return contextErrorf("the parent of block %x is unknown", block.Hash)
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("block height %d does not follow its parent's %d", block.Height, parent.Height)
+	}
+	if block.Timestamp < parent.Timestamp {
+		return errors.New("block timestamp is before its parent's")
+	}
+	if bytes.Equal(block.PrevHash, chain.LastHash) {
+		return chain.connectTip(block)
+	}
+
+	//the transactions of a side branch are only validated once it is about to become the chain
+	err = chain.storeBlock(block)
+	if err != nil {
+		return err
+	}
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+	if chainWork(block.Height).Cmp(chainWork(tip.Height)) <= 0 {
+		return nil //with equal work the branch we saw first stays
+	}
+	return chain.reorganize(block)
+}
+
+// validates the transactions of a block on the tip and makes it the new tip
+func (chain *Blockchain) connectTip(block *Block) error {
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	err := UTXO.ValidateBlockTransactions(block.Transactions, block.Height, block.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return chain.extendTip(txn, block)
+	})
+	if err != nil {
+		return err
+	}
+	chain.LastHash = block.Hash
+	chain.Events.Publish(BlockConnected{Block: block})
+	return nil
+}
+
+// writes a validated block on the tip: the block, its filter, the new tip and the changes to the UTXO set
+func (chain *Blockchain) extendTip(txn *badger.Txn, block *Block) error {
+	err := txn.Set(block.Hash, block.Serialize())
+	if err != nil {
+		return err
+	}
+	err = storeBlockFilter(txn, block)
+	if err != nil {
+		return err
+	}
+	err = txn.Set([]byte("lh"), block.Hash)
+	if err != nil {
+		return err
+	}
+	return UTXOSet{Blockchain: chain}.apply(txn, block)
+}
+
+// stores a block of a side branch, the tip and the UTXO set stay as they are
+func (chain *Blockchain) storeBlock(block *Block) error {
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		err := txn.Set(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		return storeBlockFilter(txn, block)
+	})
+}
+
+// whether the block is part of the chain up to the tip, rather than of a side branch
+func (chain *Blockchain) IsMainChain(hash []byte) bool {
+	block, err := chain.GetBlock(hash)
+	if err != nil || block.Height > chain.GetBestHeight() {
+		return false
+	}
+	mainBlock, err := chain.GetBlockByHeight(block.Height)
+	return err == nil && bytes.Equal(mainBlock.Hash, hash)
+}
+
+// a genesis block has to be the one of our network, one of another network would put us on the wrong chain
+func checkGenesis(block *Block) error {
+	var coinbase *Transaction = block.Transactions[0]
+	if !coinbase.Is_Coinbase() || !bytes.Equal(coinbase.Inputs[0].Script, PushData([]byte(Params.Active.GenesisMessage))) {
+		return fmt.Errorf("genesis block %x is not one of %s", block.Hash, Params.Active.Name)
+	}
+	if Params.Active.GenesisTime != 0 && block.Timestamp != Params.Active.GenesisTime {
+		return fmt.Errorf("genesis block %x does not have the time of the %s genesis", block.Hash, Params.Active.Name)
+	}
+	if Params.Active.GenesisAddress != "" && (len(coinbase.Outputs) != 1 || !bytes.Equal(coinbase.Outputs[0].Script, AddressScript([]byte(Params.Active.GenesisAddress)))) {
+		return fmt.Errorf("genesis block %x does not pay the %s genesis address", block.Hash, Params.Active.Name)
+	}
+	return checkGenesisHash(block.Hash)
+}
+
+// a network with a fixed genesis names its hash, the parameters were validated when they were loaded
+func checkGenesisHash(hash []byte) error {
+	pinned, _ := hex.DecodeString(Params.Active.GenesisHash)
+	if len(pinned) != 0 && !bytes.Equal(hash, pinned) {
+		return fmt.Errorf("genesis %x is not the %s genesis %x", hash, Params.Active.Name, pinned)
+	}
+	return nil
+}
+
+// height of the newest block, -1 for an empty chain
+func (chain *Blockchain) GetBestHeight() int {
+	if len(chain.LastHash) == 0 {
+		return -1
+	}
+	block, err := chain.GetBlock(chain.LastHash)
+	Handle(err)
+	return block.Height
+}
+
 // Iterating from the newest to the genesis block(reverse iteration)
 func (chain *Blockchain) Iterator() *BlockchainIterator {
 	iter := &BlockchainIterator{CurrentHash: chain.LastHash, Database: chain.Database}
@@ -164,6 +475,9 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 
 		Outputs:
 			for outIdx, output := range tx.Outputs{
+				if output.IsDataOutput() {
+					continue //can never be spent, no need to track it
+				}
 				if spentTXOs[txID] != nil{
 					for _, spentOutput := range spentTXOs[txID]{
 						if spentOutput == outIdx{
@@ -173,6 +487,9 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 				}
 				var outputs TxOutputs = UTXO[txID]
 				outputs.Outputs = append(outputs.Outputs, output)
+				outputs.Indexes = append(outputs.Indexes, outIdx)
+				outputs.Height = block.Height
+				outputs.Coinbase = tx.Is_Coinbase()
 				UTXO[txID] = outputs
 			}
 			if tx.Is_Coinbase() == false{
@@ -190,7 +507,44 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 }
 
 
+// an OP_RETURN output found in the chain
+type DataOutput struct {
+	TxID        []byte
+	OutputIdx   int
+	BlockHeight int
+	Data        []byte
+}
+
+// all data carrier outputs, newest first
+func (chain *Blockchain) FindDataOutputs() []DataOutput {
+	var dataOutputs []DataOutput
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		for _, tx := range block.Transactions {
+			for outIdx, output := range tx.Outputs {
+				if data, isData := ExtractData(output.Script); isData {
+					dataOutputs = append(dataOutputs, DataOutput{TxID: tx.ID, OutputIdx: outIdx, BlockHeight: block.Height, Data: data})
+				}
+			}
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return dataOutputs
+}
+
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := chain.FindTransactionBlock(ID)
+	return tx, err
+}
+
+// like FindTransaction, also returns the block that contains the transaction
+func (chain *Blockchain) FindTransactionBlock(ID []byte) (Transaction, *Block, error) {
+	if len(chain.LastHash) == 0 {
+		return Transaction{}, nil, errors.New("Transaction does not exist")
+	}
 	var iter *BlockchainIterator = chain.Iterator()
 
 	for {
@@ -198,14 +552,14 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
-			}
-			if len(block.PrevHash) == 0 {
-				break
+				return *tx, block, nil
 			}
 		}
-		return Transaction{}, errors.New("Transaction does not exist")
+		if len(block.PrevHash) == 0 {
+			break //reached the genesis block without finding the transaction
+		}
 	}
+	return Transaction{}, nil, errors.New("Transaction does not exist")
 }
 
 func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
@@ -0,0 +1,256 @@
+package Blockchain
+
+import (
+	"sync"
+)
+
+/*
+	In-process publish/subscribe for what happens to the chain and the pool, so indexes, servers and plugins can
+	follow it without changes to this package. Every Blockchain has a bus in chain.Events.
+	Handlers run synchronously in the publishing goroutine, while it still holds its locks (the node publishes
+	with its chain lock held), and see the state right after the change: BlockConnected is published once the
+	UTXO set includes the block. A handler must return quickly and must not wait for the chain's owner, slow work
+	belongs in a goroutine fed by the handler. A handler may publish events itself.
+*/
+
+const (
+	TopicBlockConnected    = "blockconnected"
+	TopicBlockDisconnected = "blockdisconnected"
+	TopicReorg             = "reorg"
+	TopicTxAccepted        = "txaccepted"
+	TopicTxRemoved         = "txremoved"
+	TopicBalanceChanged    = "balancechanged"
+)
+
+type Event interface {
+	Topic() string
+}
+
+// a block became the new tip and its transactions are in the UTXO set
+type BlockConnected struct {
+	Block *Block
+}
+
+// a block was taken off the tip by a reorganisation and its transactions are out of the UTXO set
+type BlockDisconnected struct {
+	Block *Block
+	Spent []UnspentOutput //the outputs the block spent, back in the UTXO set
+}
+
+// a branch with more work replaced the tip, published after the BlockDisconnected and BlockConnected of its blocks
+type Reorg struct {
+	Fork         []byte   //hash of the last block both branches share
+	Disconnected []*Block //newest first
+	Connected    []*Block //oldest first
+}
+
+// a transaction entered the pool
+type TxAccepted struct {
+	Tx *Transaction
+}
+
+const (
+	RemovedConfirmed   = "confirmed"   //the transaction is in a block now
+	RemovedInvalidated = "invalidated" //a block spent one of its inputs or otherwise made it invalid
+)
+
+// a transaction left the pool
+type TxRemoved struct {
+	Tx     *Transaction
+	Reason string
+}
+
+// the confirmed balance of a watched address changed, see WatchBalances
+type BalanceChanged struct {
+	Address  string
+	Balance  int
+	Immature int
+}
+
+func (BlockConnected) Topic() string    { return TopicBlockConnected }
+func (BlockDisconnected) Topic() string { return TopicBlockDisconnected }
+func (Reorg) Topic() string             { return TopicReorg }
+func (TxAccepted) Topic() string        { return TopicTxAccepted }
+func (TxRemoved) Topic() string         { return TopicTxRemoved }
+func (BalanceChanged) Topic() string    { return TopicBalanceChanged }
+
+type Subscription struct {
+	bus     *EventBus
+	topics  map[string]bool //nil for every topic
+	handler func(Event)
+}
+
+type EventBus struct {
+	mu            sync.Mutex
+	subscriptions []*Subscription
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Calls the handler for every event of the given topics, or of every topic if none are given
+func (bus *EventBus) Subscribe(handler func(Event), topics ...string) *Subscription {
+	var sub *Subscription = &Subscription{bus: bus, handler: handler}
+	if len(topics) > 0 {
+		sub.topics = make(map[string]bool)
+		for _, topic := range topics {
+			sub.topics[topic] = true
+		}
+	}
+	bus.mu.Lock()
+	bus.subscriptions = append(bus.subscriptions, sub)
+	bus.mu.Unlock()
+	return sub
+}
+
+func (sub *Subscription) Unsubscribe() {
+	var bus *EventBus = sub.bus
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for idx, other := range bus.subscriptions {
+		if other == sub {
+			bus.subscriptions = append(bus.subscriptions[:idx:idx], bus.subscriptions[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Hands the event to the subscribers in the order they subscribed, a nil bus drops it
+func (bus *EventBus) Publish(event Event) {
+	if bus == nil {
+		return
+	}
+	bus.mu.Lock()
+	var subscriptions []*Subscription = bus.subscriptions //Unsubscribe copies, so this stays intact
+	bus.mu.Unlock()
+	for _, sub := range subscriptions {
+		if sub.topics == nil || sub.topics[event.Topic()] {
+			sub.handler(event)
+		}
+	}
+}
+
+/*
+	Publishes BalanceChanged whenever a connected or disconnected block changes the confirmed balance of one of
+	the addresses, including coinbase rewards that mature. The unspent outputs of the addresses are kept and each
+	block's inputs and outputs are applied to them, so a block costs no scan of the UTXO set. addresses is asked
+	again on every block, so wallets created later are picked up; only new addresses are looked up in the UTXO
+	set, and their first balance is published when it is not zero. addresses runs under the chain lock, it must
+	be cheap.
+*/
+func WatchBalances(chain *Blockchain, addresses func() []string) *Subscription {
+	var watcher *balanceWatcher = &balanceWatcher{
+		UTXO:    UTXOSet{Blockchain: chain},
+		scripts: make(map[string]string),
+		outputs: make(map[string]watchedOutput),
+		known:   make(map[string]Balance),
+	}
+	if len(chain.LastHash) > 0 {
+		watcher.track(addresses())
+		watcher.known = watcher.balances(chain.GetBestHeight() + 1)
+	}
+	return chain.Events.Subscribe(func(event Event) {
+		watcher.mu.Lock()
+		defer watcher.mu.Unlock()
+		watcher.track(addresses())
+		if len(watcher.scripts) == 0 {
+			return
+		}
+		var nextHeight int
+		switch event := event.(type) {
+		case BlockConnected:
+			watcher.connected(event.Block)
+			nextHeight = event.Block.Height + 1
+		case BlockDisconnected:
+			watcher.disconnected(event.Block, event.Spent)
+			nextHeight = event.Block.Height
+		}
+		for address, balance := range watcher.balances(nextHeight) {
+			if watcher.known[address] == balance {
+				continue
+			}
+			watcher.known[address] = balance
+			chain.Events.Publish(BalanceChanged{Address: address, Balance: balance.Spendable, Immature: balance.Immature})
+		}
+	}, TopicBlockConnected, TopicBlockDisconnected)
+}
+
+type watchedOutput struct {
+	address string
+	entry   UTXOEntry
+}
+
+type balanceWatcher struct {
+	mu      sync.Mutex
+	UTXO    UTXOSet
+	scripts map[string]string        //locking script --> watched address
+	outputs map[string]watchedOutput //outpointKey --> unspent output of a watched address
+	known   map[string]Balance       //the balances last published
+}
+
+// starts watching the addresses it does not watch yet, their outputs are looked up in the UTXO set
+func (watcher *balanceWatcher) track(addresses []string) {
+	var added map[string]string = make(map[string]string)
+	for _, address := range addresses {
+		var script string = string(AddressScript([]byte(address)))
+		if _, watched := watcher.scripts[script]; !watched {
+			added[script] = address
+			watcher.scripts[script] = address
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	watcher.UTXO.scanScripts(added, func(address string, output UnspentOutput) {
+		watcher.outputs[outpointKey(output.TxID, output.OutputIdx)] = watchedOutput{address: address, entry: output.UTXOEntry}
+	})
+}
+
+// applies a block that was connected, the outputs may be there already if track just found them
+func (watcher *balanceWatcher) connected(block *Block) {
+	for _, tx := range block.Transactions {
+		if !tx.Is_Coinbase() {
+			for _, input := range tx.Inputs {
+				delete(watcher.outputs, outpointKey(input.ID, input.OutputIdx))
+			}
+		}
+		for outIdx, output := range tx.Outputs {
+			if address, watched := watcher.scripts[string(output.Script)]; watched {
+				var entry UTXOEntry = UTXOEntry{Output: output, Height: block.Height, Coinbase: tx.Is_Coinbase()}
+				watcher.outputs[outpointKey(tx.ID, outIdx)] = watchedOutput{address: address, entry: entry}
+			}
+		}
+	}
+}
+
+// reverts a block that was disconnected, outputs it both created and spent are put back and removed again
+func (watcher *balanceWatcher) disconnected(block *Block, spent []UnspentOutput) {
+	for _, output := range spent {
+		if address, watched := watcher.scripts[string(output.Output.Script)]; watched {
+			watcher.outputs[outpointKey(output.TxID, output.OutputIdx)] = watchedOutput{address: address, entry: output.UTXOEntry}
+		}
+	}
+	for _, tx := range block.Transactions {
+		for outIdx := range tx.Outputs {
+			delete(watcher.outputs, outpointKey(tx.ID, outIdx))
+		}
+	}
+}
+
+func (watcher *balanceWatcher) balances(nextHeight int) map[string]Balance {
+	var balances map[string]Balance = make(map[string]Balance)
+	for _, address := range watcher.scripts {
+		balances[address] = Balance{}
+	}
+	for _, output := range watcher.outputs {
+		var balance Balance = balances[output.address]
+		if output.entry.IsMatureAt(nextHeight) {
+			balance.Spendable += output.entry.Output.Value
+		} else {
+			balance.Immature += output.entry.Output.Value
+		}
+		balances[output.address] = balance
+	}
+	return balances
+}
@@ -0,0 +1,117 @@
+package Blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+func TestEventBusTopics(t *testing.T) {
+	var bus *EventBus = NewEventBus()
+	var got []string
+	bus.Subscribe(func(event Event) { got = append(got, "all:"+event.Topic()) })
+	bus.Subscribe(func(event Event) { got = append(got, "tx:"+event.Topic()) }, TopicTxAccepted, TopicTxRemoved)
+
+	bus.Publish(BlockConnected{})
+	bus.Publish(TxAccepted{})
+	var want []string = []string{"all:blockconnected", "all:txaccepted", "tx:txaccepted"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	var nilBus *EventBus
+	nilBus.Publish(BlockConnected{}) //dropped
+}
+
+func TestUnsubscribeWhilePublishing(t *testing.T) {
+	var bus *EventBus = NewEventBus()
+	var calls [3]int
+	var second *Subscription
+	bus.Subscribe(func(Event) {
+		calls[0]++
+		second.Unsubscribe()
+	})
+	second = bus.Subscribe(func(Event) { calls[1]++ })
+	bus.Subscribe(func(Event) { calls[2]++ })
+
+	bus.Publish(TxAccepted{})
+	bus.Publish(TxAccepted{})
+	//the event being published still reaches the subscriber that was removed, later ones do not
+	if calls != [3]int{2, 1, 2} {
+		t.Errorf("got %v calls", calls)
+	}
+}
+
+func TestHandlerMayPublish(t *testing.T) {
+	var bus *EventBus = NewEventBus()
+	var removed int
+	bus.Subscribe(func(event Event) { bus.Publish(TxRemoved{Tx: event.(TxAccepted).Tx}) }, TopicTxAccepted)
+	bus.Subscribe(func(Event) { removed++ }, TopicTxRemoved)
+	bus.Publish(TxAccepted{})
+	if removed != 1 {
+		t.Errorf("got %d nested events", removed)
+	}
+}
+
+func TestChainAndPoolEvents(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var pool *Mempool = NewMempool()
+	var events []Event
+	chain.Events.Subscribe(func(event Event) { events = append(events, event) })
+
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(Wallet.MakeWallet(), 50)})
+	err := UTXO.AcceptToMempool(pool, spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].(TxAccepted).Tx != spend {
+		t.Fatalf("got %v, want the accepted transaction", events)
+	}
+
+	var block *Block = chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1), spend})
+	UTXO.Update(block)
+	UTXO.UpdateMempool(pool, block)
+	if len(events) != 3 {
+		t.Fatalf("got %d events", len(events))
+	}
+	if connected, ok := events[1].(BlockConnected); !ok || !bytes.Equal(connected.Block.Hash, block.Hash) {
+		t.Errorf("got %v, want the connected block", events[1])
+	}
+	if removed, ok := events[2].(TxRemoved); !ok || removed.Reason != RemovedConfirmed || !bytes.Equal(removed.Tx.ID, spend.ID) {
+		t.Errorf("got %v, want the confirmed transaction", events[2])
+	}
+}
+
+func TestWatchBalances(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var owner string = string(w.CreateAddress())
+	var payee string = string(Wallet.MakeWallet().CreateAddress())
+	var changes []BalanceChanged
+	chain.Events.Subscribe(func(event Event) { changes = append(changes, event.(BalanceChanged)) }, TopicBalanceChanged)
+	WatchBalances(chain, func() []string { return []string{owner, payee} })
+
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{*NewTxOutput(20, payee), *NewTxOutput(Params.Active.InitialSubsidy-20, owner)})
+	var block *Block = chain.AddBlock([]*Transaction{CoinbaseTx(string(Wallet.MakeWallet().CreateAddress()), "", chain.GetBestHeight()+1), spend})
+	UTXO.Update(block)
+
+	if len(changes) != 2 {
+		t.Fatalf("got %v, want the owner's and the payee's balance", changes)
+	}
+	for _, change := range changes {
+		var want int = map[string]int{owner: Params.Active.InitialSubsidy - 20, payee: 20}[change.Address]
+		if change.Balance != want {
+			t.Errorf("%s: got %d, want %d", change.Address, change.Balance, want)
+		}
+	}
+}
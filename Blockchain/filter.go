@@ -0,0 +1,420 @@
+package Blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+/*
+	Compact block filters let a light wallet find the blocks that concern it without telling the server its addresses.
+	Every block gets a Golomb coded set of the hashes its outputs pay to and of the outpoints its inputs spend.
+	The wallet downloads the filters, tests its own items locally and only fetches the blocks that match.
+	A filter can match by accident (about 1 in M items), it never misses an item that is in the block.
+
+	Each filter also gets a filter header, the hash of the filter chained with the previous filter header, so
+	filters served by different servers can be compared by their headers alone.
+*/
+
+const (
+	filterPrefix       = "cf-"  //block hash --> encoded filter
+	filterHeaderPrefix = "cfh-" //block hash --> filter header
+	filterP            = 19     //bits of the remainder in the Golomb-Rice coding
+	filterM            = 784931 //1/M is the false positive rate per item
+	filterKeyLength    = 16     //bytes of the block hash that key the item hashes
+)
+
+type CompactFilter struct {
+	N    int    //number of items in the set
+	Data []byte //Golomb-Rice coded sorted differences of the item hashes
+}
+
+// a filter as served to clients, together with the block it belongs to and its filter header
+type BlockFilter struct {
+	BlockHash []byte
+	Height    int
+	Filter    CompactFilter
+	Header    []byte
+}
+
+// The item an output adds to a filter: the public key hash or script hash it pays to, nil for data outputs
+func OutputFilterItem(script []byte) []byte {
+	_, _, inner := SplitTimelockScript(script) //a timelocked output pays to the script behind the lock
+	if pubKeyHash := ExtractPubKeyHash(inner); pubKeyHash != nil {
+		return pubKeyHash
+	}
+	if scriptHash := ExtractScriptHash(inner); scriptHash != nil {
+		return scriptHash
+	}
+	if _, isData := ExtractData(inner); isData {
+		return nil
+	}
+	return inner
+}
+
+// The item an input adds to a filter: the outpoint it spends
+func OutpointFilterItem(txID []byte, outputIdx int) []byte {
+	return append(append([]byte{}, txID...), ToHex(int64(outputIdx))...)
+}
+
+func (block *Block) filterItems() [][]byte {
+	var items [][]byte
+	for _, tx := range block.Transactions {
+		for _, output := range tx.Outputs {
+			if item := OutputFilterItem(output.Script); item != nil {
+				items = append(items, item)
+			}
+		}
+		if tx.Is_Coinbase() {
+			continue
+		}
+		for _, input := range tx.Inputs {
+			items = append(items, OutpointFilterItem(input.ID, input.OutputIdx))
+		}
+	}
+	return items
+}
+
+// maps an item to [0, modulus), keyed with the block hash so the same item lands differently in every block
+func hashFilterItem(key []byte, item []byte, modulus uint64) uint64 {
+	var hash [32]byte = sha256.Sum256(append(append([]byte{}, key...), item...))
+	high, _ := bits.Mul64(binary.BigEndian.Uint64(hash[:8]), modulus)
+	return high
+}
+
+// the key of a block's filter, the start of the block hash
+func filterKey(blockHash []byte) ([]byte, error) {
+	if len(blockHash) < filterKeyLength {
+		return nil, fmt.Errorf("block hash %x is too short to key a filter", blockHash)
+	}
+	return blockHash[:filterKeyLength], nil
+}
+
+func hashedFilterSet(key []byte, items [][]byte, n int) []uint64 {
+	var modulus uint64 = uint64(n) * filterM
+	var values []uint64
+	for _, item := range items {
+		values = append(values, hashFilterItem(key, item, modulus))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+func NewCompactFilter(blockHash []byte, items [][]byte) (CompactFilter, error) {
+	key, err := filterKey(blockHash)
+	if err != nil {
+		return CompactFilter{}, err
+	}
+	var unique map[string]bool = make(map[string]bool)
+	var deduped [][]byte
+	for _, item := range items {
+		if !unique[string(item)] {
+			unique[string(item)] = true
+			deduped = append(deduped, item)
+		}
+	}
+	var filter CompactFilter = CompactFilter{N: len(deduped)}
+	if filter.N == 0 {
+		return filter, nil
+	}
+
+	var writer bitWriter
+	var last uint64 = 0
+	for _, value := range hashedFilterSet(key, deduped, filter.N) {
+		var delta uint64 = value - last
+		last = value
+		for quotient := delta >> filterP; quotient > 0; quotient-- {
+			writer.writeBit(1)
+		}
+		writer.writeBit(0)
+		writer.writeBits(delta, filterP)
+	}
+	filter.Data = writer.bytes
+	return filter, nil
+}
+
+func (block *Block) CompactFilter() (CompactFilter, error) {
+	return NewCompactFilter(block.Hash, block.filterItems())
+}
+
+// true if any of the items is (probably) in the set, blockHash has to be the block the filter was built for
+func (filter CompactFilter) MatchAny(blockHash []byte, items [][]byte) (bool, error) {
+	key, err := filterKey(blockHash)
+	if err != nil {
+		return false, err
+	}
+	if filter.N == 0 || len(items) == 0 {
+		return false, nil
+	}
+	var queries []uint64 = hashedFilterSet(key, items, filter.N)
+
+	var reader bitReader = bitReader{bytes: filter.Data}
+	var value uint64 = 0
+	var next int = 0
+	for i := 0; i < filter.N; i++ {
+		var quotient uint64 = 0
+		for {
+			bit, err := reader.readBit()
+			if err != nil {
+				return false, err
+			}
+			if bit == 0 {
+				break
+			}
+			quotient++
+		}
+		remainder, err := reader.readBits(filterP)
+		if err != nil {
+			return false, err
+		}
+		value += quotient<<filterP + remainder
+
+		for next < len(queries) && queries[next] < value {
+			next++
+		}
+		if next == len(queries) {
+			return false, nil
+		}
+		if queries[next] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (filter CompactFilter) Serialize() []byte {
+	return append(ToHex(int64(filter.N)), filter.Data...)
+}
+
+// the filter header commits to the filter and to every filter before it
+func FilterHeader(filter CompactFilter, prevHeader []byte) []byte {
+	var filterHash [32]byte = sha256.Sum256(filter.Serialize())
+	var header [32]byte = sha256.Sum256(append(filterHash[:], prevHeader...))
+	return header[:]
+}
+
+// the filter header before the genesis filter
+var genesisPrevFilterHeader = make([]byte, 32)
+
+// Builds and stores the filter of a block that is being connected, inside the transaction that stores the block.
+// Chains created before filters existed have no header to link to, reindexfilters builds those first.
+func storeBlockFilter(txn *badger.Txn, block *Block) error {
+	var prevHeader []byte = genesisPrevFilterHeader
+	if len(block.PrevHash) != 0 {
+		item, err := txn.Get(append([]byte(filterHeaderPrefix), block.PrevHash...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		prevHeader, err = item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+	}
+	filter, err := block.CompactFilter()
+	if err != nil {
+		return err
+	}
+	var encoded bytes.Buffer
+	err = gob.NewEncoder(&encoded).Encode(filter)
+	if err != nil {
+		return err
+	}
+	err = txn.Set(append([]byte(filterPrefix), block.Hash...), encoded.Bytes())
+	if err != nil {
+		return err
+	}
+	return txn.Set(append([]byte(filterHeaderPrefix), block.Hash...), FilterHeader(filter, prevHeader))
+}
+
+// Rebuilds the filters of every block, from the genesis block up
+func (chain *Blockchain) ReindexFilters() int {
+	var blocks []*Block
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		blocks = append([]*Block{block}, blocks...)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	for _, block := range blocks {
+		var err error = chain.Database.Update(func(txn *badger.Txn) error {
+			return storeBlockFilter(txn, block)
+		})
+		Handle(err)
+	}
+	return len(blocks)
+}
+
+// The stored filters of the blocks from the given height up to the tip, oldest first
+func (chain *Blockchain) GetBlockFilters(fromHeight int) ([]BlockFilter, error) {
+	var filters []BlockFilter
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		if block.Height < fromHeight {
+			break
+		}
+		var blockFilter BlockFilter = BlockFilter{BlockHash: block.Hash, Height: block.Height}
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(append([]byte(filterPrefix), block.Hash...))
+			if err != nil {
+				return err
+			}
+			encoded, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&blockFilter.Filter)
+			if err != nil {
+				return err
+			}
+			item, err = txn.Get(append([]byte(filterHeaderPrefix), block.Hash...))
+			if err != nil {
+				return err
+			}
+			blockFilter.Header, err = item.ValueCopy(nil)
+			return err
+		})
+		if err == badger.ErrKeyNotFound {
+			return nil, fmt.Errorf("block %x has no filter, run reindexfilters", block.Hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		filters = append([]BlockFilter{blockFilter}, filters...)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return filters, nil
+}
+
+/*
+Checks filters received from a server before they are used: they have to belong to the blocks of the stored
+header chain and their filter headers have to link up. The first filter header is taken on trust (compare it with
+other servers), unless the filter header before it was stored by an earlier scan.
+Returns the heights of the blocks that match any of the items.
+*/
+func (headerChain *HeaderChain) ScanFilters(filters []BlockFilter, items [][]byte) ([]int, error) {
+	var matches []int
+	for idx, blockFilter := range filters {
+		stored, found := headerChain.HeaderAt(blockFilter.Height)
+		if !found || !bytes.Equal(stored.Hash, blockFilter.BlockHash) {
+			return nil, fmt.Errorf("filter for block %x does not belong to the header chain", blockFilter.BlockHash)
+		}
+		var prevHeader []byte
+		switch {
+		case blockFilter.Height == 0:
+			prevHeader = genesisPrevFilterHeader
+		case idx > 0:
+			if filters[idx-1].Height != blockFilter.Height-1 {
+				return nil, errors.New("filters are not consecutive")
+			}
+			prevHeader = filters[idx-1].Header
+		case blockFilter.Height-1 < len(headerChain.FilterHeaders):
+			prevHeader = headerChain.FilterHeaders[blockFilter.Height-1]
+		}
+		if prevHeader != nil && !bytes.Equal(FilterHeader(blockFilter.Filter, prevHeader), blockFilter.Header) {
+			return nil, fmt.Errorf("filter header of block %x does not match the filter", blockFilter.BlockHash)
+		}
+
+		match, err := blockFilter.Filter.MatchAny(blockFilter.BlockHash, items)
+		if err != nil {
+			return nil, fmt.Errorf("filter of block %x is malformed: %w", blockFilter.BlockHash, err)
+		}
+		if match {
+			matches = append(matches, blockFilter.Height)
+		}
+		if blockFilter.Height == len(headerChain.FilterHeaders) {
+			headerChain.FilterHeaders = append(headerChain.FilterHeaders, blockFilter.Header)
+		}
+	}
+	return matches, nil
+}
+
+func BlockFiltersToHex(filters []BlockFilter) string {
+	var encoded bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&encoded)
+	var err error = encoder.Encode(filters)
+	Handle(err)
+	return hex.EncodeToString(encoded.Bytes())
+}
+
+func BlockFiltersFromHex(data string) ([]BlockFilter, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	var filters []BlockFilter
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(raw))
+	err = decoder.Decode(&filters)
+	if err != nil {
+		return nil, err
+	}
+	for _, blockFilter := range filters {
+		if len(blockFilter.BlockHash) < 16 || blockFilter.Filter.N < 0 || blockFilter.Filter.N > len(blockFilter.Filter.Data)*8/(filterP+1) {
+			return nil, errors.New("malformed block filter")
+		}
+	}
+	return filters, nil
+}
+
+type bitWriter struct {
+	bytes []byte
+	used  uint //bits used in the last byte, 0 means a new byte is needed
+}
+
+func (writer *bitWriter) writeBit(bit uint64) {
+	if writer.used == 0 {
+		writer.bytes = append(writer.bytes, 0)
+	}
+	if bit == 1 {
+		writer.bytes[len(writer.bytes)-1] |= 1 << (7 - writer.used)
+	}
+	writer.used = (writer.used + 1) % 8
+}
+
+// writes the lowest count bits of value, most significant first
+func (writer *bitWriter) writeBits(value uint64, count uint) {
+	for i := count; i > 0; i-- {
+		writer.writeBit((value >> (i - 1)) & 1)
+	}
+}
+
+type bitReader struct {
+	bytes    []byte
+	position uint
+}
+
+func (reader *bitReader) readBit() (uint64, error) {
+	if reader.position/8 >= uint(len(reader.bytes)) {
+		return 0, errors.New("filter ended early")
+	}
+	var bit byte = (reader.bytes[reader.position/8] >> (7 - reader.position%8)) & 1
+	reader.position++
+	return uint64(bit), nil
+}
+
+func (reader *bitReader) readBits(count uint) (uint64, error) {
+	var value uint64 = 0
+	for i := uint(0); i < count; i++ {
+		bit, err := reader.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+	return value, nil
+}
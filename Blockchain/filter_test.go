@@ -0,0 +1,176 @@
+package Blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+func testBlockHash(seed string) []byte {
+	var hash [32]byte = sha256.Sum256([]byte(seed))
+	return hash[:]
+}
+
+func TestCompactFilterMatchesItsItems(t *testing.T) {
+	var blockHash []byte = testBlockHash("block")
+	var items [][]byte
+	for i := 0; i < 200; i++ {
+		items = append(items, []byte(fmt.Sprintf("item %d", i)))
+	}
+	filter, err := NewCompactFilter(blockHash, append(items, items[0], items[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.N != len(items) {
+		t.Errorf("got %d items, duplicates should count once", filter.N)
+	}
+	for _, item := range items {
+		match, err := filter.MatchAny(blockHash, [][]byte{item})
+		if err != nil || !match {
+			t.Fatalf("%s is not matched: %v", item, err)
+		}
+	}
+
+	var falsePositives int = 0
+	for i := 0; i < 1000; i++ {
+		match, err := filter.MatchAny(blockHash, [][]byte{[]byte(fmt.Sprintf("other %d", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match {
+			falsePositives++
+		}
+	}
+	if falsePositives > 2 { //about 1 in filterM is expected
+		t.Errorf("%d of 1000 other items matched", falsePositives)
+	}
+
+	match, err := filter.MatchAny(blockHash, [][]byte{[]byte("other"), items[150]})
+	if err != nil || !match {
+		t.Errorf("a set of items with one member is not matched: %v", err)
+	}
+}
+
+// the same items hash differently in every block, a filter only works with the hash it was built for
+func TestCompactFilterIsKeyedByBlock(t *testing.T) {
+	var items [][]byte = [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	first, err := NewCompactFilter(testBlockHash("first"), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewCompactFilter(testBlockHash("second"), items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Data, second.Data) {
+		t.Error("the filters of two blocks are the same")
+	}
+}
+
+func TestCompactFilterShortBlockHash(t *testing.T) {
+	if _, err := NewCompactFilter(make([]byte, filterKeyLength-1), [][]byte{[]byte("a")}); err == nil {
+		t.Error("built a filter keyed with a short hash")
+	}
+	filter, err := NewCompactFilter(testBlockHash("block"), [][]byte{[]byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range [][]byte{nil, {1, 2, 3}} {
+		if _, err := filter.MatchAny(hash, [][]byte{[]byte("a")}); err == nil {
+			t.Errorf("matched with the block hash %x", hash)
+		}
+	}
+}
+
+func TestCompactFilterMalformed(t *testing.T) {
+	var empty CompactFilter
+	match, err := empty.MatchAny(testBlockHash("block"), [][]byte{[]byte("a")})
+	if err != nil || match {
+		t.Errorf("an empty filter matched: %v %v", match, err)
+	}
+	var truncated CompactFilter = CompactFilter{N: 3}
+	if _, err := truncated.MatchAny(testBlockHash("block"), [][]byte{[]byte("a")}); err == nil {
+		t.Error("a filter without data was read")
+	}
+}
+
+func TestBlockFilterItems(t *testing.T) {
+	var pubKeyHash []byte = bytes.Repeat([]byte{1}, 20)
+	var lockedHash []byte = bytes.Repeat([]byte{2}, 20)
+	var spentTx []byte = testBlockHash("spent")
+	var coinbase Transaction = Transaction{
+		Inputs:  []TxInput{{ID: []byte{}, OutputIdx: -1, Script: PushData([]byte("coinbase"))}},
+		Outputs: []TxOutput{{Value: 50, Script: P2PKHScript(pubKeyHash)}},
+	}
+	var spend Transaction = Transaction{
+		Inputs: []TxInput{{ID: spentTx, OutputIdx: 1}},
+		Outputs: []TxOutput{
+			{Value: 5, Script: TimelockScript(100, false, P2PKHScript(lockedHash))},
+			{Value: 0, Script: DataScript([]byte("data"))},
+		},
+	}
+	var block Block = Block{Hash: testBlockHash("block"), Transactions: []*Transaction{&coinbase, &spend}}
+	filter, err := block.CompactFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.N != 3 {
+		t.Errorf("got %d items, want the two paid hashes and the spent outpoint", filter.N)
+	}
+	for _, item := range [][]byte{pubKeyHash, lockedHash, OutpointFilterItem(spentTx, 1)} {
+		match, err := filter.MatchAny(block.Hash, [][]byte{item})
+		if err != nil || !match {
+			t.Errorf("%x is not matched: %v", item, err)
+		}
+	}
+	match, err := filter.MatchAny(block.Hash, [][]byte{OutpointFilterItem(spentTx, 0)})
+	if err != nil || match {
+		t.Errorf("another output of the spent transaction matched: %v", err)
+	}
+}
+
+func TestScanFilters(t *testing.T) {
+	var w, payee *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1)}))
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1), spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(payee, 50)})}))
+
+	var headerChain HeaderChain
+	_, err := headerChain.AddHeaders(chain.GetHeaders(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err := chain.GetBlockFilters(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payeeItem []byte = OutputFilterItem(payTo(payee, 1).Script)
+	matches, err := headerChain.ScanFilters(filters, [][]byte{payeeItem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0] != 2 {
+		t.Errorf("got the blocks %v, want the block at height 2", matches)
+	}
+	if len(headerChain.FilterHeaders) != 3 {
+		t.Errorf("stored %d filter headers", len(headerChain.FilterHeaders))
+	}
+
+	var changed []BlockFilter = append([]BlockFilter{}, filters...)
+	changed[2].Filter, err = NewCompactFilter(changed[2].BlockHash, nil) //hides the payment
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rescan HeaderChain
+	_, err = rescan.AddHeaders(chain.GetHeaders(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rescan.ScanFilters(changed, [][]byte{payeeItem}); err == nil {
+		t.Error("accepted a filter that does not match its filter header")
+	}
+}
@@ -0,0 +1,225 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var mempoolFile string //see nodePath
+
+// the pool kept between runs, transactions queued by send wait here until mine or a node picks them up
+func mempoolPath() string {
+	return nodePath(mempoolFile, "./temp/mempool.data")
+}
+
+// Transactions that were accepted but are not in a block yet. Every transaction spends confirmed outputs only and
+// no two transactions spend the same output, so any subset can go into the next block together.
+// The pool is not safe for concurrent use, the node guards it together with the chain.
+type Mempool struct {
+	transactions map[string]*Transaction
+	order        []string          //transaction ids in the order they arrived
+	spent        map[string]string //outpoint --> id of the pool transaction spending it
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{transactions: make(map[string]*Transaction), spent: make(map[string]string)}
+}
+
+func outpointKey(txID []byte, outputIdx int) string {
+	return fmt.Sprintf("%x:%d", txID, outputIdx)
+}
+
+func (pool *Mempool) Has(txID []byte) bool {
+	_, found := pool.transactions[hex.EncodeToString(txID)]
+	return found
+}
+
+func (pool *Mempool) Get(txID []byte) (*Transaction, bool) {
+	tx, found := pool.transactions[hex.EncodeToString(txID)]
+	return tx, found
+}
+
+func (pool *Mempool) Count() int {
+	return len(pool.order)
+}
+
+// whether a pooled transaction spends the output, false for a nil pool
+func (pool *Mempool) Spends(txID []byte, outputIdx int) bool {
+	if pool == nil {
+		return false
+	}
+	_, found := pool.spent[outpointKey(txID, outputIdx)]
+	return found
+}
+
+// the pooled transactions, oldest first
+func (pool *Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, txID := range pool.order {
+		txs = append(txs, pool.transactions[txID])
+	}
+	return txs
+}
+
+// Validates the transaction against the chain and the pool and adds it
+func (u UTXOSet) AcceptToMempool(pool *Mempool, tx *Transaction) error {
+	if pool.Has(tx.ID) {
+		return contextErrorf("transaction %x is already in the pool", tx.ID)
+	}
+	for _, input := range tx.Inputs {
+		if other, found := pool.spent[outpointKey(input.ID, input.OutputIdx)]; found {
+			return contextErrorf("output %x:%d is already spent by pool transaction %s", input.ID, input.OutputIdx, other)
+		}
+	}
+	err := u.ValidateTransaction(tx)
+	if err != nil {
+		return err
+	}
+	pool.add(tx)
+	u.Blockchain.Events.Publish(TxAccepted{Tx: tx})
+	return nil
+}
+
+func (pool *Mempool) add(tx *Transaction) {
+	var txID string = hex.EncodeToString(tx.ID)
+	pool.transactions[txID] = tx
+	pool.order = append(pool.order, txID)
+	for _, input := range tx.Inputs {
+		pool.spent[outpointKey(input.ID, input.OutputIdx)] = txID
+	}
+}
+
+func (pool *Mempool) Remove(txID []byte) {
+	var id string = hex.EncodeToString(txID)
+	tx, found := pool.transactions[id]
+	if !found {
+		return
+	}
+	delete(pool.transactions, id)
+	for _, input := range tx.Inputs {
+		delete(pool.spent, outpointKey(input.ID, input.OutputIdx))
+	}
+	for idx, pooled := range pool.order {
+		if pooled == id {
+			pool.order = append(pool.order[:idx], pool.order[idx+1:]...)
+			break
+		}
+	}
+}
+
+// The ids of the transactions whose outputs the transaction spends but that are not in the chain. Such a
+// transaction is not invalid yet, it may become valid once its parents are mined.
+func (u UTXOSet) MissingParents(tx *Transaction) [][]byte {
+	var missing [][]byte
+	for _, input := range tx.Inputs {
+		if _, found := u.FindOutput(input.ID, input.OutputIdx); found {
+			continue
+		}
+		if _, err := u.Blockchain.FindTransaction(input.ID); err != nil {
+			missing = append(missing, input.ID)
+		}
+	}
+	return missing
+}
+
+// Drops the transactions of a newly connected block and every transaction it made invalid (e.g. a double spend
+// that lost), returns the number of transactions removed
+func (u UTXOSet) UpdateMempool(pool *Mempool, block *Block) int {
+	var removed int = 0
+	for _, tx := range block.Transactions {
+		if pooled, found := pool.Get(tx.ID); found {
+			pool.Remove(tx.ID)
+			u.Blockchain.Events.Publish(TxRemoved{Tx: pooled, Reason: RemovedConfirmed})
+			removed++
+		}
+	}
+	for _, tx := range pool.Transactions() {
+		if u.ValidateTransaction(tx) != nil {
+			pool.Remove(tx.ID)
+			u.Blockchain.Events.Publish(TxRemoved{Tx: tx, Reason: RemovedInvalidated})
+			removed++
+		}
+	}
+	return removed
+}
+
+/*
+	Brings the pool in line with a reorganisation: the transactions of the disconnected blocks go back into the pool
+	(oldest first) if they are still valid on the new branch, then UpdateMempool runs for every connected block.
+	A disconnected transaction spending another one that went back to the pool is dropped, the pool only holds
+	transactions that spend confirmed outputs.
+*/
+func (u UTXOSet) ReorgMempool(pool *Mempool, reorg Reorg) {
+	for idx := len(reorg.Disconnected) - 1; idx >= 0; idx-- {
+		for _, tx := range reorg.Disconnected[idx].Transactions {
+			if !tx.Is_Coinbase() {
+				u.AcceptToMempool(pool, tx) //fails if the new branch spent its inputs or confirmed it again
+			}
+		}
+	}
+	for _, block := range reorg.Connected {
+		u.UpdateMempool(pool, block)
+	}
+}
+
+// Writes the pooled transactions to the mempool file, oldest first
+func (pool *Mempool) Save() error {
+	var txs [][]byte
+	for _, tx := range pool.Transactions() {
+		txs = append(txs, tx.Serialize())
+	}
+	var content bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&content)
+	err := encoder.Encode(txs)
+	if err != nil {
+		return err
+	}
+	var file string = mempoolPath()
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file+".tmp", content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+/*
+	Loads the pool written by Save. Every transaction is validated again, those the chain made invalid in the
+	meantime (e.g. mined elsewhere or double spent) are dropped. An empty chain cannot validate anything, so the
+	file is not read then.
+*/
+func (u UTXOSet) LoadMempool() (*Mempool, error) {
+	var pool *Mempool = NewMempool()
+	if len(u.Blockchain.LastHash) == 0 {
+		return pool, nil
+	}
+	content, err := os.ReadFile(mempoolPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return pool, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var txs [][]byte
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(content))
+	err = decoder.Decode(&txs)
+	if err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %w", mempoolPath(), err)
+	}
+	for _, data := range txs {
+		tx, err := DeserializeTransaction(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s is corrupt: %w", mempoolPath(), err)
+		}
+		u.AcceptToMempool(pool, tx) //no longer valid if it fails
+	}
+	return pool, nil
+}
@@ -1,9 +1,26 @@
 package Blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+/*
+	Leaves and inner nodes are hashed with a different prefix byte, so an inner node can never be passed off
+	as a leaf (or the other way round) to prove something that is not in the tree.
+	The tree is built level by level, a node without a partner at the end of an odd sized level is moved up
+	unchanged instead of being paired with a copy of itself, so no two different leaf lists share a root.
+*/
+
+const (
+	leafPrefix  byte = 0x00
+	innerPrefix byte = 0x01
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+	levels   [][]*MerkleNode //levels[0] are the leaves, the last level only holds the root
 }
 type MerkleNode struct {
 	Left  *MerkleNode
@@ -15,12 +32,9 @@ func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode
 	var mNode MerkleNode = MerkleNode{}
 
 	if left == nil && right == nil {
-		var hash [32]byte = sha256.Sum256(data)
-		mNode.Data = hash[:]
+		mNode.Data = hashLeaf(data)
 	} else {
-		var prevHashes []byte = append(left.Data, right.Data...)
-		var hash [32]byte = sha256.Sum256(prevHashes)
-		mNode.Data = hash[:]
+		mNode.Data = hashInner(left.Data, right.Data)
 	}
 
 	mNode.Left = left
@@ -29,30 +43,95 @@ func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode
 	return &mNode
 }
 
-func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
+func hashLeaf(data []byte) []byte {
+	var hash [32]byte = sha256.Sum256(append([]byte{leafPrefix}, data...))
+	return hash[:]
+}
 
-	if len(data) % 2 != 0{
-		data = append(data, data[len(data)-1])	//concatenate the duplicate of last element of the slice to the end of the slice so as to make the length of the elements even
-	}
+func hashInner(left []byte, right []byte) []byte {
+	var combined []byte = append([]byte{innerPrefix}, left...)
+	var hash [32]byte = sha256.Sum256(append(combined, right...))
+	return hash[:]
+}
+
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var nodes []*MerkleNode
 
 	for _, info := range data {
-		var node MerkleNode = MerkleNode{Data: info, Left: nil, Right: nil}
-		nodes = append(nodes, node)
+		nodes = append(nodes, NewMerkleNode(nil, nil, info))
+	}
+	if len(nodes) == 0 {
+		var empty [32]byte = sha256.Sum256([]byte{}) //blocks always hold a coinbase, this only keeps the function total
+		nodes = append(nodes, &MerkleNode{Data: empty[:]})
 	}
 
-	for i := 0; i < len(data)/2; i++ {
-		var newLevel []MerkleNode
+	var mTree MerkleTree = MerkleTree{levels: [][]*MerkleNode{nodes}}
+	for len(nodes) > 1 {
+		var newLevel []*MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j]/*Left*/, &nodes[j+1]/*Right*/, nil/*data*/)	//initialising the parent node
-			newLevel = append(newLevel, *node)	//appending the parent node to the new level
+			if j+1 == len(nodes) {
+				newLevel = append(newLevel, nodes[j]) //odd one out, moved up as it is
+				continue
+			}
+			newLevel = append(newLevel, NewMerkleNode(nodes[j] /*Left*/, nodes[j+1] /*Right*/, nil /*data*/)) //the parent node
 		}
 
-		nodes = newLevel	//updating the nodes slice with the new level(parent nodes right now are child nodes to the next level parent nodes)
+		nodes = newLevel //the parent nodes are the child nodes of the next level
+		mTree.levels = append(mTree.levels, nodes)
 	}
 
-	var mTree MerkleTree = MerkleTree{RootNode: &nodes[0]}
-
+	mTree.RootNode = nodes[0]
 	return &mTree
 }
+
+// The sibling hashes on the way from a leaf to the root, enough to prove the leaf is part of the tree
+type MerkleProof struct {
+	Index     int      //position of the leaf
+	LeafCount int      //together with Index this determines on which side each sibling goes and where nodes moved up
+	Siblings  [][]byte //from the leaf level upwards, levels where the node moved up unchanged have no sibling
+}
+
+// Builds the inclusion proof for the leaf at index (in the order the data was given to NewMerkleTree)
+func (tree *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(tree.levels[0]) {
+		return nil, errors.New("leaf index out of range")
+	}
+	var proof MerkleProof = MerkleProof{Index: index, LeafCount: len(tree.levels[0])}
+	var position int = index
+	for _, level := range tree.levels[:len(tree.levels)-1] {
+		if position%2 == 1 {
+			proof.Siblings = append(proof.Siblings, level[position-1].Data)
+		} else if position+1 < len(level) {
+			proof.Siblings = append(proof.Siblings, level[position+1].Data)
+		}
+		position /= 2
+	}
+	return &proof, nil
+}
+
+// Checks that leaf is part of the tree with the given root, without needing the rest of the tree
+func VerifyProof(root []byte, leaf []byte, proof *MerkleProof) bool {
+	if proof.Index < 0 || proof.Index >= proof.LeafCount {
+		return false
+	}
+	var hash []byte = hashLeaf(leaf)
+	var position, levelSize int = proof.Index, proof.LeafCount
+	var siblings [][]byte = proof.Siblings
+	for levelSize > 1 {
+		if position%2 == 1 || position+1 < levelSize { //the node has a partner on this level
+			if len(siblings) == 0 {
+				return false
+			}
+			if position%2 == 1 {
+				hash = hashInner(siblings[0], hash)
+			} else {
+				hash = hashInner(hash, siblings[0])
+			}
+			siblings = siblings[1:]
+		}
+		position /= 2
+		levelSize = (levelSize + 1) / 2
+	}
+	return len(siblings) == 0 && bytes.Equal(hash, root)
+}
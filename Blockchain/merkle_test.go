@@ -0,0 +1,166 @@
+package Blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+func testLeaves(count int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < count; i++ {
+		leaves = append(leaves, []byte(fmt.Sprintf("leaf %d", i)))
+	}
+	return leaves
+}
+
+func TestMerkleProofEveryLeaf(t *testing.T) {
+	for count := 1; count <= 17; count++ {
+		var leaves [][]byte = testLeaves(count)
+		var tree *MerkleTree = NewMerkleTree(leaves)
+		for idx, leaf := range leaves {
+			proof, err := tree.Proof(idx)
+			if err != nil {
+				t.Fatalf("%d leaves, leaf %d: %s", count, idx, err)
+			}
+			if !VerifyProof(tree.RootNode.Data, leaf, proof) {
+				t.Errorf("%d leaves: the proof of leaf %d does not verify", count, idx)
+			}
+			if VerifyProof(tree.RootNode.Data, []byte("not a leaf"), proof) {
+				t.Errorf("%d leaves: the proof of leaf %d verifies another leaf", count, idx)
+			}
+		}
+	}
+}
+
+func TestMerkleProofTampered(t *testing.T) {
+	var leaves [][]byte = testLeaves(7)
+	var tree *MerkleTree = NewMerkleTree(leaves)
+	proof, err := tree.Proof(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root []byte = tree.RootNode.Data
+
+	var moved MerkleProof = *proof
+	moved.Index = 3
+	if VerifyProof(root, leaves[2], &moved) {
+		t.Error("verified at another index")
+	}
+	var flipped MerkleProof = *proof
+	flipped.Siblings = append([][]byte{}, proof.Siblings...)
+	flipped.Siblings[0] = bytes.Repeat([]byte{0}, 32)
+	if VerifyProof(root, leaves[2], &flipped) {
+		t.Error("verified with a changed sibling")
+	}
+	var extra MerkleProof = *proof
+	extra.Siblings = append(append([][]byte{}, proof.Siblings...), root)
+	if VerifyProof(root, leaves[2], &extra) {
+		t.Error("verified with an extra sibling")
+	}
+	var outside MerkleProof = *proof
+	outside.Index = outside.LeafCount
+	if VerifyProof(root, leaves[2], &outside) {
+		t.Error("verified an index outside the tree")
+	}
+	if _, err := tree.Proof(len(leaves)); err == nil {
+		t.Error("built a proof for a leaf that does not exist")
+	}
+}
+
+// copying the last leaf of an odd level must not give the same root, as it would if it was paired with itself
+func TestMerkleRootDuplicatedLeaf(t *testing.T) {
+	var leaves [][]byte = testLeaves(3)
+	var duplicated [][]byte = append(append([][]byte{}, leaves...), leaves[2])
+	if bytes.Equal(NewMerkleTree(leaves).RootNode.Data, NewMerkleTree(duplicated).RootNode.Data) {
+		t.Error("a duplicated last leaf gives the same root")
+	}
+}
+
+// an inner node cannot be proven as a leaf of a smaller tree
+func TestMerkleInnerNodeIsNoLeaf(t *testing.T) {
+	var tree *MerkleTree = NewMerkleTree(testLeaves(4))
+	var left, right *MerkleNode = tree.RootNode.Left, tree.RootNode.Right
+	var forged MerkleProof = MerkleProof{Index: 0, LeafCount: 2, Siblings: [][]byte{right.Data}}
+	if VerifyProof(tree.RootNode.Data, append(append([]byte{}, left.Left.Data...), left.Right.Data...), &forged) {
+		t.Error("an inner node was proven as a leaf")
+	}
+}
+
+func TestTxProof(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, 50)})
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1), spend}))
+
+	for _, tx := range []*Transaction{genesisCoinbase, spend} {
+		txProof, err := chain.GetTransactionProof(tx.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := TxProofFromHex(txProof.ToHex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := decoded.Verify(); err != nil {
+			t.Errorf("proof of %x: %s", tx.ID, err)
+		}
+	}
+
+	txProof, err := chain.GetTransactionProof(spend.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var otherTx TxProof = *txProof
+	otherTx.TxID = genesisCoinbase.ID
+	otherTx.TxHash = genesisCoinbase.SignedHash()
+	if otherTx.Verify() == nil {
+		t.Error("the proof verified another transaction")
+	}
+	var otherRoot TxProof = *txProof
+	otherRoot.Header.MerkleRoot = NewMerkleTree([][]byte{spend.SignedHash()}).RootNode.Data
+	if otherRoot.Verify() == nil {
+		t.Error("a header with another merkle root passed the proof of work")
+	}
+	if _, err := chain.GetTransactionProof([]byte("missing")); err == nil {
+		t.Error("proved a transaction that is not in the chain")
+	}
+}
+
+func TestBlockHashCoversUnlockingScripts(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, 50)})
+	var block *Block = CreateBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", 1), spend}, chain.LastHash, 1)
+
+	//a relayer strips the signature, the transaction keeps its id
+	var stripped Transaction = *spend
+	stripped.Inputs = []TxInput{spend.Inputs[0]}
+	stripped.Inputs[0].Script = nil
+	var tampered Block = *block
+	tampered.Transactions = []*Transaction{block.Transactions[0], &stripped}
+	if !bytes.Equal(stripped.UnsignedHash(), spend.ID) {
+		t.Fatal("stripping the script changed the id")
+	}
+	if bytes.Equal(tampered.HashTransactions(), block.HashTransactions()) {
+		t.Fatal("the merkle root does not cover the unlocking scripts")
+	}
+	var header BlockHeader = tampered.Header()
+	if header.Validate() {
+		t.Fatal("the tampered block still has the honest block's hash")
+	}
+
+	if chain.ConnectBlock(&tampered) == nil {
+		t.Fatal("connected the tampered block")
+	}
+	if chain.HasBlock(block.Hash) {
+		t.Fatal("the tampered block was stored under the honest block's hash")
+	}
+	err := chain.ConnectBlock(block)
+	if err != nil {
+		t.Fatalf("the honest block: %s", err)
+	}
+}
@@ -4,24 +4,25 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"math"
 	"math/big"
+
+	"github.com/pred695/golang-blockchain/Params"
 )
 
-// Difficulty is the number of leading zeros that must be present in the hash
+// The difficulty (Params.Active.Difficulty) is the number of leading zeros that must be present in the hash
 /*
 Step 1: Take Data from the block
 Step 2: Take the previous hash from the block
 Step 3: Take the nonce from the block
 Step 4: Take the difficulty from the block
-Step 5: Join the data, previous hash, nonce and difficulty into a single byte slice
+Step 5: Join the data, previous hash, nonce, difficulty, timestamp and height into a single byte slice
 Step 6: Hash the byte slice
 Step 7: Return the hash
 */
 
-const Difficulty = 18
 const MaxNonce = math.MaxInt64
+const stopCheckInterval = 4096 //nonces tried between two calls of RunUntil's stop function
 
 type ProofOfWork struct {
 	Block  *Block
@@ -30,7 +31,7 @@ type ProofOfWork struct {
 
 func NewProof(block *Block) *ProofOfWork {
 	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target.Lsh(target, uint(256-Params.Active.Difficulty))
 	proof := &ProofOfWork{block, target}
 	return proof
 }
@@ -45,12 +46,19 @@ func ToHex(num int64) []byte {
 }
 
 func (proof *ProofOfWork) InitData(nonce int) []byte {
+	return headerData(proof.Block.HashTransactions(), proof.Block.PrevHash, nonce, proof.Block.Timestamp, proof.Block.Height)
+}
+
+// the bytes that are hashed for the proof of work, shared by blocks and headers
+func headerData(merkleRoot []byte, prevHash []byte, nonce int, timestamp int64, height int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			proof.Block.HashTransactions(),
-			proof.Block.PrevHash,
+			merkleRoot,
+			prevHash,
 			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
+			ToHex(int64(Params.Active.Difficulty)),
+			ToHex(timestamp),
+			ToHex(int64(height)),
 		},
 		[]byte{},
 	)
@@ -58,22 +66,29 @@ func (proof *ProofOfWork) InitData(nonce int) []byte {
 }
 
 func (proof *ProofOfWork) Run() (int, []byte) {
+	nonce, hash, _ := proof.RunUntil(nil)
+	return nonce, hash
+}
+
+// Run that gives up once stop returns true, which it reports by returning false. A nil stop never gives up.
+func (proof *ProofOfWork) RunUntil(stop func() bool) (int, []byte, bool) {
 	var intHash big.Int
 	var hash [32]byte
 	nonce := 0
 	for nonce < MaxNonce {
+		if stop != nil && nonce%stopCheckInterval == 0 && stop() {
+			return nonce, hash[:], false
+		}
 		data := proof.InitData(nonce)
 		hash = sha256.Sum256(data)
-		fmt.Printf("\r%x", hash)
 		intHash.SetBytes(hash[:])
 		if intHash.Cmp(proof.Target) == -1 {
 			break //our hash is less than the target we are looking for, success.
 		} else {
 			nonce++
 		}
-		fmt.Print()
 	}
-	return nonce, hash[:]
+	return nonce, hash[:], true
 }
 //Computational part of the algorithm is relatively expensive, validation part is pretty simple.
 //Changing a particular block requires the "expensive" part of the algorithm to be run again, hence the blockchain is secure(tamper-proof).
@@ -85,3 +100,13 @@ func (proof *ProofOfWork) Validate() bool {
 	result := intHash.Cmp(proof.Target)
 	return result == -1
 }
+
+// Checks the work of a header on its own: the hash has to match the header fields and be below the target
+func (header *BlockHeader) Validate() bool {
+	var intHash big.Int
+	var target *big.Int = big.NewInt(1)
+	target.Lsh(target, uint(256-Params.Active.Difficulty))
+	hash := sha256.Sum256(headerData(header.MerkleRoot, header.PrevHash, header.Nonce, header.Timestamp, header.Height))
+	intHash.SetBytes(hash[:])
+	return bytes.Equal(hash[:], header.Hash) && intHash.Cmp(target) == -1
+}
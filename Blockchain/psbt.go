@@ -0,0 +1,251 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// A partially signed transaction is passed around between the owners of the inputs, every owner adds the
+// signatures for the inputs they can unlock. Once every input is covered it is finalized into a normal transaction.
+type PartiallySignedTx struct {
+	Tx          Transaction //the unsigned transaction
+	PrevOutputs []TxOutput  //the output spent by each input, signers do not need access to the chain
+	Inputs      []PSBTInput
+}
+
+type PSBTInput struct {
+	PartialSigs  map[string][]byte //hex encoded public key --> signature made with the matching private key
+	RedeemScript []byte            //only for inputs spending a pay to script hash output (multisig)
+	Final        bool              //set once the signatures have been moved into the transaction
+}
+
+// wraps an unsigned transaction, the outputs it spends are looked up in the UTXO set
+func (u UTXOSet) NewPSBT(tx *Transaction) (*PartiallySignedTx, error) {
+	prevOutputs, err := u.PrevOutputs(tx)
+	if err != nil {
+		return nil, err
+	}
+	var psbt PartiallySignedTx = PartiallySignedTx{Tx: tx.TrimmedCopy(), PrevOutputs: prevOutputs}
+	for range tx.Inputs {
+		psbt.Inputs = append(psbt.Inputs, PSBTInput{PartialSigs: make(map[string][]byte)})
+	}
+	return &psbt, nil
+}
+
+// the unspent output each input of the transaction spends, in the order of the inputs
+func (u UTXOSet) PrevOutputs(tx *Transaction) ([]TxOutput, error) {
+	var prevOutputs []TxOutput
+	for _, input := range tx.Inputs {
+		entry, found := u.FindOutput(input.ID, input.OutputIdx)
+		if !found {
+			return nil, fmt.Errorf("output %x:%d does not exist or is already spent", input.ID, input.OutputIdx)
+		}
+		prevOutputs = append(prevOutputs, entry.Output)
+	}
+	return prevOutputs, nil
+}
+
+// Attaches a redeem script to every input spending an output locked to its hash, returns the number of inputs it applies to
+func (psbt *PartiallySignedTx) AddRedeemScript(redeemScript []byte) int {
+	var scriptHash []byte = Wallet.CreatePubKeyHash(redeemScript)
+	var added int = 0
+	for inID, prevOutput := range psbt.PrevOutputs {
+		_, _, inner := SplitTimelockScript(prevOutput.Script)
+		if bytes.Equal(ExtractScriptHash(inner), scriptHash) {
+			psbt.Inputs[inID].RedeemScript = redeemScript
+			added++
+		}
+	}
+	return added
+}
+
+// true if the wallet's key can contribute a signature to the input
+func (psbt *PartiallySignedTx) canSign(inID int, w Wallet.Wallet) bool {
+	_, _, inner := SplitTimelockScript(psbt.PrevOutputs[inID].Script) //a timelocked output is signed like the script behind the lock
+	if bytes.Equal(ExtractPubKeyHash(inner), Wallet.CreatePubKeyHash(w.PublicKey)) {
+		return true
+	}
+	_, pubKeys, ok := ParseMultisigScript(psbt.Inputs[inID].RedeemScript)
+	if !ok {
+		return false
+	}
+	for _, pubKey := range pubKeys {
+		if bytes.Equal(pubKey, w.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signs every input the wallet's key can unlock or co-sign, returns the number of inputs signed
+func (psbt *PartiallySignedTx) Sign(w Wallet.Wallet) int {
+	var signed int = 0
+	for inID, prevOutput := range psbt.PrevOutputs {
+		if !psbt.canSign(inID, w) {
+			continue //somebody else has to sign this input
+		}
+		var signature []byte = psbt.Tx.SignInput(inID, w.PrivateKey.ToECDSA(), prevOutput.Script)
+		psbt.Inputs[inID].PartialSigs[hex.EncodeToString(w.PublicKey)] = signature
+		signed++
+	}
+	return signed
+}
+
+// Merges the signatures collected in other copies of the same partially signed transaction
+func (psbt *PartiallySignedTx) Combine(other *PartiallySignedTx) error {
+	if !bytes.Equal(psbt.Tx.ID, other.Tx.ID) || len(psbt.Inputs) != len(other.Inputs) {
+		return errors.New("partially signed transactions are for different transactions")
+	}
+	for inID, input := range other.Inputs {
+		for pubKey, sig := range input.PartialSigs {
+			psbt.Inputs[inID].PartialSigs[pubKey] = sig
+		}
+		if psbt.Inputs[inID].RedeemScript == nil {
+			psbt.Inputs[inID].RedeemScript = input.RedeemScript
+		}
+	}
+	return nil
+}
+
+// Builds the unlocking script of every input from the collected signatures, fails if an input is still missing some
+func (psbt *PartiallySignedTx) Finalize() error {
+	for inID, prevOutput := range psbt.PrevOutputs {
+		var input *PSBTInput = &psbt.Inputs[inID]
+		var script []byte
+		var err error
+		_, _, inner := SplitTimelockScript(prevOutput.Script)
+		var checker txSignatureChecker = txSignatureChecker{tx: &psbt.Tx, inID: inID, prevScript: prevOutput.Script}
+		switch {
+		case ExtractPubKeyHash(inner) != nil:
+			script, err = finalizeP2PKH(ExtractPubKeyHash(inner), input.PartialSigs, checker)
+		case ExtractScriptHash(inner) != nil:
+			script, err = finalizeMultisig(input.RedeemScript, input.PartialSigs, checker)
+		default:
+			err = errors.New("non standard script")
+		}
+		if err != nil {
+			return fmt.Errorf("input %d: %w", inID, err)
+		}
+		psbt.Tx.Inputs[inID].Script = script
+		input.Final = true
+	}
+	return nil
+}
+
+// a signature of the key the output is locked to, which has to verify like the multisig ones
+func finalizeP2PKH(pubKeyHash []byte, partialSigs map[string][]byte, checker SignatureChecker) ([]byte, error) {
+	for pubKeyHex, sig := range partialSigs {
+		pubKey, err := hex.DecodeString(pubKeyHex)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(Wallet.CreatePubKeyHash(pubKey), pubKeyHash) && checker.CheckSig(sig, pubKey) {
+			return P2PKHUnlockingScript(sig, pubKey), nil
+		}
+	}
+	return nil, errors.New("not signed yet")
+}
+
+// The signatures are pushed in the order of the keys in the redeem script, followed by the redeem script itself.
+// A signature that does not verify against its key is left out, a bad co-signer cannot spoil the input.
+func finalizeMultisig(redeemScript []byte, partialSigs map[string][]byte, checker SignatureChecker) ([]byte, error) {
+	m, pubKeys, ok := ParseMultisigScript(redeemScript)
+	if !ok {
+		return nil, errors.New("missing or unsupported redeem script")
+	}
+	var script []byte
+	var collected int = 0
+	for _, pubKey := range pubKeys {
+		sig, found := partialSigs[hex.EncodeToString(pubKey)]
+		if !found || collected == m || !checker.CheckSig(sig, pubKey) {
+			continue
+		}
+		script = append(script, PushData(sig)...)
+		collected++
+	}
+	if collected < m {
+		return nil, fmt.Errorf("has %d of %d required signatures", collected, m)
+	}
+	return append(script, PushData(redeemScript)...), nil
+}
+
+// Returns the finished transaction, the partially signed transaction has to be finalized first
+func (psbt *PartiallySignedTx) Extract() (*Transaction, error) {
+	for inID, input := range psbt.Inputs {
+		if !input.Final {
+			return nil, fmt.Errorf("input %d is not finalized", inID)
+		}
+	}
+	var tx Transaction = psbt.Tx
+	for inID, input := range tx.Inputs {
+		if input.OutputIdx < 0 {
+			return nil, fmt.Errorf("input %d spends the invalid output index %d", inID, input.OutputIdx)
+		}
+		//checked against the spent output carried along, the previous transaction is not needed
+		var prevScript []byte = psbt.PrevOutputs[inID].Script
+		var checker txSignatureChecker = txSignatureChecker{tx: &tx, inID: inID, prevScript: prevScript}
+		err := VerifyScript(input.Script, prevScript, checker)
+		if err != nil {
+			return nil, fmt.Errorf("input %d does not satisfy the spent output (signatures or locks): %w", inID, err)
+		}
+	}
+	return &tx, nil
+}
+
+func (psbt *PartiallySignedTx) ToHex() string {
+	var encoded bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&encoded)
+	var err error = encoder.Encode(psbt)
+	Handle(err)
+	return hex.EncodeToString(encoded.Bytes())
+}
+
+func PSBTFromHex(data string) (*PartiallySignedTx, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	var psbt PartiallySignedTx
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(raw))
+	err = decoder.Decode(&psbt)
+	if err != nil {
+		return nil, err
+	}
+	if len(psbt.PrevOutputs) != len(psbt.Tx.Inputs) || len(psbt.Inputs) != len(psbt.Tx.Inputs) {
+		return nil, errors.New("malformed partially signed transaction")
+	}
+	for inID := range psbt.Inputs {
+		if psbt.Inputs[inID].PartialSigs == nil {
+			psbt.Inputs[inID].PartialSigs = make(map[string][]byte) //gob drops empty maps
+		}
+	}
+	return &psbt, nil
+}
+
+func (psbt *PartiallySignedTx) To_String() string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("--- Partially signed transaction %x:", psbt.Tx.ID))
+	for inID, input := range psbt.Tx.Inputs {
+		lines = append(lines, fmt.Sprintf("Input %d: spends %x:%d", inID, input.ID, input.OutputIdx))
+		lines = append(lines, fmt.Sprintf("	Value: %d", psbt.PrevOutputs[inID].Value))
+		lines = append(lines, fmt.Sprintf("	Locked with: %s", DisasmScript(psbt.PrevOutputs[inID].Script)))
+		var required int = 1
+		if m, _, ok := ParseMultisigScript(psbt.Inputs[inID].RedeemScript); ok {
+			lines = append(lines, fmt.Sprintf("	Redeem script: %s", DisasmScript(psbt.Inputs[inID].RedeemScript)))
+			required = m
+		}
+		lines = append(lines, fmt.Sprintf("	Signatures: %d of %d, finalized: %t", len(psbt.Inputs[inID].PartialSigs), required, psbt.Inputs[inID].Final))
+	}
+	for idx, output := range psbt.Tx.Outputs {
+		lines = append(lines, fmt.Sprintf(" Output %d:", idx))
+		lines = append(lines, fmt.Sprintf("	Value: %d", output.Value))
+		lines = append(lines, fmt.Sprintf("	Script: %s", DisasmScript(output.Script)))
+	}
+	return strings.Join(lines, "\n")
+}
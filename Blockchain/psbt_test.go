@@ -0,0 +1,214 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// a partially signed transaction with one input paid to each wallet
+func testPSBT(wallets ...*Wallet.Wallet) *PartiallySignedTx {
+	var psbt PartiallySignedTx
+	for idx, w := range wallets {
+		psbt.Tx.Inputs = append(psbt.Tx.Inputs, TxInput{ID: bytes.Repeat([]byte{byte(idx + 1)}, 32), OutputIdx: 0})
+		psbt.PrevOutputs = append(psbt.PrevOutputs, *NewTxOutput(10, string(w.CreateAddress())))
+		psbt.Inputs = append(psbt.Inputs, PSBTInput{PartialSigs: make(map[string][]byte)})
+	}
+	psbt.Tx.Outputs = []TxOutput{*NewTxOutput(5*len(wallets), string(wallets[0].CreateAddress()))}
+	psbt.Tx.ID = psbt.Tx.UnsignedHash()
+	return &psbt
+}
+
+func TestPSBTSignCombineExtract(t *testing.T) {
+	var first, second *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	var psbt *PartiallySignedTx = testPSBT(first, second)
+
+	//every owner signs their own copy, passed around as hex
+	firstCopy, err := PSBTFromHex(psbt.ToHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondCopy, err := PSBTFromHex(psbt.ToHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed := firstCopy.Sign(*first); signed != 1 {
+		t.Fatalf("the first wallet signed %d inputs", signed)
+	}
+	if signed := secondCopy.Sign(*second); signed != 1 {
+		t.Fatalf("the second wallet signed %d inputs", signed)
+	}
+
+	if firstCopy.Finalize() == nil {
+		t.Fatal("finalized with an input that is not signed")
+	}
+	err = firstCopy.Combine(secondCopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = firstCopy.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := firstCopy.Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+		t.Error("the id does not match the extracted transaction")
+	}
+}
+
+func TestPSBTExtractNeedsFinalize(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	var psbt *PartiallySignedTx = testPSBT(w)
+	psbt.Sign(*w)
+	if _, err := psbt.Extract(); err == nil {
+		t.Error("extracted a transaction that is not finalized")
+	}
+}
+
+func TestPSBTCombineOtherTransaction(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	if testPSBT(w).Combine(testPSBT(w, w)) == nil {
+		t.Error("combined partially signed transactions of different transactions")
+	}
+}
+
+func TestPSBTFromHexMalformed(t *testing.T) {
+	var psbt *PartiallySignedTx = testPSBT(Wallet.MakeWallet())
+	psbt.PrevOutputs = nil
+	for _, data := range []string{"not hex", "abcd", psbt.ToHex()} {
+		if _, err := PSBTFromHex(data); err == nil {
+			t.Errorf("decoded %q", data)
+		}
+	}
+}
+
+// a partially signed transaction spending one output locked to the redeem script
+func multisigPSBT(t *testing.T, redeemScript []byte) *PartiallySignedTx {
+	t.Helper()
+	var tx Transaction = Transaction{
+		Inputs:  []TxInput{{ID: bytes.Repeat([]byte{1}, 32), OutputIdx: 0}},
+		Outputs: []TxOutput{{Value: 5, Script: P2PKHScript(bytes.Repeat([]byte{2}, 20))}},
+	}
+	tx.ID = tx.UnsignedHash()
+	var psbt *PartiallySignedTx = &PartiallySignedTx{
+		Tx:          tx,
+		PrevOutputs: []TxOutput{{Value: 10, Script: P2SHScript(Wallet.CreatePubKeyHash(redeemScript))}},
+		Inputs:      []PSBTInput{{PartialSigs: make(map[string][]byte)}},
+	}
+	if psbt.AddRedeemScript(redeemScript) != 1 {
+		t.Fatal("the redeem script does not match the spent output")
+	}
+	return psbt
+}
+
+func TestPSBTMultisig(t *testing.T) {
+	var wallets []*Wallet.Wallet = []*Wallet.Wallet{Wallet.MakeWallet(), Wallet.MakeWallet(), Wallet.MakeWallet()}
+	var pubKeys [][]byte
+	for _, w := range wallets {
+		pubKeys = append(pubKeys, w.PublicKey)
+	}
+	redeemScript, err := MultisigRedeemScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psbt *PartiallySignedTx = multisigPSBT(t, redeemScript)
+	psbt.Sign(*wallets[2])
+	if psbt.Finalize() == nil {
+		t.Fatal("finalized with one signature of two")
+	}
+	psbt.Sign(*wallets[0])
+	if len(psbt.Inputs[0].PartialSigs) != 2 || psbt.Inputs[0].PartialSigs[hex.EncodeToString(pubKeys[1])] != nil {
+		t.Fatal("the signatures were not collected by key")
+	}
+	err = psbt.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = psbt.Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizeSkipsInvalidPartialSignatures(t *testing.T) {
+	var wallets []*Wallet.Wallet = []*Wallet.Wallet{Wallet.MakeWallet(), Wallet.MakeWallet(), Wallet.MakeWallet()}
+	var pubKeys [][]byte
+	for _, w := range wallets {
+		pubKeys = append(pubKeys, w.PublicKey)
+	}
+	redeemScript, err := MultisigRedeemScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psbt *PartiallySignedTx = multisigPSBT(t, redeemScript)
+	psbt.Sign(*wallets[1])
+	psbt.Sign(*wallets[2])
+	psbt.Inputs[0].PartialSigs[hex.EncodeToString(pubKeys[0])] = bytes.Repeat([]byte{3}, 64) //comes first in the script
+
+	err = psbt.Finalize()
+	if err != nil {
+		t.Fatalf("finalize: %s", err)
+	}
+	_, err = psbt.Extract()
+	if err != nil {
+		t.Fatalf("the bad signature was used: %s", err)
+	}
+}
+
+func TestFinalizeChecksP2PKHSignature(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	var psbt *PartiallySignedTx = testPSBT(w)
+	psbt.Inputs[0].PartialSigs[hex.EncodeToString(w.PublicKey)] = bytes.Repeat([]byte{3}, 64)
+
+	if psbt.Finalize() == nil {
+		t.Fatal("finalized with a signature that does not verify")
+	}
+	psbt.Sign(*w)
+	err := psbt.Finalize()
+	if err != nil {
+		t.Fatalf("finalize after signing: %s", err)
+	}
+	_, err = psbt.Extract()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFinalizeCountsOnlyValidSignatures(t *testing.T) {
+	var first, second *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	redeemScript, err := MultisigRedeemScript(2, [][]byte{first.PublicKey, second.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psbt *PartiallySignedTx = multisigPSBT(t, redeemScript)
+	psbt.Sign(*first)
+	psbt.Inputs[0].PartialSigs[hex.EncodeToString(second.PublicKey)] = bytes.Repeat([]byte{3}, 64)
+
+	if psbt.Finalize() == nil {
+		t.Fatal("finalized with one valid signature of two")
+	}
+}
+
+func TestExtractRejectsNegativeOutputIndex(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	redeemScript, err := MultisigRedeemScript(1, [][]byte{w.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var psbt *PartiallySignedTx = multisigPSBT(t, redeemScript)
+	psbt.Tx.Inputs[0].OutputIdx = -1
+	psbt.Sign(*w)
+	err = psbt.Finalize()
+	if err != nil {
+		t.Fatalf("finalize: %s", err)
+	}
+	_, err = psbt.Extract()
+	if err == nil {
+		t.Fatal("extracted a transaction spending output -1")
+	}
+}
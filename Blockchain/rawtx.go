@@ -0,0 +1,94 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// Raw transactions are built from explicit inputs and outputs without touching the chain or the wallet file,
+// they can be signed on a different machine that is given the outputs they spend and submitted afterwards.
+func NewRawTransaction(inputs []TxInput, outputs []TxOutput, lockTime int64) *Transaction {
+	var tx Transaction = Transaction{ID: nil, Inputs: inputs, Outputs: outputs, LockTime: lockTime}
+	tx.ID = tx.UnsignedHash()
+	return &tx
+}
+
+// The id of a transaction is the hash of its contents without the unlocking scripts, signing does not change the id.
+// The coinbase keeps its script since that is where its (random) data lives.
+func (tx *Transaction) UnsignedHash() []byte {
+	if tx.Is_Coinbase() {
+		return tx.HashTransaction()
+	}
+	var txCopy Transaction = tx.TrimmedCopy()
+	return txCopy.HashTransaction()
+}
+
+// The hash of the whole transaction, unlocking scripts included. It is the transaction's merkle leaf, so a block
+// commits to the scripts as well: stripping or swapping them changes the block hash.
+func (tx *Transaction) SignedHash() []byte {
+	return tx.HashTransaction()
+}
+
+/*
+	Signs the inputs that spend outputs locked to the wallet's key, prevOutputs holds the output each input spends
+	(see UTXOSet.PrevOutputs). Inputs locked to other keys are left for their owners to sign. An output the wallet
+	cannot unlock with a single signature, e.g. a multisig, is an error, those are signed as a partially signed
+	transaction. Returns the number of inputs signed, nothing is signed on an error.
+*/
+func (tx *Transaction) SignWithWallet(w Wallet.Wallet, prevOutputs []TxOutput) (int, error) {
+	if len(prevOutputs) != len(tx.Inputs) {
+		return 0, fmt.Errorf("%d spent outputs for %d inputs", len(prevOutputs), len(tx.Inputs))
+	}
+	var pubKeyHash []byte = Wallet.CreatePubKeyHash(w.PublicKey)
+	var mine []int //the inputs the wallet signs
+	for idx, prevOutput := range prevOutputs {
+		_, _, inner := SplitTimelockScript(prevOutput.Script) //a timelocked output is signed like the script behind the lock
+		var lockedTo []byte = ExtractPubKeyHash(inner)
+		if lockedTo == nil {
+			return 0, fmt.Errorf("input %d spends a script that needs a partially signed transaction", idx)
+		}
+		if bytes.Equal(lockedTo, pubKeyHash) {
+			mine = append(mine, idx)
+		}
+	}
+	for _, idx := range mine {
+		var signature []byte = tx.SignInput(idx, w.PrivateKey.ToECDSA(), prevOutputs[idx].Script)
+		tx.Inputs[idx].Script = P2PKHUnlockingScript(signature, w.PublicKey)
+	}
+	return len(mine), nil
+}
+
+func (tx *Transaction) ToHex() string {
+	return hex.EncodeToString(tx.Serialize())
+}
+
+// decodes a hex encoded transaction, unlike Deserialize the input is untrusted so errors are returned instead of panicking
+func TransactionFromHex(data string) (*Transaction, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := DeserializeTransaction(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return nil, errors.New("transaction needs at least one input and one output")
+	}
+	return tx, nil
+}
+
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&tx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
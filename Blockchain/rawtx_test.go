@@ -0,0 +1,109 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// a transaction paying the wallet, standing in for the one an input spends
+func testPrevTx(w *Wallet.Wallet, value int) Transaction {
+	var tx Transaction = Transaction{Outputs: []TxOutput{*NewTxOutput(value, string(w.CreateAddress()))}}
+	tx.ID = tx.HashTransaction()
+	return tx
+}
+
+func TestSignWithWalletKeepsTheID(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	var prevTx Transaction = testPrevTx(w, 50)
+	var tx *Transaction = NewRawTransaction([]TxInput{{ID: prevTx.ID, OutputIdx: 0}}, []TxOutput{*NewTxOutput(50, string(w.CreateAddress()))}, 0)
+	tx.SignWithWallet(*w, []TxOutput{prevTx.Outputs[0]})
+
+	if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+		t.Error("the id does not match the signed transaction")
+	}
+	var signedID []byte = tx.ID
+	tx.Inputs[0].Script = nil
+	if !bytes.Equal(tx.UnsignedHash(), signedID) {
+		t.Error("the unlocking script is part of the id")
+	}
+}
+
+func TestSignWithWalletVerifies(t *testing.T) {
+	var owner, other *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	var prevTx Transaction = testPrevTx(owner, 50)
+	var prevTxs map[string]Transaction = map[string]Transaction{hex.EncodeToString(prevTx.ID): prevTx}
+	var outputs []TxOutput = []TxOutput{*NewTxOutput(50, string(other.CreateAddress()))}
+
+	var tx *Transaction = NewRawTransaction([]TxInput{{ID: prevTx.ID, OutputIdx: 0}}, outputs, 0)
+	tx.SignWithWallet(*owner, []TxOutput{prevTx.Outputs[0]})
+	if !tx.Verify(prevTxs) {
+		t.Error("the owner's signature does not verify")
+	}
+	var theft *Transaction = NewRawTransaction([]TxInput{{ID: prevTx.ID, OutputIdx: 0}}, outputs, 0)
+	theft.SignWithWallet(*other, []TxOutput{prevTx.Outputs[0]})
+	if theft.Verify(prevTxs) {
+		t.Error("another wallet's signature verifies")
+	}
+}
+
+func TestSignWithWalletSignsOnlyItsInputs(t *testing.T) {
+	var owner, other *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	var ownPrev, otherPrev Transaction = testPrevTx(owner, 50), testPrevTx(other, 20)
+	var prevTxs map[string]Transaction = map[string]Transaction{hex.EncodeToString(ownPrev.ID): ownPrev, hex.EncodeToString(otherPrev.ID): otherPrev}
+	var inputs []TxInput = []TxInput{{ID: ownPrev.ID, OutputIdx: 0}, {ID: otherPrev.ID, OutputIdx: 0}}
+	var prevOutputs []TxOutput = []TxOutput{ownPrev.Outputs[0], otherPrev.Outputs[0]}
+	var tx *Transaction = NewRawTransaction(inputs, []TxOutput{*NewTxOutput(70, string(owner.CreateAddress()))}, 0)
+
+	signed, err := tx.SignWithWallet(*owner, prevOutputs)
+	if err != nil || signed != 1 || tx.Inputs[1].Script != nil {
+		t.Fatalf("signed %d inputs, the other owner's script is %x: %v", signed, tx.Inputs[1].Script, err)
+	}
+	signed, err = tx.SignWithWallet(*other, prevOutputs)
+	if err != nil || signed != 1 {
+		t.Fatalf("signed %d inputs: %v", signed, err)
+	}
+	if !tx.Verify(prevTxs) {
+		t.Error("the transaction signed by both owners does not verify")
+	}
+
+	if _, err := tx.SignWithWallet(*owner, prevOutputs[:1]); err == nil {
+		t.Error("signed without the output of every input")
+	}
+	redeemScript, err := MultisigRedeemScript(1, [][]byte{owner.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var multisig TxOutput = TxOutput{Value: 20, Script: P2SHScript(Wallet.CreatePubKeyHash(redeemScript))}
+	var unsigned *Transaction = NewRawTransaction([]TxInput{{ID: ownPrev.ID, OutputIdx: 0}, {ID: otherPrev.ID, OutputIdx: 0}}, tx.Outputs, 0)
+	if _, err := unsigned.SignWithWallet(*owner, []TxOutput{ownPrev.Outputs[0], multisig}); err == nil {
+		t.Error("signed an input spending a multisig")
+	}
+	if unsigned.Inputs[0].Script != nil {
+		t.Error("signed an input of a transaction it failed on")
+	}
+}
+
+func TestTransactionHex(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	var prevTx Transaction = testPrevTx(w, 50)
+	var tx *Transaction = NewRawTransaction([]TxInput{{ID: prevTx.ID, OutputIdx: 0}}, []TxOutput{*NewTxOutput(20, string(w.CreateAddress()))}, 0)
+	tx.SignWithWallet(*w, []TxOutput{prevTx.Outputs[0]})
+
+	decoded, err := TransactionFromHex(tx.ToHex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Serialize(), tx.Serialize()) {
+		t.Error("the decoded transaction differs")
+	}
+
+	var empty Transaction = Transaction{Outputs: tx.Outputs}
+	for _, data := range []string{"not hex", "abcd", empty.ToHex()} {
+		if _, err := TransactionFromHex(data); err == nil {
+			t.Errorf("decoded %q", data)
+		}
+	}
+}
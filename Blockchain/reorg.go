@@ -0,0 +1,248 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pred695/golang-blockchain/Params"
+)
+
+/*
+	Fork choice: the chain follows the branch with the most work. Blocks of other branches are stored as they
+	arrive (see ConnectBlock), and once one of them gives its branch more work than the tip has, the chain
+	reorganises: the blocks after the fork are disconnected newest first, putting back the outputs each of them
+	spent (its undo data), then the blocks of the new branch are connected oldest first, which validates their
+	transactions. All of it happens in one database transaction, so a reorganisation is never left halfway: if a
+	block of the new branch is invalid, or anything else fails, the transaction is discarded and the old branch is
+	still the chain, the invalid blocks are dropped. Once it is committed subscribers see BlockDisconnected and
+	BlockConnected for every block, and a Reorg.
+*/
+
+const undoPrefix = "undo-" //block hash --> the outputs the block spent
+
+// the work a block proves, the expected number of hashes to meet the target
+func blockWork() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(Params.Active.Difficulty))
+}
+
+// The total work of a branch up to the block at the height. Every block of a network has the same target, there is
+// no retargeting (see Params), so it is the work of one block times the number of blocks. A difficulty that adjusts
+// would have to add up the work of each block instead.
+func chainWork(height int) *big.Int {
+	return new(big.Int).Mul(big.NewInt(int64(height)+1), blockWork())
+}
+
+// makes the branch ending in newTip the chain, the block is stored already
+func (chain *Blockchain) reorganize(newTip *Block) error {
+	oldTip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return err
+	}
+	var disconnect []*Block //newest first
+	var connect []*Block    //newest first, reversed below
+	var old *Block = &oldTip
+	var branch *Block = newTip
+	for !bytes.Equal(old.Hash, branch.Hash) { //walks both branches back to the block they share
+		if old.Height >= branch.Height {
+			disconnect = append(disconnect, old)
+			old, err = chain.parent(old)
+		} else {
+			connect = append(connect, branch)
+			branch, err = chain.parent(branch)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i, j := 0, len(connect)-1; i < j; i, j = i+1, j-1 {
+		connect[i], connect[j] = connect[j], connect[i]
+	}
+
+	var spent [][]UnspentOutput = make([][]UnspentOutput, len(disconnect)) //the undo data of each disconnected block
+	var invalid []*Block
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		var UTXO UTXOSet = UTXOSet{Blockchain: chain, txn: txn}
+		for idx, block := range disconnect {
+			blockSpent, err := chain.retractTip(txn, block)
+			spent[idx] = blockSpent
+			if err != nil {
+				return fmt.Errorf("disconnecting block %x: %w", block.Hash, err)
+			}
+		}
+		for idx, block := range connect {
+			err := UTXO.ValidateBlockTransactions(block.Transactions, block.Height, block.Timestamp)
+			if err != nil {
+				invalid = connect[idx:] //the branch is invalid from this block on
+				return fmt.Errorf("block %x of the branch: %w", block.Hash, err)
+			}
+			err = chain.extendTip(txn, block)
+			if err != nil {
+				return fmt.Errorf("connecting block %x: %w", block.Hash, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if len(invalid) > 0 {
+			removeErr := chain.removeBlocks(invalid)
+			if removeErr != nil {
+				return fmt.Errorf("%w, and the invalid blocks could not be removed: %v", err, removeErr)
+			}
+		}
+		return err
+	}
+
+	chain.LastHash = newTip.Hash
+	for idx, block := range disconnect {
+		chain.Events.Publish(BlockDisconnected{Block: block, Spent: spent[idx]})
+	}
+	for _, block := range connect {
+		chain.Events.Publish(BlockConnected{Block: block})
+	}
+	chain.Events.Publish(Reorg{Fork: old.Hash, Disconnected: disconnect, Connected: connect})
+	return nil
+}
+
+func (chain *Blockchain) parent(block *Block) (*Block, error) {
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return nil, fmt.Errorf("the parent of block %x is missing", block.Hash)
+	}
+	return &parent, nil
+}
+
+// takes the tip off the chain, its parent becomes the tip, and returns the outputs it had spent
+func (chain *Blockchain) retractTip(txn *badger.Txn, block *Block) ([]UnspentOutput, error) {
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain, txn: txn}
+	spent, err := UTXO.spentOutputs(block) //while the block is still on the chain, see spentOutputs
+	if err != nil {
+		return nil, err
+	}
+	err = txn.Set([]byte("lh"), block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	return spent, UTXO.unapply(txn, block, spent)
+}
+
+// forgets invalid blocks, together with their filters and undo data
+func (chain *Blockchain) removeBlocks(blocks []*Block) error {
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			for _, prefix := range []string{"", filterPrefix, filterHeaderPrefix, undoPrefix} {
+				err := txn.Delete(append([]byte(prefix), block.Hash...))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// The outputs a block spent, from its undo data. Blocks connected before undo data was kept have none, their
+// spent outputs are looked up in the chain, which still has to include the block.
+func (u UTXOSet) spentOutputs(block *Block) ([]UnspentOutput, error) {
+	var spent []UnspentOutput
+	var found bool = false
+	err := u.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(undoPrefix), block.Hash...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		spent = deserializeUndo(value)
+		found = true
+		return nil
+	})
+	if err != nil || found {
+		return spent, err
+	}
+	for _, tx := range block.Transactions {
+		if tx.Is_Coinbase() {
+			continue
+		}
+		for _, input := range tx.Inputs {
+			prevTx, prevBlock, err := u.Blockchain.FindTransactionBlock(input.ID)
+			if err != nil {
+				return nil, err
+			}
+			var entry UTXOEntry = UTXOEntry{Output: prevTx.Outputs[input.OutputIdx], Height: prevBlock.Height, Coinbase: prevTx.Is_Coinbase()}
+			spent = append(spent, UnspentOutput{UTXOEntry: entry, TxID: input.ID, OutputIdx: input.OutputIdx})
+		}
+	}
+	return spent, nil
+}
+
+// reverts apply for a block that is taken off the tip
+func (u UTXOSet) unapply(txn *badger.Txn, block *Block, spent []UnspentOutput) error {
+	var created map[string]bool = make(map[string]bool)
+	for _, tx := range block.Transactions {
+		created[hex.EncodeToString(tx.ID)] = true
+	}
+	for _, tx := range block.Transactions {
+		err := txn.Delete(append([]byte(utxoPrefix), tx.ID...))
+		if err != nil {
+			return err
+		}
+	}
+	for _, output := range spent {
+		if created[hex.EncodeToString(output.TxID)] {
+			continue //created and spent within the block, gone with the transaction that created it
+		}
+		var key []byte = append([]byte(utxoPrefix), output.TxID...)
+		var outputs TxOutputs = TxOutputs{Height: output.Height, Coinbase: output.Coinbase}
+		item, err := txn.Get(key)
+		if err == nil {
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			outputs = DeserializeOutputs(value)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		outputs.restore(output.OutputIdx, output.Output)
+		err = txn.Set(key, outputs.SerializeOutputs())
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Delete(append([]byte(undoPrefix), block.Hash...))
+}
+
+// puts a spent output back, keeping the outputs ordered by their index
+func (outputs *TxOutputs) restore(outIdx int, output TxOutput) {
+	var at int = 0
+	for at < len(outputs.Indexes) && outputs.Indexes[at] < outIdx {
+		at++
+	}
+	outputs.Indexes = append(outputs.Indexes[:at], append([]int{outIdx}, outputs.Indexes[at:]...)...)
+	outputs.Outputs = append(outputs.Outputs[:at], append([]TxOutput{output}, outputs.Outputs[at:]...)...)
+}
+
+func serializeUndo(spent []UnspentOutput) []byte {
+	var buffer bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&buffer)
+	var err error = encoder.Encode(spent)
+	Handle(err)
+	return buffer.Bytes()
+}
+
+func deserializeUndo(data []byte) []UnspentOutput {
+	var spent []UnspentOutput
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(data))
+	var err error = decoder.Decode(&spent)
+	Handle(err)
+	return spent
+}
@@ -0,0 +1,155 @@
+package Blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// a mined block on parent, its coinbase pays the wallet
+func mineOn(w *Wallet.Wallet, parent *Block, txs ...*Transaction) *Block {
+	var coinbase *Transaction = CoinbaseTx(string(w.CreateAddress()), "", parent.Height+1)
+	return CreateBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1)
+}
+
+func connect(t *testing.T, chain *Blockchain, block *Block) {
+	t.Helper()
+	err := chain.ConnectBlock(block)
+	if err != nil {
+		t.Fatalf("block at height %d: %s", block.Height, err)
+	}
+}
+
+func tip(t *testing.T, chain *Blockchain) *Block {
+	t.Helper()
+	block, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+// whether the UTXO set has the first output of the transaction
+func unspent(u UTXOSet, tx *Transaction) bool {
+	for _, output := range u.FindUnspentOutputs(tx.Outputs[0].Script) {
+		if bytes.Equal(output.TxID, tx.ID) && output.OutputIdx == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReorgFollowsTheMostWork(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var genesis *Block = tip(t, chain)
+	var events []Event
+	chain.Events.Subscribe(func(event Event) { events = append(events, event) })
+
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(Wallet.MakeWallet(), 50)})
+	var a1 *Block = mineOn(w, genesis, spend)
+	connect(t, chain, a1)
+	var b1 *Block = mineOn(Wallet.MakeWallet(), genesis)
+	connect(t, chain, b1)
+	if !bytes.Equal(chain.LastHash, a1.Hash) {
+		t.Fatal("a branch with the same work replaced the tip")
+	}
+	if unspent(UTXO, b1.Transactions[0]) {
+		t.Fatal("a side branch block is in the UTXO set")
+	}
+
+	events = nil
+	var b2 *Block = mineOn(Wallet.MakeWallet(), b1)
+	connect(t, chain, b2)
+	if !bytes.Equal(chain.LastHash, b2.Hash) || chain.GetBestHeight() != 2 {
+		t.Fatal("the branch with more work did not become the chain")
+	}
+	if unspent(UTXO, a1.Transactions[0]) || unspent(UTXO, spend) {
+		t.Error("the outputs of the disconnected block are still unspent")
+	}
+	if !unspent(UTXO, genesisCoinbase) {
+		t.Error("the output the disconnected block spent was not put back")
+	}
+	if !unspent(UTXO, b1.Transactions[0]) || !unspent(UTXO, b2.Transactions[0]) {
+		t.Error("the outputs of the new branch are missing")
+	}
+
+	var topics []string
+	for _, event := range events {
+		topics = append(topics, event.Topic())
+	}
+	var want []string = []string{TopicBlockDisconnected, TopicBlockConnected, TopicBlockConnected, TopicReorg}
+	if len(topics) != len(want) {
+		t.Fatalf("got events %v, want %v", topics, want)
+	}
+	for idx := range want {
+		if topics[idx] != want[idx] {
+			t.Fatalf("got events %v, want %v", topics, want)
+		}
+	}
+	var reorg Reorg = events[3].(Reorg)
+	if !bytes.Equal(reorg.Fork, genesis.Hash) || len(reorg.Disconnected) != 1 || len(reorg.Connected) != 2 || !bytes.Equal(reorg.Connected[0].Hash, b1.Hash) {
+		t.Errorf("got %+v", reorg)
+	}
+
+	//the disconnected payment goes back into the pool, the new branch's coinbases never do
+	var pool *Mempool = NewMempool()
+	UTXO.ReorgMempool(pool, reorg)
+	if pool.Count() != 1 || !pool.Has(spend.ID) {
+		t.Errorf("the pool holds %d transactions, want the disconnected payment", pool.Count())
+	}
+}
+
+func TestReorgToAnInvalidBranchRollsBack(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	var thief *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var genesis *Block = tip(t, chain)
+
+	var a1 *Block = mineOn(w, genesis)
+	connect(t, chain, a1)
+	var b1 *Block = mineOn(thief, genesis)
+	connect(t, chain, b1)
+	var theft *Transaction = spendTx(chain, thief, genesisCoinbase, []TxOutput{payTo(thief, 50)})
+	var b2 *Block = mineOn(thief, b1, theft) //well formed, but its transaction does not verify
+
+	var events []Event
+	chain.Events.Subscribe(func(event Event) { events = append(events, event) })
+	if chain.ConnectBlock(b2) == nil {
+		t.Fatal("connected a branch with an invalid transaction")
+	}
+	if !bytes.Equal(chain.LastHash, a1.Hash) {
+		t.Fatal("the old branch is not the chain again")
+	}
+	var storedTip []byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		storedTip, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil || !bytes.Equal(storedTip, a1.Hash) {
+		t.Fatalf("stored tip %x, %v, want %x", storedTip, err, a1.Hash)
+	}
+	if len(events) != 0 {
+		t.Errorf("a failed reorganisation published %d events", len(events))
+	}
+	if !unspent(UTXO, a1.Transactions[0]) || !unspent(UTXO, genesisCoinbase) {
+		t.Error("the UTXO set was not rolled back")
+	}
+	if unspent(UTXO, b1.Transactions[0]) {
+		t.Error("the valid block of the dropped branch is still in the UTXO set")
+	}
+	if chain.HasBlock(b2.Hash) {
+		t.Error("the invalid block was kept")
+	}
+	if !chain.HasBlock(b1.Hash) {
+		t.Error("the valid block of the branch was dropped, a later block may still build on it")
+	}
+}
@@ -0,0 +1,710 @@
+package Blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+/*
+	Outputs are locked with a small stack based script and inputs carry an unlocking script.
+	To spend an output the unlocking script is run first (it may only push data), then the locking script
+	is run on the resulting stack. The output is unlocked if the locking script finishes with a true value on top.
+
+	Pay to public key hash (the standard template):
+	locking:   OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+	unlocking: <signature> <pubKey>
+
+	Pay to script hash (used for M-of-N multisig):
+	locking:   OP_HASH160 <hash of the redeem script> OP_EQUAL
+	unlocking: <signature 1> ... <signature M> <redeem script>
+	redeem:    OP_M <pubKey 1> ... <pubKey N> OP_N OP_CHECKMULTISIG
+	After the locking script succeeds the redeem script is run on the remaining stack.
+
+	Timelocked outputs prefix a template with a lock:
+	<lock time> OP_CHECKLOCKTIMEVERIFY OP_DROP ...   spendable by transactions with at least this lock time
+	<blocks> OP_CHECKSEQUENCEVERIFY OP_DROP ...      spendable by inputs waiting at least this many blocks
+
+	Data carrier outputs can never be spent and are not added to the UTXO set:
+	OP_RETURN <data>
+*/
+
+const (
+	OP_0         byte = 0x00
+	OP_PUSHDATA1 byte = 0x4c //next byte is the length of the data
+	OP_PUSHDATA2 byte = 0x4d //next two bytes (little endian) are the length of the data
+	OP_1NEGATE   byte = 0x4f
+	OP_1         byte = 0x51 //OP_1 to OP_16 push the numbers 1 to 16
+	OP_16        byte = 0x60
+
+	OP_IF     byte = 0x63
+	OP_NOTIF  byte = 0x64
+	OP_ELSE   byte = 0x67
+	OP_ENDIF  byte = 0x68
+	OP_VERIFY byte = 0x69
+	OP_RETURN byte = 0x6a
+
+	OP_DROP byte = 0x75
+	OP_DUP  byte = 0x76
+	OP_SWAP byte = 0x7c
+	OP_SIZE byte = 0x82
+
+	OP_EQUAL       byte = 0x87
+	OP_EQUALVERIFY byte = 0x88
+
+	OP_SHA256         byte = 0xa8
+	OP_HASH160        byte = 0xa9
+	OP_CHECKSIG       byte = 0xac
+	OP_CHECKSIGVERIFY byte = 0xad
+
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+const (
+	MaxScriptSize      = 10000
+	MaxScriptElement   = 520 //largest single push
+	MaxStackSize       = 1000
+	MaxMultisigKeys    = 7 //the redeem script has to fit into a single push of MaxScriptElement bytes
+	maxScriptNumLength = 4
+	maxLockNumLength   = 5 //lock times are allowed one more byte so timestamps fit
+	MaxDataCarrierSize = 80 //bytes of data a single OP_RETURN output may carry
+)
+
+var opcodeNames map[byte]string = map[byte]string{
+	OP_0: "OP_0", OP_1NEGATE: "OP_1NEGATE", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF",
+	OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN", OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_SWAP: "OP_SWAP",
+	OP_SIZE: "OP_SIZE", OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_SHA256: "OP_SHA256",
+	OP_HASH160: "OP_HASH160", OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY", OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// a single parsed instruction, Data is only set for pushes
+type ScriptOp struct {
+	Opcode byte
+	Data   []byte
+}
+
+// checks signatures and locks against the transaction being verified
+type SignatureChecker interface {
+	CheckSig(signature []byte, pubKey []byte) bool
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+// Encodes a data push using the smallest push opcode
+func PushData(data []byte) []byte {
+	var script []byte
+	switch {
+	case len(data) < int(OP_PUSHDATA1):
+		script = append(script, byte(len(data)))
+	case len(data) <= 0xff:
+		script = append(script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		script = append(script, OP_PUSHDATA2, byte(len(data)), byte(len(data)>>8))
+	}
+	return append(script, data...)
+}
+
+// Encodes a small number, 0 to 16 have their own opcodes
+func PushNumber(num int64) []byte {
+	if num == 0 {
+		return []byte{OP_0}
+	}
+	if num >= 1 && num <= 16 {
+		return []byte{OP_1 + byte(num-1)}
+	}
+	return PushData(encodeScriptNum(num))
+}
+
+func P2PKHScript(pubKeyHash []byte) []byte {
+	var script []byte = []byte{OP_DUP, OP_HASH160}
+	script = append(script, PushData(pubKeyHash)...)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+func P2PKHUnlockingScript(signature []byte, pubKey []byte) []byte {
+	return append(PushData(signature), PushData(pubKey)...)
+}
+
+func P2SHScript(scriptHash []byte) []byte {
+	var script []byte = []byte{OP_HASH160}
+	script = append(script, PushData(scriptHash)...)
+	return append(script, OP_EQUAL)
+}
+
+// Builds the redeem script for an M-of-N multisig, the signatures have to be given in the order of the keys
+func MultisigRedeemScript(m int, pubKeys [][]byte) ([]byte, error) {
+	if len(pubKeys) == 0 || len(pubKeys) > MaxMultisigKeys {
+		return nil, fmt.Errorf("a multisig needs between 1 and %d keys", MaxMultisigKeys)
+	}
+	if m < 1 || m > len(pubKeys) {
+		return nil, fmt.Errorf("cannot require %d of %d signatures", m, len(pubKeys))
+	}
+	var script []byte = PushNumber(int64(m))
+	for _, pubKey := range pubKeys {
+		if len(pubKey) != 64 {
+			return nil, fmt.Errorf("public key %x is not 64 bytes", pubKey)
+		}
+		script = append(script, PushData(pubKey)...)
+	}
+	script = append(script, PushNumber(int64(len(pubKeys)))...)
+	return append(script, OP_CHECKMULTISIG), nil
+}
+
+// returns the required signature count and the keys of a multisig redeem script, ok is false for any other script
+func ParseMultisigScript(script []byte) (m int, pubKeys [][]byte, ok bool) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].Opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	var first, last ScriptOp = ops[0], ops[len(ops)-2]
+	if first.Data != nil || first.Opcode < OP_1 || first.Opcode > OP_16 || last.Data != nil || last.Opcode < OP_1 || last.Opcode > OP_16 {
+		return 0, nil, false
+	}
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.Data == nil {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.Data)
+	}
+	m = int(first.Opcode-OP_1) + 1
+	if len(pubKeys) != int(last.Opcode-OP_1)+1 || m > len(pubKeys) {
+		return 0, nil, false
+	}
+	return m, pubKeys, true
+}
+
+func DataScript(data []byte) []byte {
+	return append([]byte{OP_RETURN}, PushData(data)...)
+}
+
+// returns the data of an OP_RETURN output and whether the script is one
+func ExtractData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil, false
+	}
+	ops, err := ParseScript(script[1:])
+	if err != nil || len(ops) > 1 || (len(ops) == 1 && ops[0].Data == nil) {
+		return nil, true //still unspendable, just not in the standard form
+	}
+	if len(ops) == 0 {
+		return []byte{}, true
+	}
+	return ops[0].Data, true
+}
+
+// Prefixes a locking script with an absolute (lock time) or relative (blocks) lock
+func TimelockScript(lock int64, relative bool, script []byte) []byte {
+	var opcode byte = OP_CHECKLOCKTIMEVERIFY
+	if relative {
+		opcode = OP_CHECKSEQUENCEVERIFY
+	}
+	var result []byte = PushNumber(lock)
+	result = append(result, opcode, OP_DROP)
+	return append(result, script...)
+}
+
+// Splits off a lock prefix added by TimelockScript, scripts without a lock are returned unchanged with lock 0
+func SplitTimelockScript(script []byte) (lock int64, relative bool, inner []byte) {
+	ops, err := ParseScript(script)
+	if err != nil || len(ops) < 3 || ops[2].Opcode != OP_DROP || ops[2].Data != nil {
+		return 0, false, script
+	}
+	if ops[1].Data != nil || (ops[1].Opcode != OP_CHECKLOCKTIMEVERIFY && ops[1].Opcode != OP_CHECKSEQUENCEVERIFY) {
+		return 0, false, script
+	}
+	var prefix []byte //the encoded lock, the inner script starts after it and the two opcodes
+	switch {
+	case ops[0].Data != nil:
+		lock, err = decodeNumber(ops[0].Data, maxLockNumLength)
+		prefix = PushData(ops[0].Data)
+	case ops[0].Opcode >= OP_1 && ops[0].Opcode <= OP_16:
+		lock = int64(ops[0].Opcode-OP_1) + 1
+		prefix = []byte{ops[0].Opcode}
+	default:
+		return 0, false, script
+	}
+	if err != nil || !bytes.HasPrefix(script, prefix) {
+		return 0, false, script
+	}
+	return lock, ops[1].Opcode == OP_CHECKSEQUENCEVERIFY, script[len(prefix)+2:]
+}
+
+// returns the redeem script hash of a pay to script hash script, nil for any other script
+func ExtractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL {
+		return script[2:22]
+	}
+	return nil
+}
+
+// returns the public key hash of a pay to public key hash script, nil for any other script
+func ExtractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+	return nil
+}
+
+func ParseScript(script []byte) ([]ScriptOp, error) {
+	var ops []ScriptOp
+	if len(script) > MaxScriptSize {
+		return nil, errors.New("script is too large")
+	}
+	for pc := 0; pc < len(script); {
+		var opcode byte = script[pc]
+		pc++
+
+		var length int = -1
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			length = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if pc+1 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA1")
+			}
+			length = int(script[pc])
+			pc++
+		case opcode == OP_PUSHDATA2:
+			if pc+2 > len(script) {
+				return nil, errors.New("truncated OP_PUSHDATA2")
+			}
+			length = int(binary.LittleEndian.Uint16(script[pc : pc+2]))
+			pc += 2
+		}
+
+		if length < 0 {
+			ops = append(ops, ScriptOp{Opcode: opcode})
+			continue
+		}
+		if pc+length > len(script) {
+			return nil, errors.New("push past the end of the script")
+		}
+		ops = append(ops, ScriptOp{Opcode: opcode, Data: script[pc : pc+length]})
+		pc += length
+	}
+	return ops, nil
+}
+
+// human readable form of a script, pushes are printed as hex
+func DisasmScript(script []byte) string {
+	ops, err := ParseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+	var parts []string
+	for _, op := range ops {
+		parts = append(parts, op.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (op ScriptOp) String() string {
+	if op.Data != nil {
+		return hex.EncodeToString(op.Data)
+	}
+	if op.Opcode >= OP_1 && op.Opcode <= OP_16 {
+		return fmt.Sprintf("OP_%d", op.Opcode-OP_1+1)
+	}
+	if name, ok := opcodeNames[op.Opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_UNKNOWN_%#x", op.Opcode)
+}
+
+func isPushOnly(ops []ScriptOp) bool {
+	for _, op := range ops {
+		if op.Data == nil && op.Opcode != OP_0 && op.Opcode != OP_1NEGATE && (op.Opcode < OP_1 || op.Opcode > OP_16) {
+			return false
+		}
+	}
+	return true
+}
+
+// Runs the unlocking script and then the locking script on the same stack
+func VerifyScript(unlocking []byte, locking []byte, checker SignatureChecker) error {
+	unlockOps, err := ParseScript(unlocking)
+	if err != nil {
+		return err
+	}
+	if !isPushOnly(unlockOps) {
+		return errors.New("unlocking script may only push data")
+	}
+	lockOps, err := ParseScript(locking)
+	if err != nil {
+		return err
+	}
+
+	var engine ScriptEngine = ScriptEngine{checker: checker}
+	if err := engine.Execute(unlockOps); err != nil {
+		return err
+	}
+	var unlockedStack [][]byte = append([][]byte{}, engine.stack...) //kept for the redeem script of pay to script hash
+	if err := engine.Execute(lockOps); err != nil {
+		return err
+	}
+	if len(engine.stack) == 0 || !castToBool(engine.stack[len(engine.stack)-1]) {
+		return errors.New("script finished with a false value")
+	}
+
+	_, _, inner := SplitTimelockScript(locking) //a time locked pay to script hash output still has to satisfy its redeem script
+	if ExtractScriptHash(inner) == nil {
+		return nil
+	}
+	//the hash matched, now the redeem script itself has to be satisfied by the other pushed values
+	var redeemScript []byte = unlockedStack[len(unlockedStack)-1]
+	redeemOps, err := ParseScript(redeemScript)
+	if err != nil {
+		return err
+	}
+	engine.stack = unlockedStack[:len(unlockedStack)-1]
+	if err := engine.Execute(redeemOps); err != nil {
+		return err
+	}
+	if len(engine.stack) == 0 || !castToBool(engine.stack[len(engine.stack)-1]) {
+		return errors.New("redeem script finished with a false value")
+	}
+	return nil
+}
+
+type ScriptEngine struct {
+	stack   [][]byte
+	checker SignatureChecker
+}
+
+func (e *ScriptEngine) push(data []byte) error {
+	if len(data) > MaxScriptElement {
+		return errors.New("stack element is too large")
+	}
+	if len(e.stack) >= MaxStackSize {
+		return errors.New("stack overflow")
+	}
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *ScriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	var top []byte = e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *ScriptEngine) popNumber() (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data)
+}
+
+// the lock opcodes leave their argument on the stack, it is usually dropped right after
+func (e *ScriptEngine) peekLock() (int64, error) {
+	if len(e.stack) == 0 {
+		return 0, errors.New("stack underflow")
+	}
+	lock, err := decodeNumber(e.stack[len(e.stack)-1], maxLockNumLength)
+	if err != nil {
+		return 0, err
+	}
+	if lock < 0 {
+		return 0, errors.New("negative lock")
+	}
+	return lock, nil
+}
+
+func (e *ScriptEngine) Execute(ops []ScriptOp) error {
+	var conditions []bool //one entry per open OP_IF, only the branches where all entries are true are executed
+
+	for _, op := range ops {
+		var executing bool = true
+		for _, cond := range conditions {
+			executing = executing && cond
+		}
+
+		switch op.Opcode {
+		case OP_IF, OP_NOTIF:
+			var cond bool = false
+			if executing {
+				top, err := e.pop()
+				if err != nil {
+					return err
+				}
+				cond = castToBool(top) == (op.Opcode == OP_IF)
+			}
+			conditions = append(conditions, cond)
+			continue
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+
+		if !executing {
+			continue //skipped branch
+		}
+		if err := e.step(op); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if len(conditions) != 0 {
+		return errors.New("unbalanced OP_IF")
+	}
+	return nil
+}
+
+func (e *ScriptEngine) step(op ScriptOp) error {
+	if op.Data != nil {
+		return e.push(op.Data)
+	}
+
+	switch {
+	case op.Opcode == OP_0:
+		return e.push([]byte{})
+	case op.Opcode == OP_1NEGATE:
+		return e.push(encodeScriptNum(-1))
+	case op.Opcode >= OP_1 && op.Opcode <= OP_16:
+		return e.push(encodeScriptNum(int64(op.Opcode - OP_1 + 1)))
+	}
+
+	switch op.Opcode {
+	case OP_VERIFY:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(top) {
+			return errors.New("verification failed")
+		}
+	case OP_RETURN:
+		return errors.New("output is unspendable")
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		return e.push(e.stack[len(e.stack)-1])
+	case OP_SWAP:
+		if len(e.stack) < 2 {
+			return errors.New("stack underflow")
+		}
+		var n int = len(e.stack)
+		e.stack[n-1], e.stack[n-2] = e.stack[n-2], e.stack[n-1]
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return errors.New("stack underflow")
+		}
+		return e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		var equal bool = bytes.Equal(a, b)
+		if op.Opcode == OP_EQUALVERIFY {
+			if !equal {
+				return errors.New("values are not equal")
+			}
+			return nil
+		}
+		return e.push(boolBytes(equal))
+	case OP_SHA256:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		var hash [32]byte = sha256.Sum256(data)
+		return e.push(hash[:])
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(Wallet.CreatePubKeyHash(data))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		var valid bool = e.checker != nil && e.checker.CheckSig(signature, pubKey)
+		if op.Opcode == OP_CHECKSIGVERIFY {
+			if !valid {
+				return errors.New("invalid signature")
+			}
+			return nil
+		}
+		return e.push(boolBytes(valid))
+	case OP_CHECKLOCKTIMEVERIFY:
+		lockTime, err := e.peekLock()
+		if err != nil {
+			return err
+		}
+		if e.checker == nil || !e.checker.CheckLockTime(lockTime) {
+			return errors.New("lock time has not been reached")
+		}
+	case OP_CHECKSEQUENCEVERIFY:
+		sequence, err := e.peekLock()
+		if err != nil {
+			return err
+		}
+		if e.checker == nil || !e.checker.CheckSequence(sequence) {
+			return errors.New("relative lock has not been reached")
+		}
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op.Opcode == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return errors.New("not enough valid signatures")
+			}
+			return nil
+		}
+		return e.push(boolBytes(valid))
+	default:
+		return errors.New("unknown opcode")
+	}
+	return nil
+}
+
+// Stack: <sig 1> ... <sig M> M <pubKey 1> ... <pubKey N> N (top). The signatures must appear in the same
+// order as their keys, every key is tried at most once.
+func (e *ScriptEngine) checkMultisig() (bool, error) {
+	n, err := e.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > MaxMultisigKeys {
+		return false, errors.New("invalid key count")
+	}
+	var pubKeys [][]byte = make([][]byte, n)
+	for idx := n - 1; idx >= 0; idx-- {
+		if pubKeys[idx], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := e.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, errors.New("invalid signature count")
+	}
+	var signatures [][]byte = make([][]byte, m)
+	for idx := m - 1; idx >= 0; idx-- {
+		if signatures[idx], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	var keyIdx int = 0
+	for _, signature := range signatures {
+		for keyIdx < len(pubKeys) && (e.checker == nil || !e.checker.CheckSig(signature, pubKeys[keyIdx])) {
+			keyIdx++
+		}
+		if keyIdx == len(pubKeys) {
+			return false, nil //ran out of keys before every signature was matched
+		}
+		keyIdx++
+	}
+	return true, nil
+}
+
+// any non zero value is true, negative zero included as false
+func castToBool(data []byte) bool {
+	for idx, b := range data {
+		if b != 0 {
+			return !(idx == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func boolBytes(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// numbers on the stack are little endian with the sign in the highest bit of the last byte
+func encodeScriptNum(num int64) []byte {
+	if num == 0 {
+		return []byte{}
+	}
+	var negative bool = num < 0
+	var abs uint64 = uint64(num)
+	if negative {
+		abs = uint64(-num)
+	}
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		var signByte byte = 0x00
+		if negative {
+			signByte = 0x80
+		}
+		result = append(result, signByte)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+func decodeScriptNum(data []byte) (int64, error) {
+	return decodeNumber(data, maxScriptNumLength)
+}
+
+func decodeNumber(data []byte, maxLength int) (int64, error) {
+	if len(data) > maxLength {
+		return 0, errors.New("number is too large")
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var result int64 = 0
+	for idx, b := range data {
+		result |= int64(b) << uint(8*idx)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		result &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		return -result, nil
+	}
+	return result, nil
+}
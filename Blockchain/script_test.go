@@ -0,0 +1,236 @@
+package Blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// accepts the listed signatures and any lock up to the given values, so scripts can be tested without transactions
+type testChecker struct {
+	sigs     map[string]string //signature --> the public key it is valid for
+	lockTime int64
+	sequence int64
+}
+
+func (checker testChecker) CheckSig(signature []byte, pubKey []byte) bool {
+	validFor, found := checker.sigs[string(signature)]
+	return found && validFor == string(pubKey)
+}
+
+func (checker testChecker) CheckLockTime(lockTime int64) bool {
+	return checker.lockTime >= lockTime
+}
+
+func (checker testChecker) CheckSequence(sequence int64) bool {
+	return checker.sequence >= sequence
+}
+
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 64)
+}
+
+func testSig(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, 64)
+}
+
+func TestVerifyScriptP2PKH(t *testing.T) {
+	var pubKey, otherKey []byte = testKey(1), testKey(2)
+	var sig []byte = testSig(10)
+	var checker testChecker = testChecker{sigs: map[string]string{string(sig): string(pubKey)}}
+	var locking []byte = P2PKHScript(Wallet.CreatePubKeyHash(pubKey))
+
+	var tests = []struct {
+		name      string
+		unlocking []byte
+		valid     bool
+	}{
+		{"valid signature", P2PKHUnlockingScript(sig, pubKey), true},
+		{"wrong signature", P2PKHUnlockingScript(testSig(11), pubKey), false},
+		{"key of another hash", P2PKHUnlockingScript(sig, otherKey), false},
+		{"missing key", PushData(sig), false},
+		{"empty", nil, false},
+		{"not push only", append(P2PKHUnlockingScript(sig, pubKey), OP_DUP), false},
+	}
+	for _, test := range tests {
+		err := VerifyScript(test.unlocking, locking, checker)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestVerifyScriptMultisig(t *testing.T) {
+	var keys [][]byte = [][]byte{testKey(1), testKey(2), testKey(3)}
+	var sigs [][]byte = [][]byte{testSig(11), testSig(12), testSig(13)}
+	var checker testChecker = testChecker{sigs: map[string]string{}}
+	for idx := range keys {
+		checker.sigs[string(sigs[idx])] = string(keys[idx])
+	}
+	redeemScript, err := MultisigRedeemScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locking []byte = P2SHScript(Wallet.CreatePubKeyHash(redeemScript))
+	var unlock = func(redeem []byte, sigs ...[]byte) []byte {
+		var script []byte
+		for _, sig := range sigs {
+			script = append(script, PushData(sig)...)
+		}
+		return append(script, PushData(redeem)...)
+	}
+	otherRedeem, err := MultisigRedeemScript(1, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name      string
+		unlocking []byte
+		valid     bool
+	}{
+		{"first and second key", unlock(redeemScript, sigs[0], sigs[1]), true},
+		{"first and third key", unlock(redeemScript, sigs[0], sigs[2]), true},
+		{"keys out of order", unlock(redeemScript, sigs[2], sigs[0]), false},
+		{"one signature", unlock(redeemScript, sigs[0]), false},
+		{"same signature twice", unlock(redeemScript, sigs[1], sigs[1]), false},
+		{"invalid signature", unlock(redeemScript, sigs[0], testSig(20)), false},
+		{"another redeem script", unlock(otherRedeem, sigs[0]), false},
+	}
+	for _, test := range tests {
+		err := VerifyScript(test.unlocking, locking, checker)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestMultisigRedeemScript(t *testing.T) {
+	var keys [][]byte = [][]byte{testKey(1), testKey(2), testKey(3)}
+	redeemScript, err := MultisigRedeemScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, pubKeys, ok := ParseMultisigScript(redeemScript)
+	if !ok || m != 2 || len(pubKeys) != 3 || !bytes.Equal(pubKeys[2], keys[2]) {
+		t.Errorf("parsed %d of %d keys, %v", m, len(pubKeys), ok)
+	}
+	for _, m := range []int{0, 4} {
+		if _, err := MultisigRedeemScript(m, keys); err == nil {
+			t.Errorf("built a %d of 3 script", m)
+		}
+	}
+}
+
+func TestVerifyScriptTimelocks(t *testing.T) {
+	var pubKey []byte = testKey(1)
+	var sig []byte = testSig(10)
+	var sigs map[string]string = map[string]string{string(sig): string(pubKey)}
+	var p2pkh []byte = P2PKHScript(Wallet.CreatePubKeyHash(pubKey))
+	var unlocking []byte = P2PKHUnlockingScript(sig, pubKey)
+
+	var absolute []byte = TimelockScript(500, false, p2pkh)
+	if VerifyScript(unlocking, absolute, testChecker{sigs: sigs, lockTime: 500}) != nil {
+		t.Error("lock time reached but the output is locked")
+	}
+	if VerifyScript(unlocking, absolute, testChecker{sigs: sigs, lockTime: 499}) == nil {
+		t.Error("spent before the lock time")
+	}
+
+	var relative []byte = TimelockScript(10, true, p2pkh)
+	if VerifyScript(unlocking, relative, testChecker{sigs: sigs, sequence: 10}) != nil {
+		t.Error("relative lock reached but the output is locked")
+	}
+	if VerifyScript(unlocking, relative, testChecker{sigs: sigs, sequence: 9}) == nil {
+		t.Error("spent before the relative lock")
+	}
+}
+
+func TestVerifyScriptTimelockedP2SHRunsRedeemScript(t *testing.T) {
+	var pubKey []byte = testKey(1)
+	var sig []byte = testSig(10)
+	var checker testChecker = testChecker{sigs: map[string]string{string(sig): string(pubKey)}, lockTime: 1000}
+	redeemScript, err := MultisigRedeemScript(1, [][]byte{pubKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locking []byte = TimelockScript(100, false, P2SHScript(Wallet.CreatePubKeyHash(redeemScript)))
+
+	if err := VerifyScript(append(PushData(sig), PushData(redeemScript)...), locking, checker); err != nil {
+		t.Errorf("valid signature: %s", err)
+	}
+	if VerifyScript(append(PushData(testSig(11)), PushData(redeemScript)...), locking, checker) == nil {
+		t.Error("spent with an invalid signature, the redeem script was not run")
+	}
+	if VerifyScript(PushData(redeemScript), locking, checker) == nil {
+		t.Error("spent without a signature, the redeem script was not run")
+	}
+}
+
+func TestSplitTimelockScript(t *testing.T) {
+	var inner []byte = P2PKHScript(bytes.Repeat([]byte{7}, 20))
+	for _, lock := range []int64{1, 16, 17, 500, 1767225600} {
+		for _, relative := range []bool{false, true} {
+			gotLock, gotRelative, gotInner := SplitTimelockScript(TimelockScript(lock, relative, inner))
+			if gotLock != lock || gotRelative != relative || !bytes.Equal(gotInner, inner) {
+				t.Errorf("lock %d relative %v: got %d %v %x", lock, relative, gotLock, gotRelative, gotInner)
+			}
+		}
+	}
+	if lock, _, gotInner := SplitTimelockScript(inner); lock != 0 || !bytes.Equal(gotInner, inner) {
+		t.Error("a script without a lock was split")
+	}
+}
+
+func TestVerifyScriptDataOutputIsUnspendable(t *testing.T) {
+	if VerifyScript(nil, DataScript([]byte("hello")), testChecker{}) == nil {
+		t.Error("a data output was spent")
+	}
+}
+
+func TestDataOutputs(t *testing.T) {
+	output, err := NewDataOutput([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, isData := ExtractData(output.Script); !isData || string(data) != "hello" {
+		t.Errorf("got %q %v", data, isData)
+	}
+	if _, err := NewDataOutput(make([]byte, MaxDataCarrierSize+1)); err == nil {
+		t.Error("built a data output above the size limit")
+	}
+	if _, isData := ExtractData(P2PKHScript(bytes.Repeat([]byte{7}, 20))); isData {
+		t.Error("a payment is a data output")
+	}
+}
+
+func TestExtractPubKeyHash(t *testing.T) {
+	var pubKeyHash []byte = bytes.Repeat([]byte{7}, 20)
+	if !bytes.Equal(ExtractPubKeyHash(P2PKHScript(pubKeyHash)), pubKeyHash) {
+		t.Error("the hash of a pay to public key hash script was not found")
+	}
+	if ExtractPubKeyHash(append(P2PKHScript(pubKeyHash), OP_DROP)) != nil {
+		t.Error("found a hash in another script")
+	}
+}
+
+func TestScriptNumbers(t *testing.T) {
+	for _, num := range []int64{0, 1, -1, 127, 128, -128, 255, 256, 32767, -32768, 1 << 30} {
+		decoded, err := decodeScriptNum(encodeScriptNum(num))
+		if err != nil || decoded != num {
+			t.Errorf("%d: got %d, %v", num, decoded, err)
+		}
+	}
+	if _, err := decodeScriptNum(make([]byte, maxScriptNumLength+1)); err == nil {
+		t.Error("decoded a number longer than allowed")
+	}
+}
+
+func TestParseScriptTruncatedPush(t *testing.T) {
+	for _, script := range [][]byte{{5, 1, 2}, {OP_PUSHDATA1}, {OP_PUSHDATA1, 10, 1}, {OP_PUSHDATA2, 1}} {
+		if _, err := ParseScript(script); err == nil {
+			t.Errorf("parsed the truncated script %x", script)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Light clients (simplified payment verification) keep only the block headers, a few hundred bytes per block
+	instead of every transaction. The headers are checked for their proof of work and for linking up to each other,
+	payments are checked with merkle proofs that a full node supplies against those headers.
+*/
+
+var headersFile string //see nodePath
+
+func headersPath() string {
+	return nodePath(headersFile, "./temp/headers.data")
+}
+
+type HeaderChain struct {
+	Headers       []BlockHeader //Headers[i] is the header at height i
+	FilterHeaders [][]byte      //filter headers of the blocks scanned so far, FilterHeaders[i] belongs to Headers[i]
+}
+
+// The headers of the full chain from the given height up to the tip, oldest first, for light clients to import
+func (chain *Blockchain) GetHeaders(fromHeight int) []BlockHeader {
+	var headers []BlockHeader
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		if block.Height < fromHeight {
+			break
+		}
+		headers = append([]BlockHeader{block.Header()}, headers...)
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return headers
+}
+
+func HeaderChainExists() bool {
+	if _, err := os.Stat(headersPath()); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// loads the stored headers, a missing file is an empty header chain
+func LoadHeaderChain() (*HeaderChain, error) {
+	var headerChain HeaderChain
+	if !HeaderChainExists() {
+		return &headerChain, nil
+	}
+	fileContent, err := os.ReadFile(headersPath())
+	if err != nil {
+		return nil, err
+	}
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&headerChain)
+	if err != nil {
+		return nil, err
+	}
+	return &headerChain, nil
+}
+
+func (headerChain *HeaderChain) SaveFile() {
+	var content bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&content)
+	var err error = encoder.Encode(headerChain)
+	Handle(err)
+
+	err = os.MkdirAll(filepath.Dir(headersPath()), 0755)
+	Handle(err)
+	err = os.WriteFile(headersPath(), content.Bytes(), 0644)
+	Handle(err)
+}
+
+func (headerChain *HeaderChain) Tip() (BlockHeader, bool) {
+	if len(headerChain.Headers) == 0 {
+		return BlockHeader{}, false
+	}
+	return headerChain.Headers[len(headerChain.Headers)-1], true
+}
+
+// the stored header at the given height
+func (headerChain *HeaderChain) HeaderAt(height int) (BlockHeader, bool) {
+	if height < 0 || height >= len(headerChain.Headers) {
+		return BlockHeader{}, false
+	}
+	return headerChain.Headers[height], true
+}
+
+/*
+Adds a run of consecutive headers, oldest first. The first one has to build on a stored header (or be the genesis
+header of an empty chain, which has to be the genesis the network pins, see Params). Headers that are already
+stored are skipped, a run that branches off below the tip replaces the stored headers only if it ends up longer,
+every block has the same difficulty so longer is more work. The genesis is never replaced.
+Returns the number of headers that were new.
+*/
+func (headerChain *HeaderChain) AddHeaders(headers []BlockHeader) (int, error) {
+	if len(headers) == 0 {
+		return 0, nil
+	}
+	var forkHeight int = headers[0].Height
+	if forkHeight == 0 {
+		if len(headers[0].PrevHash) != 0 {
+			return 0, errors.New("header at height 0 is not a genesis header")
+		}
+		err := checkGenesisHash(headers[0].Hash)
+		if err != nil {
+			return 0, err
+		}
+		//a network without a fixed genesis keeps the first one stored, no branch may replace it
+		genesis, found := headerChain.HeaderAt(0)
+		if found && !bytes.Equal(genesis.Hash, headers[0].Hash) {
+			return 0, fmt.Errorf("genesis header %x is not the stored genesis %x", headers[0].Hash, genesis.Hash)
+		}
+	} else {
+		parent, found := headerChain.HeaderAt(forkHeight - 1)
+		if !found || !bytes.Equal(parent.Hash, headers[0].PrevHash) {
+			return 0, fmt.Errorf("header %x does not build on a stored header, import the earlier headers first", headers[0].Hash)
+		}
+	}
+
+	for idx, header := range headers {
+		if !header.Validate() {
+			return 0, fmt.Errorf("header %x has an invalid proof of work", header.Hash)
+		}
+		if idx > 0 && (header.Height != headers[idx-1].Height+1 || !bytes.Equal(header.PrevHash, headers[idx-1].Hash)) {
+			return 0, fmt.Errorf("header %x does not follow the header before it", header.Hash)
+		}
+	}
+
+	var known int = 0 //leading headers that are stored already
+	for known < len(headers) {
+		stored, found := headerChain.HeaderAt(headers[known].Height)
+		if !found || !bytes.Equal(stored.Hash, headers[known].Hash) {
+			break
+		}
+		known++
+	}
+	if known == len(headers) {
+		return 0, nil
+	}
+
+	var newTip BlockHeader = headers[len(headers)-1]
+	if newTip.Height < len(headerChain.Headers) {
+		return 0, fmt.Errorf("headers branch off at height %d but are not longer than the stored chain", headers[known].Height)
+	}
+	headerChain.Headers = append(headerChain.Headers[:headers[known].Height], headers[known:]...)
+	if len(headerChain.FilterHeaders) > headers[known].Height {
+		headerChain.FilterHeaders = headerChain.FilterHeaders[:headers[known].Height] //they belonged to the replaced blocks
+	}
+	return len(headers) - known, nil
+}
+
+// The part of a payment that a light client can check: the transaction is in a block of the header chain
+type VerifiedPayment struct {
+	Header        BlockHeader
+	Confirmations int
+}
+
+/*
+Checks that the transaction is included in the stored header chain. The transaction itself has to be supplied,
+the proof only carries its id and hash. Everything the full node sent is checked, it does not have to be trusted.
+*/
+func (headerChain *HeaderChain) VerifyPayment(tx *Transaction, txProof *TxProof) (*VerifiedPayment, error) {
+	if !bytes.Equal(tx.UnsignedHash(), tx.ID) {
+		return nil, errors.New("transaction id does not match its contents")
+	}
+	if !bytes.Equal(tx.ID, txProof.TxID) || !bytes.Equal(tx.SignedHash(), txProof.TxHash) {
+		return nil, errors.New("proof is for a different transaction")
+	}
+	err := txProof.Verify()
+	if err != nil {
+		return nil, err
+	}
+	stored, found := headerChain.HeaderAt(txProof.Header.Height)
+	if !found || !bytes.Equal(stored.Hash, txProof.Header.Hash) {
+		return nil, fmt.Errorf("block %x is not part of the header chain, import newer headers first", txProof.Header.Hash)
+	}
+	tip, _ := headerChain.Tip()
+	return &VerifiedPayment{Header: stored, Confirmations: tip.Height - stored.Height + 1}, nil
+}
+
+func HeadersToHex(headers []BlockHeader) string {
+	var encoded bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&encoded)
+	var err error = encoder.Encode(headers)
+	Handle(err)
+	return hex.EncodeToString(encoded.Bytes())
+}
+
+func HeadersFromHex(data string) ([]BlockHeader, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	var headers []BlockHeader
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(raw))
+	err = decoder.Decode(&headers)
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
@@ -0,0 +1,157 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// mines count blocks on top of prev without storing them, for branches the full chain does not have
+func testBranch(w *Wallet.Wallet, prev BlockHeader, count int) []BlockHeader {
+	var headers []BlockHeader
+	for i := 0; i < count; i++ {
+		var block *Block = CreateBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", prev.Height+1)}, prev.Hash, prev.Height+1)
+		prev = block.Header()
+		headers = append(headers, prev)
+	}
+	return headers
+}
+
+func TestHeaderChainVerifiesPayment(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, 50)})
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1), spend}))
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1)}))
+
+	var headerChain HeaderChain
+	added, err := headerChain.AddHeaders(chain.GetHeaders(0))
+	if err != nil || added != 3 {
+		t.Fatalf("added %d headers: %v", added, err)
+	}
+	added, err = headerChain.AddHeaders(chain.GetHeaders(1))
+	if err != nil || added != 0 {
+		t.Errorf("added %d known headers again: %v", added, err)
+	}
+
+	txProof, err := chain.GetTransactionProof(spend.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment, err := headerChain.VerifyPayment(spend, txProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Header.Height != 1 || payment.Confirmations != 2 {
+		t.Errorf("got height %d with %d confirmations", payment.Header.Height, payment.Confirmations)
+	}
+	if _, err := headerChain.VerifyPayment(genesisCoinbase, txProof); err == nil {
+		t.Error("verified the proof of another transaction")
+	}
+
+	var unknown HeaderChain
+	_, err = unknown.AddHeaders(chain.GetHeaders(0)[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unknown.VerifyPayment(spend, txProof); err == nil {
+		t.Error("verified a payment in a block that is not in the header chain")
+	}
+}
+
+func TestHeaderChainRejects(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, _ := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1)}))
+	var headers []BlockHeader = chain.GetHeaders(0)
+
+	var badWork []BlockHeader = append([]BlockHeader{}, headers...)
+	badWork[1].Nonce++
+	var tests = []struct {
+		name    string
+		headers []BlockHeader
+		want    string
+	}{
+		{"missing parent", headers[1:], "does not build on a stored header"},
+		{"out of order", []BlockHeader{headers[0], headers[0]}, "does not follow"},
+		{"invalid proof of work", badWork, "invalid proof of work"},
+	}
+	for _, test := range tests {
+		var headerChain HeaderChain
+		_, err := headerChain.AddHeaders(test.headers)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestHeaderChainPinsTheGenesis(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, _ := newTestChain(t, w)
+	var genesis []BlockHeader = chain.GetHeaders(0)
+	var other []BlockHeader = []BlockHeader{Genesis(CoinbaseTx(string(Wallet.MakeWallet().CreateAddress()), Params.Active.GenesisMessage, 0)).Header()}
+	other = append(other, testBranch(w, other[0], 2)...)
+
+	var headerChain HeaderChain
+	_, err := headerChain.AddHeaders(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := headerChain.AddHeaders(other); err == nil || !strings.Contains(err.Error(), "stored genesis") {
+		t.Errorf("got %v, want the longer chain of another genesis rejected", err)
+	}
+
+	Params.Active.GenesisHash = hex.EncodeToString(other[0].Hash)
+	var empty HeaderChain
+	if _, err := empty.AddHeaders(genesis); err == nil || !strings.Contains(err.Error(), "is not the regtest genesis") {
+		t.Errorf("got %v, want a genesis other than the pinned one rejected", err)
+	}
+	if _, err := empty.AddHeaders(other); err != nil {
+		t.Errorf("the pinned genesis: %s", err)
+	}
+}
+
+func TestTestnetGenesisIsPinned(t *testing.T) {
+	var active *Params.ChainParams = Params.Active
+	var testnet Params.ChainParams = Params.Testnet
+	Params.Active = &testnet
+	t.Cleanup(func() { Params.Active = active })
+	var genesis *Block = Genesis(CoinbaseTx(testnet.GenesisAddress, testnet.GenesisMessage, 0))
+	if hex.EncodeToString(genesis.Hash) != testnet.GenesisHash {
+		t.Errorf("the testnet genesis is %x, the parameters pin %s", genesis.Hash, testnet.GenesisHash)
+	}
+	if err := checkGenesis(genesis); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHeaderChainFollowsLongerBranch(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, _ := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1)}))
+	var headers []BlockHeader = chain.GetHeaders(0)
+
+	var headerChain HeaderChain
+	_, err := headerChain.AddHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var branch []BlockHeader = testBranch(w, headers[0], 2)
+	if _, err := headerChain.AddHeaders(branch[:1]); err == nil {
+		t.Error("switched to a branch that is not longer")
+	}
+	added, err := headerChain.AddHeaders(branch)
+	if err != nil || added != 2 {
+		t.Fatalf("added %d headers: %v", added, err)
+	}
+	if tip, _ := headerChain.Tip(); !bytes.Equal(tip.Hash, branch[1].Hash) {
+		t.Error("the longer branch is not the tip")
+	}
+}
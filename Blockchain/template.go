@@ -0,0 +1,69 @@
+package Blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"time"
+)
+
+/*
+	A block template is a block with everything but the proof of work: it builds on the tip, holds the pooled
+	transactions that are valid in the next block and a coinbase paying the subsidy plus their fees to the reward
+	address. The node's miner and external miners (getblocktemplate and submitblock) only have to find the nonce.
+*/
+
+func (u UTXOSet) NewBlockTemplate(pool *Mempool, rewardAddress string) (*Block, error) {
+	var chain *Blockchain = u.Blockchain
+	if len(chain.LastHash) == 0 {
+		return nil, errors.New("the chain is empty")
+	}
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+	var height int = tip.Height + 1
+	var timestamp int64 = time.Now().Unix()
+	if timestamp < tip.Timestamp {
+		timestamp = tip.Timestamp //the parent's clock was ahead, a block may not be older than its parent
+	}
+
+	var spent map[string]bool = make(map[string]bool)
+	var txs []*Transaction
+	var fees int = 0
+	for _, tx := range pool.Transactions() {
+		fee, err := u.validateTransaction(tx, height, timestamp, spent)
+		if err != nil {
+			continue //e.g. locked until a later height, it waits in the pool
+		}
+		txs = append(txs, tx)
+		fees += fee
+	}
+	var coinbase *Transaction = CoinbaseTx(rewardAddress, "", height)
+	coinbase.Outputs[0].Value += fees
+	coinbase.ID = coinbase.HashTransaction()
+
+	return &Block{
+		Timestamp:    timestamp,
+		Hash:         []byte{},
+		Transactions: append([]*Transaction{coinbase}, txs...),
+		PrevHash:     tip.Hash,
+		Height:       height,
+	}, nil
+}
+
+// Searches the nonce of a template, false if stop returned true first
+func (block *Block) Mine(stop func() bool) bool {
+	nonce, hash, found := NewProof(block).RunUntil(stop)
+	if found {
+		block.Nonce = nonce
+		block.Hash = hash
+	}
+	return found
+}
+
+// Sets a nonce found by an external miner and the hash it gives, ConnectBlock checks that it meets the target
+func (block *Block) SetNonce(nonce int) {
+	var hash [32]byte = sha256.Sum256(NewProof(block).InitData(nonce))
+	block.Nonce = nonce
+	block.Hash = hash[:]
+}
@@ -0,0 +1,66 @@
+package Blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+func TestBlockTemplateCollectsFees(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var pool *Mempool = NewMempool()
+
+	var spend *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, Params.Active.InitialSubsidy-10)})
+	err := UTXO.AcceptToMempool(pool, spend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//added behind the pool's checks: a second spend of the same output and one locked until a later height
+	pool.add(spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, Params.Active.InitialSubsidy-20)}))
+	var locked Transaction = Transaction{Inputs: []TxInput{{ID: genesisCoinbase.ID, OutputIdx: 0}}, Outputs: []TxOutput{payTo(w, 1)}, LockTime: 5}
+	locked.ID = locked.UnsignedHash()
+	chain.SignTransaction(&locked, w.PrivateKey.ToECDSA())
+	pool.add(&locked)
+
+	var reward string = string(Wallet.MakeWallet().CreateAddress())
+	template, err := UTXO.NewBlockTemplate(pool, reward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Height != 1 || !bytes.Equal(template.PrevHash, chain.LastHash) {
+		t.Errorf("the template builds on height %d", template.Height-1)
+	}
+	if len(template.Transactions) != 2 || !bytes.Equal(template.Transactions[1].ID, spend.ID) {
+		t.Fatalf("got %d transactions, want the coinbase and the first spend", len(template.Transactions))
+	}
+	if value := template.Transactions[0].Outputs[0].Value; value != Params.Active.InitialSubsidy+10 {
+		t.Errorf("the coinbase pays %d, want the subsidy and the fee", value)
+	}
+
+	if template.Mine(func() bool { return true }) {
+		t.Fatal("mined although told to stop")
+	}
+	if !template.Mine(nil) {
+		t.Fatal("gave up without being told to")
+	}
+	var copied Block = *template
+	copied.SetNonce(template.Nonce)
+	if !bytes.Equal(copied.Hash, template.Hash) {
+		t.Error("the nonce does not give the mined hash")
+	}
+	err = chain.ConnectBlock(template)
+	if err != nil {
+		t.Fatalf("the mined template: %s", err)
+	}
+}
+
+func TestBlockTemplateNeedsAChain(t *testing.T) {
+	var UTXO UTXOSet = UTXOSet{Blockchain: &Blockchain{}}
+	if _, err := UTXO.NewBlockTemplate(NewMempool(), "x"); err == nil {
+		t.Error("built a template without a tip")
+	}
+}
@@ -13,28 +13,33 @@ import (
 	"math/big"
 	"strings"
 
+	"github.com/pred695/golang-blockchain/Params"
 	"github.com/pred695/golang-blockchain/Wallet"
 )
 
 // Outpoint is the index of the output in the transaction + the transaction id
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime int64 //the transaction cannot be put into a block before this height (or unix time, see LockTimeThreshold), 0 for none
 }
 
+// lock times below the threshold are block heights, lock times above it are unix timestamps
+const LockTimeThreshold = 500000000
+
 
 // Coinbase Transaction --> A transaction that creates a new coin, it is the first transaction in a block(rewarding transaction).
-// it has no inputs(no reference to previous outputs and no outpoint) and only one output.
-func CoinbaseTx(rec_address string, data string) *Transaction {
+// it has no inputs(no reference to previous outputs and no outpoint) and only one output, paying the subsidy of the block's height.
+func CoinbaseTx(rec_address string, data string, height int) *Transaction {
 	if data == "" {
 		var randData []byte = make([]byte, 24)
 		_, err := rand.Read(randData)
 		Handle(err)
 		data = fmt.Sprintf("%x", randData)
 	}
-	var txin TxInput = TxInput{ID: []byte{}, OutputIdx: -1, Signature: nil, PubKey: []byte(data)}
-	var txout *TxOutput = NewTxOutput(50, rec_address)
+	var txin TxInput = TxInput{ID: []byte{}, OutputIdx: -1, Script: PushData([]byte(data))} //the coinbase script is never run, it only carries the data
+	var txout *TxOutput = NewTxOutput(Params.Active.Subsidy(height), rec_address)
 	tx := Transaction{ID: nil, Inputs: []TxInput{txin}, Outputs: []TxOutput{*txout}}
 	tx.ID = tx.HashTransaction() //creates the hash id for the transaction
 	return &tx
@@ -53,13 +58,38 @@ func (tx *Transaction) Serialize() []byte {
 func (tx *Transaction) HashTransaction() []byte {
 	var hash [32]byte
 
-	var txCopy Transaction = *tx
-	txCopy.ID = []byte{} //setting this to nil since we don't want to hash the ID, creating the circular dependency, the output of this function is going to be used as the ID.
-
-	hash = sha256.Sum256(txCopy.Serialize())
+	hash = sha256.Sum256(tx.hashData()) //the ID itself is not hashed, the output of this function is going to be used as the ID.
 	return hash[:]
 }
 
+// The bytes hashed for the id and the signatures. Gob output cannot be hashed: it depends on the order in which a
+// process first used its types, so two nodes would compute different ids for the same transaction.
+func (tx *Transaction) hashData() []byte {
+	var buff bytes.Buffer
+	writeInt := func(num int64) {
+		buff.Write(ToHex(num))
+	}
+	writeBytes := func(data []byte) {
+		writeInt(int64(len(data)))
+		buff.Write(data)
+	}
+
+	writeInt(int64(len(tx.Inputs)))
+	for _, input := range tx.Inputs {
+		writeBytes(input.ID)
+		writeInt(int64(input.OutputIdx))
+		writeBytes(input.Script)
+		writeInt(int64(input.Sequence))
+	}
+	writeInt(int64(len(tx.Outputs)))
+	for _, output := range tx.Outputs {
+		writeInt(int64(output.Value))
+		writeBytes(output.Script)
+	}
+	writeInt(tx.LockTime)
+	return buff.Bytes()
+}
+
 func (tx *Transaction) Is_Coinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].OutputIdx == -1
 }
@@ -69,18 +99,31 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, input := range tx.Inputs {
-		inputs = append(inputs, TxInput{ID: input.ID, OutputIdx: input.OutputIdx, Signature: nil, PubKey: nil})
+		inputs = append(inputs, TxInput{ID: input.ID, OutputIdx: input.OutputIdx, Script: nil, Sequence: input.Sequence})
 	}
 
 	for _, output := range tx.Outputs {
-		outputs = append(outputs, TxOutput{Value: output.Value, PubKeyHash: output.PubKeyHash})
+		outputs = append(outputs, TxOutput{Value: output.Value, Script: output.Script})
 
 	}
-	var txCopy Transaction = Transaction{ID: tx.ID, Inputs: inputs, Outputs: outputs}
+	var txCopy Transaction = Transaction{ID: tx.ID, Inputs: inputs, Outputs: outputs, LockTime: tx.LockTime}
 	return txCopy
 }
 
-func (UTXO *UTXOSet) NewTransaction(send_address string, rec_address string, amount int) *Transaction {
+// true if the lock time allows the transaction into a block with the given height and timestamp
+func (tx *Transaction) IsFinal(height int, timestamp int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < LockTimeThreshold {
+		return int64(height) >= tx.LockTime
+	}
+	return timestamp >= tx.LockTime
+}
+
+// builds and signs a payment from a wallet in the local wallet file, data is attached as an OP_RETURN output when not empty
+// Outputs already spent by a transaction in the pool are left alone, the pool may be nil.
+func (UTXO *UTXOSet) NewTransaction(send_address string, rec_address string, amount int, data []byte, pool *Mempool) *Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
@@ -88,7 +131,7 @@ func (UTXO *UTXOSet) NewTransaction(send_address string, rec_address string, amo
 	Handle(err)
 	w := wallets.GetWallet(send_address)
 	var pubKeyHash []byte = Wallet.CreatePubKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount, pool)
 
 	if acc < amount {
 		log.Panic("Error: not enough funds")
@@ -99,7 +142,7 @@ func (UTXO *UTXOSet) NewTransaction(send_address string, rec_address string, amo
 		Handle(err)
 
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{ID: txID, OutputIdx: out, Script: nil}
 			inputs = append(inputs, input)
 		}
 	}
@@ -110,8 +153,14 @@ func (UTXO *UTXOSet) NewTransaction(send_address string, rec_address string, amo
 		outputs = append(outputs, *NewTxOutput(acc-amount, send_address)) //sending the remaining amount back to the sender
 	}
 
+	if len(data) > 0 {
+		dataOutput, err := NewDataOutput(data)
+		Handle(err)
+		outputs = append(outputs, *dataOutput)
+	}
+
 	var tx Transaction = Transaction{ID: nil, Inputs: inputs, Outputs: outputs}
-	tx.ID = tx.HashTransaction()
+	tx.ID = tx.UnsignedHash()
 	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey.ToECDSA())
 
 	return &tx
@@ -128,30 +177,18 @@ func (tx *Transaction) Verify(prevTxs map[string]Transaction) bool {
 		}
 	}
 
-	var txCopy Transaction = tx.TrimmedCopy() //copy of the transaction without the signature and public key
-	var curve elliptic.Curve = elliptic.P256()
-
-	for inID, input := range txCopy.Inputs {
+	for inID, input := range tx.Inputs {
 		var prevTx Transaction = prevTxs[hex.EncodeToString(input.ID)] //getting the previous transactions referenced by the input
-		txCopy.Inputs[inID].Signature = nil
-		txCopy.Inputs[inID].PubKey = prevTx.Outputs[input.OutputIdx].PubKeyHash
-		txCopy.ID = txCopy.HashTransaction()
-		txCopy.Inputs[inID].PubKey = nil //clearing it again so it doesn't affect the next iteration and signing
-
-		var r, s big.Int //(Signing Component, Nonce Component)
-		var signatureLen int = len(input.Signature)
-		r.SetBytes(input.Signature[:(signatureLen / 2)])
-		s.SetBytes(input.Signature[(signatureLen / 2):])
-
-		var x, y big.Int
-		var keyLen int = len(input.PubKey)
-		x.SetBytes(input.PubKey[:(keyLen / 2)])
-		y.SetBytes(input.PubKey[(keyLen / 2):])
-
-		var rawPubKey ecdsa.PublicKey = ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		return ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s)
+		if input.OutputIdx < 0 || input.OutputIdx >= len(prevTx.Outputs) {
+			return false
+		}
+		var prevScript []byte = prevTx.Outputs[input.OutputIdx].Script
+		var checker txSignatureChecker = txSignatureChecker{tx: tx, inID: inID, prevScript: prevScript}
+		if err := VerifyScript(input.Script, prevScript, checker); err != nil {
+			return false //the unlocking script does not satisfy the locking script
+		}
 	}
-	return false
+	return true
 }
 
 func (tx *Transaction) Sign(private_key ecdsa.PrivateKey, prevTXs map[string]Transaction) {
@@ -164,20 +201,75 @@ func (tx *Transaction) Sign(private_key ecdsa.PrivateKey, prevTXs map[string]Tra
 			log.Panic("ERROR: Previous transaction does not exist")
 		}
 	}
-	var txCopy = tx.TrimmedCopy() //copy of the transaction without the signature and public key
-	for inID, input := range txCopy.Inputs {
+	var pubKey []byte = make([]byte, 64)
+	private_key.PublicKey.X.FillBytes(pubKey[:32])
+	private_key.PublicKey.Y.FillBytes(pubKey[32:])
 
+	for inID, input := range tx.Inputs {
 		var prevTx Transaction = prevTXs[hex.EncodeToString(input.ID)] //getting the previous transactions referenced by the input
-		txCopy.Inputs[inID].Signature = nil
-		txCopy.Inputs[inID].PubKey = prevTx.Outputs[input.OutputIdx].PubKeyHash
-		txCopy.ID = txCopy.HashTransaction()
-		txCopy.Inputs[inID].PubKey = nil //clearing it again so it doesn't affect the next iteration and signing
-		r, s, err := ecdsa.Sign(rand.Reader, &private_key, txCopy.ID)
-		Handle(err)
-		var signature []byte = append(r.Bytes(), s.Bytes()...)
-		tx.Inputs[inID].Signature = signature
+		var signature []byte = tx.SignInput(inID, private_key, prevTx.Outputs[input.OutputIdx].Script)
+		tx.Inputs[inID].Script = P2PKHUnlockingScript(signature, pubKey)
+	}
+
+}
+
+// The hash that is signed for a single input: a trimmed copy of the transaction where only that input carries
+// the locking script of the output it spends. Signing and verification have to agree on this exactly.
+func (tx *Transaction) SignatureHash(inID int, prevScript []byte) []byte {
+	var txCopy Transaction = tx.TrimmedCopy() //copy of the transaction without any unlocking scripts
+	txCopy.Inputs[inID].Script = prevScript
+	return txCopy.HashTransaction()
+}
+
+// signs one input and returns the signature, the caller supplies the locking script of the spent output so this
+// works without access to the chain, and builds the unlocking script from the signature.
+func (tx *Transaction) SignInput(inID int, private_key ecdsa.PrivateKey, prevScript []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &private_key, tx.SignatureHash(inID, prevScript))
+	Handle(err)
+	var signature []byte = make([]byte, 64)
+	r.FillBytes(signature[:32]) //fixed width halves, verification splits the signature in the middle
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+// checks signatures for OP_CHECKSIG while one input of tx is verified
+type txSignatureChecker struct {
+	tx         *Transaction
+	inID       int
+	prevScript []byte
+}
+
+// the script demands the transaction lock time to be at least lockTime (of the same kind, height or timestamp)
+func (checker txSignatureChecker) CheckLockTime(lockTime int64) bool {
+	if (lockTime < LockTimeThreshold) != (checker.tx.LockTime < LockTimeThreshold) {
+		return false
+	}
+	return checker.tx.LockTime >= lockTime
+}
+
+// the script demands the spending input to wait for at least this many confirmations of the spent output
+func (checker txSignatureChecker) CheckSequence(sequence int64) bool {
+	return int64(checker.tx.Inputs[checker.inID].Sequence) >= sequence
+}
+
+func (checker txSignatureChecker) CheckSig(signature []byte, pubKey []byte) bool {
+	if len(signature) != 64 || len(pubKey) != 64 {
+		return false
 	}
+	var r, s big.Int //(Signing Component, Nonce Component)
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
+
+	var x, y big.Int
+	x.SetBytes(pubKey[:32])
+	y.SetBytes(pubKey[32:])
 
+	var curve elliptic.Curve = elliptic.P256()
+	if !curve.IsOnCurve(&x, &y) {
+		return false
+	}
+	var rawPubKey ecdsa.PublicKey = ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
+	return ecdsa.Verify(&rawPubKey, checker.tx.SignatureHash(checker.inID, checker.prevScript), &r, &s)
 }
 
 func (priv PrivateKey) ToECDSA() ecdsa.PrivateKey {
@@ -188,19 +280,24 @@ func (tx *Transaction) To_String() string {
 	var lines []string
 
 	lines = append(lines, fmt.Sprintf("--- Transaction %x:", tx.ID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("Lock time: %d", tx.LockTime))
+	}
 
 	for idx, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("Input %d:", idx))
 		lines = append(lines, fmt.Sprintf("	Transaction ID: %x", input.ID))
 		lines = append(lines, fmt.Sprintf("	Output Index: %d", input.OutputIdx))
-		lines = append(lines, fmt.Sprintf("	Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("	PubKey: %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("	Script: %s", DisasmScript(input.Script)))
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("	Relative lock: %d blocks", input.Sequence))
+		}
 	}
 
 	for idx, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf(" Output %d:", idx))
 		lines = append(lines, fmt.Sprintf("	Value: %d", output.Value))
-		lines = append(lines, fmt.Sprintf("	PubKeyHash: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("	Script: %s", DisasmScript(output.Script)))
 	}
 	return strings.Join(lines, "\n")
 }
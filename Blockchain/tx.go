@@ -3,27 +3,56 @@ package Blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 
+	"github.com/pred695/golang-blockchain/Params"
 	"github.com/pred695/golang-blockchain/Wallet"
 )
 
 type TxOutput struct {
-	Value      int
-	PubKeyHash []byte
+	Value  int
+	Script []byte //locking script, the conditions for spending this output
 }
 
 type TxOutputs struct {
 	Outputs []TxOutput
+	Indexes []int //position of each unspent output in its transaction, spent outputs are removed from Outputs
+	Height   int  //height of the block that confirmed the transaction
+	Coinbase bool //the outputs were minted by a coinbase and are subject to the coinbase maturity
+}
+
+// a single unspent output together with what validation needs to know about where it came from
+type UTXOEntry struct {
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+}
+
+/*
+	True if the output may be spent by a transaction in a block at the given height. A coinbase output needs the
+	network's CoinbaseMaturity confirmations, so rewards of blocks that may still be replaced are not passed on.
+	The genesis reward is exempt since the genesis block can never be replaced.
+*/
+func (entry UTXOEntry) IsMatureAt(height int) bool {
+	return !entry.Coinbase || entry.Height == 0 || height >= entry.Height+Params.Active.CoinbaseMaturity
 }
 type TxInput struct {
 	ID        []byte //references to the previous output that led to the input
 	OutputIdx int    //index of the referenced output which is spent in the transaction
-	Signature []byte //signature or the sender's public key
-	PubKey    []byte //unhashed
+	Script    []byte //unlocking script, e.g. the signature and the unhashed public key of the sender
+	Sequence  int    //relative lock: the spent output needs this many confirmations before the input is valid, 0 for none
+}
+
+// An output carrying data instead of value, it is provably unspendable
+func NewDataOutput(data []byte) (*TxOutput, error) {
+	if len(data) > MaxDataCarrierSize {
+		return nil, fmt.Errorf("data outputs carry at most %d bytes", MaxDataCarrierSize)
+	}
+	return &TxOutput{Value: 0, Script: DataScript(data)}, nil
 }
 
 func NewTxOutput(value int, address string) *TxOutput {
-	var tx_output TxOutput = TxOutput{Value: value, PubKeyHash: nil}
+	var tx_output TxOutput = TxOutput{Value: value, Script: nil}
 
 	tx_output.Lock([]byte(address))
 
@@ -46,17 +75,31 @@ func DeserializeOutputs(data []byte) TxOutputs {
 	return outputs
 }
 
-func (inputTx *TxInput) UsesKey(pubKeyHash []byte) bool {
-	var lockingHash []byte = Wallet.CreatePubKeyHash(inputTx.PubKey)
-	return bytes.Compare(lockingHash, pubKeyHash) == 0 //the input contains the public key that can unlock the output
+func (outputTx *TxOutput) Lock(address []byte) {
+	outputTx.Script = AddressScript(address)
 }
 
-func (outputTx *TxOutput) Lock(address []byte) {
+// The locking script paying to an address, either a public key hash or a redeem script hash (multisig)
+func AddressScript(address []byte) []byte {
 	var pubKeyHash []byte = Wallet.Base58Decode(address)
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-Wallet.ChecksumLength] //taking the bytes between version and checksum
-	outputTx.PubKeyHash = pubKeyHash                                   //the output is locked with the public key hash, to be unlocked by the input's  public key
+	if Wallet.IsScriptAddress(address) {
+		return P2SHScript(pubKeyHash) //unlocked by a redeem script with this hash, plus whatever the redeem script requires
+	}
+	return P2PKHScript(pubKeyHash) //the output is locked with the public key hash, to be unlocked by the input's public key and signature
+}
+
+// the public key hash of a standard pay to public key hash output, nil for other scripts
+func (output *TxOutput) PubKeyHash() []byte {
+	return ExtractPubKeyHash(output.Script)
+}
+
+func (output *TxOutput) IsDataOutput() bool {
+	_, isData := ExtractData(output.Script)
+	return isData
 }
 
 func (output *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(output.PubKeyHash, pubKeyHash) == 0
+	var lockingHash []byte = output.PubKeyHash()
+	return lockingHash != nil && bytes.Compare(lockingHash, pubKeyHash) == 0
 }
@@ -0,0 +1,70 @@
+package Blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+)
+
+// Proves that a transaction is part of a block: the header carries the proof of work and the merkle root,
+// the merkle proof links the transaction to that root. Nothing else from the chain is needed to check it.
+type TxProof struct {
+	TxID   []byte
+	TxHash []byte //the merkle leaf, see SignedHash
+	Header BlockHeader
+	Proof  MerkleProof
+}
+
+func (chain *Blockchain) GetTransactionProof(txID []byte) (*TxProof, error) {
+	var iter *BlockchainIterator = chain.Iterator()
+	for {
+		var block *Block = iter.Next()
+		for idx, tx := range block.Transactions {
+			if !bytes.Equal(tx.ID, txID) {
+				continue
+			}
+			proof, err := block.MerkleTree().Proof(idx)
+			if err != nil {
+				return nil, err
+			}
+			return &TxProof{TxID: tx.ID, TxHash: tx.SignedHash(), Header: block.Header(), Proof: *proof}, nil
+		}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+	return nil, errors.New("Transaction does not exist")
+}
+
+func (txProof *TxProof) Verify() error {
+	if !txProof.Header.Validate() {
+		return errors.New("block header has an invalid proof of work")
+	}
+	if !VerifyProof(txProof.Header.MerkleRoot, txProof.TxHash, &txProof.Proof) {
+		return errors.New("merkle proof does not lead to the block's merkle root")
+	}
+	return nil
+}
+
+func (txProof *TxProof) ToHex() string {
+	var encoded bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&encoded)
+	var err error = encoder.Encode(txProof)
+	Handle(err)
+	return hex.EncodeToString(encoded.Bytes())
+}
+
+func TxProofFromHex(data string) (*TxProof, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	var txProof TxProof
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(raw))
+	err = decoder.Decode(&txProof)
+	if err != nil {
+		return nil, err
+	}
+	return &txProof, nil
+}
@@ -1,9 +1,14 @@
 package Blockchain
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/pred695/golang-blockchain/Params"
 )
 
 const (
@@ -13,6 +18,15 @@ const (
 
 type UTXOSet struct {
 	Blockchain *Blockchain
+	txn        *badger.Txn //set during a reorganisation, lookups then see the changes it has not committed yet
+}
+
+// runs the lookup in the reorganisation's transaction, if there is one
+func (u UTXOSet) view(fn func(txn *badger.Txn) error) error {
+	if u.txn != nil {
+		return fn(u.txn)
+	}
+	return u.Blockchain.Database.View(fn)
 }
 
 func (u UTXOSet) DeleteByPrefix(prefix []byte) {
@@ -89,47 +103,75 @@ func (u UTXOSet) Reindex() {
 	Handle(err)
 }
 
+// Applies a block that was just added to the chain and publishes BlockConnected.
 func (u UTXOSet) Update(block *Block) {
-	var db *badger.DB = u.Blockchain.Database
-	var err error = db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.Is_Coinbase() == false {
-				for _, input := range tx.Inputs {
-					var updatedOutputs TxOutputs
-					var inID []byte = append([]byte(utxoPrefix), input.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					value, err := item.ValueCopy([]byte{})
-					Handle(err)
+	var err error = u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return u.apply(txn, block)
+	})
+	Handle(err)
+	u.Blockchain.Events.Publish(BlockConnected{Block: block})
+}
 
-					var outputs TxOutputs = DeserializeOutputs(value)
+// The changes of a block to the UTXO set. The outputs it spends are kept as the block's undo data, to put them
+// back if a reorganisation disconnects the block.
+func (u UTXOSet) apply(txn *badger.Txn, block *Block) error {
+	var spent []UnspentOutput
+	for _, tx := range block.Transactions {
+		if tx.Is_Coinbase() == false {
+			for _, input := range tx.Inputs {
+				var updatedOutputs TxOutputs
+				var inID []byte = append([]byte(utxoPrefix), input.ID...)
+				item, err := txn.Get(inID)
+				if err != nil {
+					return fmt.Errorf("output %x:%d: %w", input.ID, input.OutputIdx, err)
+				}
+				value, err := item.ValueCopy([]byte{})
+				if err != nil {
+					return err
+				}
 
-					for outIdx, output := range outputs.Outputs {
-						if outIdx != input.OutputIdx { //if the output is not the one being spent
-							updatedOutputs.Outputs = append(updatedOutputs.Outputs, output)
-						}
-					}
-					if len(updatedOutputs.Outputs) == 0 {
-						err := txn.Delete(inID)
-						Handle(err)
+				var outputs TxOutputs = DeserializeOutputs(value)
+
+				updatedOutputs.Height = outputs.Height
+				updatedOutputs.Coinbase = outputs.Coinbase
+				for i, output := range outputs.Outputs {
+					if outputs.Indexes[i] != input.OutputIdx { //if the output is not the one being spent
+						updatedOutputs.Outputs = append(updatedOutputs.Outputs, output)
+						updatedOutputs.Indexes = append(updatedOutputs.Indexes, outputs.Indexes[i])
 					} else {
-						err := txn.Set(inID, updatedOutputs.SerializeOutputs())
-						Handle(err)
+						var entry UTXOEntry = UTXOEntry{Output: output, Height: outputs.Height, Coinbase: outputs.Coinbase}
+						spent = append(spent, UnspentOutput{UTXOEntry: entry, TxID: input.ID, OutputIdx: input.OutputIdx})
 					}
 				}
+				if len(updatedOutputs.Outputs) == 0 {
+					err = txn.Delete(inID)
+				} else {
+					err = txn.Set(inID, updatedOutputs.SerializeOutputs())
+				}
+				if err != nil {
+					return err
+				}
 			}
-			//change here if problem arises
-			var newOutputs TxOutputs
-			for _, output := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, output)
+		}
+		//change here if problem arises
+		var newOutputs TxOutputs = TxOutputs{Height: block.Height, Coinbase: tx.Is_Coinbase()}
+		for outIdx, output := range tx.Outputs {
+			if output.IsDataOutput() {
+				continue //unspendable, kept out of the UTXO set
 			}
-			var txID []byte = append([]byte(utxoPrefix), tx.ID...)
-			err := txn.Set(txID, newOutputs.SerializeOutputs())
-			Handle(err)
+			newOutputs.Outputs = append(newOutputs.Outputs, output)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
 		}
-		return nil
-	})
-	Handle(err)
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+		var txID []byte = append([]byte(utxoPrefix), tx.ID...)
+		err := txn.Set(txID, newOutputs.SerializeOutputs())
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Set(append([]byte(undoPrefix), block.Hash...), serializeUndo(spent))
 }
 
 func (u UTXOSet) CountTransactions() int {
@@ -150,8 +192,9 @@ func (u UTXOSet) CountTransactions() int {
 	return counter
 }
 
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// all unspent outputs locked with exactly this script, see AddressScript
+func (u UTXOSet) FindUnspentTransactions(lockingScript []byte) []UTXOEntry {
+	var UTXOs []UTXOEntry
 	var db *badger.DB = u.Blockchain.Database
 	err := db.View(func(txn *badger.Txn) error {
 
@@ -168,8 +211,8 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 
 			var outputs TxOutputs = DeserializeOutputs(value)
 			for _, output := range outputs.Outputs{
-				if output.IsLockedWithKey(pubKeyHash){
-					UTXOs = append(UTXOs, output)
+				if bytes.Equal(output.Script, lockingScript){
+					UTXOs = append(UTXOs, UTXOEntry{Output: output, Height: outputs.Height, Coinbase: outputs.Coinbase})
 				}
 			}
 
@@ -180,9 +223,98 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// an unspent output together with the outpoint that spends it
+type UnspentOutput struct {
+	UTXOEntry
+	TxID      []byte
+	OutputIdx int
+}
+
+// like FindUnspentTransactions, but also tells where each output is, for listing them
+func (u UTXOSet) FindUnspentOutputs(lockingScript []byte) []UnspentOutput {
+	var UTXOs []UnspentOutput
+	var db *badger.DB = u.Blockchain.Database
+	err := db.View(func(txn *badger.Txn) error {
+		var opts badger.IteratorOptions = badger.DefaultIteratorOptions
+		var it *badger.Iterator = txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(utxoPrefix)); it.ValidForPrefix([]byte(utxoPrefix)); it.Next() {
+			var item *badger.Item = it.Item()
+			var txID []byte = item.KeyCopy(nil)[prefixLength:]
+			value, err := item.ValueCopy([]byte{})
+			Handle(err)
+
+			var outputs TxOutputs = DeserializeOutputs(value)
+			for i, output := range outputs.Outputs {
+				if bytes.Equal(output.Script, lockingScript) {
+					var entry UTXOEntry = UTXOEntry{Output: output, Height: outputs.Height, Coinbase: outputs.Coinbase}
+					UTXOs = append(UTXOs, UnspentOutput{UTXOEntry: entry, TxID: txID, OutputIdx: outputs.Indexes[i]})
+				}
+			}
+		}
+		return nil
+	})
+	Handle(err)
+	return UTXOs
+}
+
+type Balance struct {
+	Spendable int
+	Immature  int //coinbase rewards waiting for the network's CoinbaseMaturity confirmations
+}
+
+// the balances of several addresses in one pass over the UTXO set
+func (u UTXOSet) Balances(addresses []string) map[string]Balance {
+	var balances map[string]Balance = make(map[string]Balance)
+	var scripts map[string]string = make(map[string]string) //locking script --> address
+	for _, address := range addresses {
+		scripts[string(AddressScript([]byte(address)))] = address
+		balances[address] = Balance{}
+	}
+	var nextHeight int = u.Blockchain.GetBestHeight() + 1
+	u.scanScripts(scripts, func(address string, output UnspentOutput) {
+		var balance Balance = balances[address]
+		if output.IsMatureAt(nextHeight) {
+			balance.Spendable += output.Output.Value
+		} else {
+			balance.Immature += output.Output.Value
+		}
+		balances[address] = balance
+	})
+	return balances
+}
+
+// calls found for every unspent output locked with one of the scripts (locking script --> address)
+func (u UTXOSet) scanScripts(scripts map[string]string, found func(address string, output UnspentOutput)) {
+	var db *badger.DB = u.Blockchain.Database
+	err := db.View(func(txn *badger.Txn) error {
+		var opts badger.IteratorOptions = badger.DefaultIteratorOptions
+		var it *badger.Iterator = txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(utxoPrefix)); it.ValidForPrefix([]byte(utxoPrefix)); it.Next() {
+			value, err := it.Item().ValueCopy([]byte{})
+			Handle(err)
+
+			var txID []byte = it.Item().KeyCopy(nil)[prefixLength:]
+			var outputs TxOutputs = DeserializeOutputs(value)
+			for idx, output := range outputs.Outputs {
+				address, matches := scripts[string(output.Script)]
+				if !matches {
+					continue
+				}
+				var entry UTXOEntry = UTXOEntry{Output: output, Height: outputs.Height, Coinbase: outputs.Coinbase}
+				found(address, UnspentOutput{UTXOEntry: entry, TxID: txID, OutputIdx: outputs.Indexes[idx]})
+			}
+		}
+		return nil
+	})
+	Handle(err)
+}
+
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int, pool *Mempool) (int, map[string][]int) {
 	var unspentOutputs map[string][]int = make(map[string][]int)
 	var accumulated int = 0
+	var nextHeight int = u.Blockchain.GetBestHeight() + 1 //the spending transaction goes into the next block
 	var db *badger.DB = u.Blockchain.Database
 	err := db.View(func(txn *badger.Txn) error {
 		var opts badger.IteratorOptions = badger.DefaultIteratorOptions
@@ -199,10 +331,14 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 			var txID string = hex.EncodeToString(key)
 			var outputs TxOutputs = DeserializeOutputs(value)
 
-			for outIdx, out := range outputs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+			var entry UTXOEntry = UTXOEntry{Height: outputs.Height, Coinbase: outputs.Coinbase}
+			if !entry.IsMatureAt(nextHeight) {
+				continue //immature coinbase
+			}
+			for i, out := range outputs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount && !pool.Spends(key, outputs.Indexes[i]) {
 					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+					unspentOutputs[txID] = append(unspentOutputs[txID], outputs.Indexes[i])
 				}
 			}
 		}
@@ -211,3 +347,179 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 	Handle(err)
 	return accumulated, unspentOutputs
 }
+
+
+// looks up a single unspent output by the transaction id and its index in that transaction
+func (u UTXOSet) FindOutput(txID []byte, outIdx int) (UTXOEntry, bool) {
+	var found bool = false
+	var result UTXOEntry
+	err := u.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(append([]byte(utxoPrefix), txID...))
+		if err == badger.ErrKeyNotFound {
+			return nil //the whole transaction is spent or it never existed
+		}
+		Handle(err)
+		value, err := item.ValueCopy([]byte{})
+		Handle(err)
+
+		var outputs TxOutputs = DeserializeOutputs(value)
+		for i, out := range outputs.Outputs {
+			if outputs.Indexes[i] == outIdx {
+				result = UTXOEntry{Output: out, Height: outputs.Height, Coinbase: outputs.Coinbase}
+				found = true
+			}
+		}
+		return nil
+	})
+	Handle(err)
+	return result, found
+}
+
+/*
+	An error that depends on the state of our chain rather than on the transaction or block itself: an output that
+	is unknown or already spent, a lock that has not expired yet, a block that does not build on our tip. Peers may
+	send such data in good faith, e.g. when two transactions race or the peer is on another branch.
+*/
+type ContextError struct {
+	Reason string
+}
+
+func (err *ContextError) Error() string {
+	return err.Reason
+}
+
+func contextErrorf(format string, args ...interface{}) error {
+	return &ContextError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// whether the error, or an error it wraps, is a ContextError
+func IsContextError(err error) bool {
+	var contextErr *ContextError
+	return errors.As(err, &contextErr)
+}
+
+// checks a transaction against the current UTXO set before it is put into the next block
+func (u UTXOSet) ValidateTransaction(tx *Transaction) error {
+	if tx.Is_Coinbase() {
+		return errors.New("coinbase transactions cannot be submitted")
+	}
+	_, err := u.validateTransaction(tx, u.Blockchain.GetBestHeight()+1, time.Now().Unix(), make(map[string]bool))
+	return err
+}
+
+// checks the transactions of a block at the given height and time, only the first one may be a coinbase and it may
+// not pay out more than the subsidy plus the fees. Transactions can only spend outputs confirmed in earlier blocks.
+func (u UTXOSet) ValidateBlockTransactions(txs []*Transaction, height int, timestamp int64) error {
+	var spent map[string]bool = make(map[string]bool) //outputs spent by earlier transactions of the same block
+	var fees int = 0
+	for idx, tx := range txs {
+		if tx.Is_Coinbase() {
+			if idx != 0 {
+				return errors.New("coinbase is not the first transaction of the block")
+			}
+			continue
+		}
+		fee, err := u.validateTransaction(tx, height, timestamp, spent)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+		fees, err = addMoney(fees, fee)
+		if err != nil {
+			return fmt.Errorf("fees: %w", err)
+		}
+	}
+	if len(txs) > 0 && txs[0].Is_Coinbase() {
+		var reward int = 0
+		for _, output := range txs[0].Outputs {
+			if output.Value <= 0 {
+				return errors.New("coinbase output values must be positive") //a negative output would pay for a larger one
+			}
+			var err error
+			reward, err = addMoney(reward, output.Value)
+			if err != nil {
+				return fmt.Errorf("coinbase: %w", err)
+			}
+		}
+		if reward > Params.Active.Subsidy(height)+fees {
+			return fmt.Errorf("coinbase pays %d, more than the subsidy and fees (%d)", reward, Params.Active.Subsidy(height)+fees)
+		}
+	}
+	return nil
+}
+
+// returns the fee (inputs minus outputs) of a valid transaction
+func (u UTXOSet) validateTransaction(tx *Transaction, height int, timestamp int64, spent map[string]bool) (int, error) {
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return 0, errors.New("transaction needs at least one input and one output")
+	}
+	if !bytes.Equal(tx.ID, tx.UnsignedHash()) {
+		return 0, errors.New("transaction id does not match its contents")
+	}
+	if !tx.IsFinal(height, timestamp) {
+		return 0, contextErrorf("transaction is locked until %d", tx.LockTime)
+	}
+
+	var inputTotal, outputTotal int
+	for _, input := range tx.Inputs {
+		var outpoint string = fmt.Sprintf("%x:%d", input.ID, input.OutputIdx)
+		if spent[outpoint] {
+			return 0, fmt.Errorf("output %s is spent twice", outpoint)
+		}
+		spent[outpoint] = true
+
+		entry, found := u.FindOutput(input.ID, input.OutputIdx)
+		if !found {
+			return 0, contextErrorf("output %s does not exist or is already spent", outpoint)
+		}
+		if input.Sequence < 0 {
+			return 0, errors.New("negative relative lock")
+		}
+		if height < entry.Height+input.Sequence {
+			return 0, contextErrorf("output %s can only be spent from height %d", outpoint, entry.Height+input.Sequence)
+		}
+		if !entry.IsMatureAt(height) {
+			return 0, contextErrorf("coinbase output %s is immature until height %d", outpoint, entry.Height+Params.Active.CoinbaseMaturity)
+		}
+		var err error
+		inputTotal, err = addMoney(inputTotal, entry.Output.Value)
+		if err != nil {
+			return 0, fmt.Errorf("inputs: %w", err)
+		}
+	}
+	var dataOutputs int = 0
+	for _, output := range tx.Outputs {
+		if data, isData := ExtractData(output.Script); isData {
+			dataOutputs++
+			if len(data) > MaxDataCarrierSize || dataOutputs > 1 {
+				return 0, fmt.Errorf("only one data output of at most %d bytes is allowed", MaxDataCarrierSize)
+			}
+			if output.Value != 0 {
+				return 0, errors.New("data outputs cannot carry value, it would be burned")
+			}
+			continue
+		}
+		if output.Value <= 0 {
+			return 0, errors.New("output values must be positive")
+		}
+		var err error
+		outputTotal, err = addMoney(outputTotal, output.Value)
+		if err != nil {
+			return 0, fmt.Errorf("outputs: %w", err)
+		}
+	}
+	if outputTotal > inputTotal {
+		return 0, fmt.Errorf("outputs (%d) spend more than the inputs (%d)", outputTotal, inputTotal)
+	}
+	if !u.Blockchain.VerifyTransaction(tx) {
+		return 0, errors.New("unlocking scripts do not satisfy the spent outputs")
+	}
+	return inputTotal - outputTotal, nil
+}
+
+// adds an amount to a running total, both stay within Params.MaxMoney so the sum cannot overflow
+func addMoney(total int, value int) (int, error) {
+	if value < 0 || value > Params.MaxMoney || total+value > Params.MaxMoney {
+		return 0, fmt.Errorf("amount %d is out of range", value)
+	}
+	return total + value, nil
+}
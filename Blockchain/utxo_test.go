@@ -0,0 +1,286 @@
+package Blockchain
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// a regtest chain in a temporary directory, its genesis block pays the wallet
+func newTestChain(t *testing.T, w *Wallet.Wallet) (*Blockchain, *Transaction) {
+	t.Helper()
+	var active *Params.ChainParams = Params.Active
+	var path string = dbPath
+	var regtest Params.ChainParams = Params.Regtest
+	Params.Active = &regtest
+	dbPath = t.TempDir()
+	t.Cleanup(func() {
+		Params.Active = active
+		dbPath = path
+	})
+
+	var chain *Blockchain = OpenBlockchain()
+	t.Cleanup(func() { chain.Database.Close() })
+	var coinbase *Transaction = CoinbaseTx(string(w.CreateAddress()), Params.Active.GenesisMessage, 0)
+	err := chain.ConnectBlock(Genesis(coinbase))
+	if err != nil {
+		t.Fatalf("genesis: %s", err)
+	}
+	return chain, coinbase
+}
+
+// a signed transaction spending the first output of prevTx
+func spendTx(chain *Blockchain, w *Wallet.Wallet, prevTx *Transaction, outputs []TxOutput) *Transaction {
+	var tx Transaction = Transaction{Inputs: []TxInput{{ID: prevTx.ID, OutputIdx: 0}}, Outputs: outputs}
+	tx.ID = tx.UnsignedHash()
+	chain.SignTransaction(&tx, w.PrivateKey.ToECDSA())
+	return &tx
+}
+
+func payTo(w *Wallet.Wallet, value int) TxOutput {
+	return *NewTxOutput(value, string(w.CreateAddress()))
+}
+
+func TestValidateTransactionAcceptsSpend(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+
+	err := UTXO.ValidateTransaction(spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, 30), payTo(w, 20)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateTransactionRejects(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+
+	var spend = func(values ...int) *Transaction {
+		var outputs []TxOutput
+		for _, value := range values {
+			outputs = append(outputs, payTo(w, value))
+		}
+		return spendTx(chain, w, genesisCoinbase, outputs)
+	}
+	var twice Transaction = Transaction{Inputs: []TxInput{{ID: genesisCoinbase.ID, OutputIdx: 0}, {ID: genesisCoinbase.ID, OutputIdx: 0}}, Outputs: []TxOutput{payTo(w, 50)}}
+	twice.ID = twice.UnsignedHash()
+	var missing Transaction = Transaction{Inputs: []TxInput{{ID: genesisCoinbase.ID, OutputIdx: 1}}, Outputs: []TxOutput{payTo(w, 50)}}
+	missing.ID = missing.UnsignedHash()
+	var changed *Transaction = spend(50)
+	changed.Outputs[0].Value = 49
+	var noInputs Transaction = Transaction{Outputs: []TxOutput{payTo(w, 50)}}
+	noInputs.ID = noInputs.UnsignedHash()
+
+	var tests = []struct {
+		name string
+		tx   *Transaction
+		want string
+	}{
+		{"coinbase", CoinbaseTx(string(w.CreateAddress()), "", 1), "coinbase"},
+		{"output above the inputs", spend(51), "more than the inputs"},
+		{"zero output", spend(50, 0), "must be positive"},
+		{"negative output", spend(-10, 60), "must be positive"},
+		{"output above max money", spend(Params.MaxMoney + 1), "out of range"},
+		{"outputs overflow", spend(math.MaxInt, 2), "out of range"},
+		{"output spent twice", &twice, "spent twice"},
+		{"missing output", &missing, "does not exist"},
+		{"id does not match", changed, "does not match"},
+		{"no inputs", &noInputs, "at least one input"},
+		{"no outputs", spend(), "at least one input and one output"},
+	}
+	for _, test := range tests {
+		err := UTXO.ValidateTransaction(test.tx)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateTransactionRejectsBadSignature(t *testing.T) {
+	var owner, thief *Wallet.Wallet = Wallet.MakeWallet(), Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, owner)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+
+	var theft *Transaction = spendTx(chain, thief, genesisCoinbase, []TxOutput{payTo(thief, 50)})
+	if UTXO.ValidateTransaction(theft) == nil {
+		t.Error("a key of another wallet spent the output")
+	}
+	var forged *Transaction = spendTx(chain, thief, genesisCoinbase, []TxOutput{payTo(thief, 50)})
+	var signature []byte = forged.SignInput(0, thief.PrivateKey.ToECDSA(), genesisCoinbase.Outputs[0].Script)
+	forged.Inputs[0].Script = P2PKHUnlockingScript(signature, owner.PublicKey) //the owner's key, signed by the thief
+	if UTXO.ValidateTransaction(forged) == nil {
+		t.Error("a signature of another key was accepted")
+	}
+}
+
+func TestValidateTransactionLocks(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+
+	var locked Transaction = Transaction{Inputs: []TxInput{{ID: genesisCoinbase.ID, OutputIdx: 0}}, Outputs: []TxOutput{payTo(w, 50)}, LockTime: 5}
+	locked.ID = locked.UnsignedHash()
+	chain.SignTransaction(&locked, w.PrivateKey.ToECDSA())
+	err := UTXO.ValidateTransaction(&locked)
+	if err == nil || !strings.Contains(err.Error(), "locked until") {
+		t.Errorf("got %v, want a lock time error", err)
+	}
+	if UTXO.ValidateBlockTransactions([]*Transaction{&locked}, 5, 0) != nil {
+		t.Error("the lock time is reached at height 5")
+	}
+
+	var waiting Transaction = Transaction{Inputs: []TxInput{{ID: genesisCoinbase.ID, OutputIdx: 0, Sequence: 3}}, Outputs: []TxOutput{payTo(w, 50)}}
+	waiting.ID = waiting.UnsignedHash()
+	chain.SignTransaction(&waiting, w.PrivateKey.ToECDSA())
+	err = UTXO.ValidateTransaction(&waiting)
+	if err == nil || !strings.Contains(err.Error(), "can only be spent from height 3") {
+		t.Errorf("got %v, want a relative lock error", err)
+	}
+}
+
+func TestValidateBlockTransactions(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var coinbase = func(values ...int) *Transaction {
+		var tx *Transaction = CoinbaseTx(string(w.CreateAddress()), "", 1)
+		tx.Outputs = nil
+		for _, value := range values {
+			tx.Outputs = append(tx.Outputs, payTo(w, value))
+		}
+		tx.ID = tx.HashTransaction()
+		return tx
+	}
+	var spend = func(value int) *Transaction {
+		return spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, value)})
+	}
+
+	err := UTXO.ValidateBlockTransactions([]*Transaction{coinbase(Params.Active.InitialSubsidy + 10), spend(40)}, 1, 0)
+	if err != nil {
+		t.Fatalf("a coinbase collecting the fee: %s", err)
+	}
+	var tests = []struct {
+		name string
+		txs  []*Transaction
+		want string
+	}{
+		{"coinbase above the subsidy", []*Transaction{coinbase(Params.Active.InitialSubsidy + 1)}, "more than the subsidy"},
+		{"coinbase above the fees", []*Transaction{coinbase(Params.Active.InitialSubsidy + 11), spend(40)}, "more than the subsidy"},
+		{"zero coinbase output", []*Transaction{coinbase(Params.Active.InitialSubsidy, 0)}, "must be positive"},
+		{"negative coinbase output", []*Transaction{coinbase(-100, 100)}, "must be positive"},
+		{"coinbase sum overflows", []*Transaction{coinbase(math.MaxInt, math.MaxInt)}, "out of range"},
+		{"coinbase not first", []*Transaction{spend(50), coinbase(Params.Active.InitialSubsidy)}, "not the first"},
+		{"double spend in a block", []*Transaction{spend(50), spend(49)}, "spent twice"},
+	}
+	for _, test := range tests {
+		err := UTXO.ValidateBlockTransactions(test.txs, 1, 0)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateTransactionImmatureCoinbase(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, _ := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	var reward *Transaction = CoinbaseTx(string(w.CreateAddress()), "", 1)
+	UTXO.Update(chain.AddBlock([]*Transaction{reward}))
+
+	var spend *Transaction = spendTx(chain, w, reward, []TxOutput{payTo(w, 50)})
+	err := UTXO.ValidateTransaction(spend)
+	if err == nil || !strings.Contains(err.Error(), "immature") {
+		t.Fatalf("got %v, want an immature coinbase", err)
+	}
+	if UTXO.ValidateBlockTransactions([]*Transaction{spend}, 1+Params.Active.CoinbaseMaturity, 0) != nil {
+		t.Error("the coinbase is mature after CoinbaseMaturity blocks")
+	}
+}
+
+func TestIsMatureAt(t *testing.T) {
+	var tests = []struct {
+		entry  UTXOEntry
+		height int
+		mature bool
+	}{
+		{UTXOEntry{Height: 5}, 6, true},
+		{UTXOEntry{Height: 0, Coinbase: true}, 1, true},
+		{UTXOEntry{Height: 5, Coinbase: true}, 5 + Params.Active.CoinbaseMaturity - 1, false},
+		{UTXOEntry{Height: 5, Coinbase: true}, 5 + Params.Active.CoinbaseMaturity, true},
+	}
+	for _, test := range tests {
+		if test.entry.IsMatureAt(test.height) != test.mature {
+			t.Errorf("%+v at height %d: want mature %v", test.entry, test.height, test.mature)
+		}
+	}
+}
+
+func TestDataOutputsStayOutOfTheUTXOSet(t *testing.T) {
+	var w *Wallet.Wallet = Wallet.MakeWallet()
+	chain, genesisCoinbase := newTestChain(t, w)
+	var UTXO UTXOSet = UTXOSet{Blockchain: chain}
+	dataOutput, err := NewDataOutput([]byte("document hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var valued TxOutput = *dataOutput
+	valued.Value = 1
+	var tests = []struct {
+		name    string
+		outputs []TxOutput
+		want    string
+	}{
+		{"data output with value", []TxOutput{payTo(w, 49), valued}, "cannot carry value"},
+		{"two data outputs", []TxOutput{payTo(w, 50), *dataOutput, *dataOutput}, "only one data output"},
+	}
+	for _, test := range tests {
+		err := UTXO.ValidateTransaction(spendTx(chain, w, genesisCoinbase, test.outputs))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+
+	var tx *Transaction = spendTx(chain, w, genesisCoinbase, []TxOutput{payTo(w, 50), *dataOutput})
+	err = UTXO.ValidateTransaction(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UTXO.Update(chain.AddBlock([]*Transaction{CoinbaseTx(string(w.CreateAddress()), "", chain.GetBestHeight()+1), tx}))
+	if _, found := UTXO.FindOutput(tx.ID, 1); found {
+		t.Error("the data output is in the UTXO set")
+	}
+	var dataOutputs []DataOutput = chain.FindDataOutputs()
+	if len(dataOutputs) != 1 || string(dataOutputs[0].Data) != "document hash" || dataOutputs[0].BlockHeight != 1 {
+		t.Errorf("got %+v", dataOutputs)
+	}
+}
+
+func TestStorageVersion(t *testing.T) {
+	chain, _ := newTestChain(t, Wallet.MakeWallet())
+	err := checkStorageVersion(chain.Database)
+	if err != nil {
+		t.Fatalf("a new chain: %s", err)
+	}
+	for _, stored := range []string{"", "3"} { //from before the version key, from a newer version
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			if stored == "" {
+				return txn.Delete([]byte("version"))
+			}
+			return txn.Set([]byte("version"), []byte(stored))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkStorageVersion(chain.Database)
+		if err == nil || !strings.Contains(err.Error(), "reindex required") {
+			t.Errorf("version %q: got %v, want a reindex required", stored, err)
+		}
+	}
+}
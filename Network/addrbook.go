@@ -0,0 +1,351 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Params"
+)
+
+/*
+	The address book holds every peer address the node heard of, from seeds, from addr messages and from peers
+	that connected to us. The node picks its outbound peers from it and saves it in temp, so a restarted node
+	finds the network without seeds.
+	Persistent peers are added by hand with addpeer and kept in their own file, the node reconnects to them
+	whenever the connection drops.
+*/
+
+var addrBookFile string //see nodeFile
+var persistentPeersFile string
+
+func addrBookPath() string {
+	return nodeFile(addrBookFile, "./temp/addrbook.data")
+}
+
+func persistentPeersPath() string {
+	return nodeFile(persistentPeersFile, "./temp/peers.data")
+}
+
+const (
+	maxAddrBookSize = 2000
+	maxAddrAttempts = 10             //addresses failing this often in a row are forgotten
+	retryBackoff    = 30 * time.Second //per failed attempt, up to maxRetryBackoff
+	maxRetryBackoff = 10 * time.Minute
+)
+
+/*
+	The path if it is set, otherwise the file in the directory of the network, with NODE_ID added if it is set. The
+	files are found when they are used, as the network is only selected at start up (see Params.Select), tests
+	set the paths to keep their files apart.
+*/
+func nodeFile(path string, file string) string {
+	if path != "" {
+		return path
+	}
+	file = Params.DataPath(file)
+	var nodeID string = os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return file
+	}
+	var ext string = filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "_" + nodeID + ext
+}
+
+type KnownAddress struct {
+	Address     string
+	Source      string    //peer that told us about the address, empty for seeds and peers that connected to us
+	LastSeen    time.Time //last time we were connected to it or a peer vouched for it
+	LastAttempt time.Time
+	Attempts    int  //failed connection attempts since the last success
+	Connected   bool //whether the node was connected to it when the book was saved
+}
+
+type AddrBook struct {
+	mu    sync.Mutex
+	addrs map[string]*KnownAddress
+	dirty bool
+}
+
+func validAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	return err == nil && host != "" && port != "" && port != "0"
+}
+
+// Loads the saved address book, a missing file gives an empty book
+func LoadAddrBook() (*AddrBook, error) {
+	var book *AddrBook = &AddrBook{addrs: make(map[string]*KnownAddress)}
+	fileContent, err := os.ReadFile(addrBookPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var addrs []KnownAddress
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&addrs)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range addrs {
+		book.addrs[addrs[idx].Address] = &addrs[idx]
+	}
+	return book, nil
+}
+
+// Writes the book if it changed, through a temporary file so readers never see half of it
+func (book *AddrBook) Save() error {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if !book.dirty {
+		return nil
+	}
+	var content bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&content)
+	err := encoder.Encode(book.sorted())
+	if err != nil {
+		return err
+	}
+	var file string = addrBookPath()
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file+".tmp", content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(file+".tmp", file)
+	if err == nil {
+		book.dirty = false
+	}
+	return err
+}
+
+// the addresses, most recently seen first, the caller holds book.mu
+func (book *AddrBook) sorted() []KnownAddress {
+	var addrs []KnownAddress
+	for _, known := range book.addrs {
+		addrs = append(addrs, *known)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if !addrs[i].LastSeen.Equal(addrs[j].LastSeen) {
+			return addrs[i].LastSeen.After(addrs[j].LastSeen)
+		}
+		return addrs[i].Address < addrs[j].Address
+	})
+	return addrs
+}
+
+func (book *AddrBook) Addresses() []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	return book.sorted()
+}
+
+func (book *AddrBook) Count() int {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	return len(book.addrs)
+}
+
+// Adds an address or refreshes when it was last seen, returns whether the address is new
+func (book *AddrBook) Add(address string, source string, seen time.Time) bool {
+	if !validAddress(address) {
+		return false
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if seen.After(time.Now()) {
+		seen = time.Now() //peers do not get to push their addresses to the top with timestamps in the future
+	}
+	if known, found := book.addrs[address]; found {
+		if seen.After(known.LastSeen) {
+			known.LastSeen = seen
+			book.dirty = true
+		}
+		return false
+	}
+	if len(book.addrs) >= maxAddrBookSize {
+		book.evict()
+	}
+	book.addrs[address] = &KnownAddress{Address: address, Source: source, LastSeen: seen}
+	book.dirty = true
+	return true
+}
+
+// drops the address that failed most often, or the one not seen for the longest time, the caller holds book.mu
+func (book *AddrBook) evict() {
+	var worst *KnownAddress
+	for _, known := range book.addrs {
+		if known.Connected {
+			continue
+		}
+		if worst == nil || known.Attempts > worst.Attempts ||
+			known.Attempts == worst.Attempts && known.LastSeen.Before(worst.LastSeen) {
+			worst = known
+		}
+	}
+	if worst != nil {
+		delete(book.addrs, worst.Address)
+	}
+}
+
+func (book *AddrBook) Remove(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if _, found := book.addrs[address]; found {
+		delete(book.addrs, address)
+		book.dirty = true
+	}
+}
+
+// records a connection attempt before dialing
+func (book *AddrBook) Attempt(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if known, found := book.addrs[address]; found {
+		known.LastAttempt = time.Now()
+		known.Attempts++
+		book.dirty = true
+		if known.Attempts >= maxAddrAttempts && !known.Connected {
+			delete(book.addrs, address)
+		}
+	}
+}
+
+// records a completed handshake with the address
+func (book *AddrBook) Good(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if known, found := book.addrs[address]; found {
+		known.LastSeen = time.Now()
+		known.Attempts = 0
+		known.Connected = true
+		book.dirty = true
+	}
+}
+
+func (book *AddrBook) Disconnected(address string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if known, found := book.addrs[address]; found && known.Connected {
+		known.Connected = false
+		book.dirty = true
+	}
+}
+
+// the saved connection state is stale after a restart
+func (book *AddrBook) clearConnected() {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	for _, known := range book.addrs {
+		known.Connected = false
+	}
+}
+
+// Picks a random address to connect to that is not in skip and whose retry backoff has passed
+func (book *AddrBook) Pick(skip func(address string) bool) (string, bool) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	var candidates []string
+	for address, known := range book.addrs {
+		var backoff time.Duration = time.Duration(known.Attempts) * retryBackoff
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		if known.Connected || time.Since(known.LastAttempt) < backoff || skip(address) {
+			continue
+		}
+		candidates = append(candidates, address)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[rand.Intn(len(candidates))], true
+}
+
+// Up to max random addresses, to answer a getaddr
+func (book *AddrBook) Sample(max int) []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	var addrs []KnownAddress = book.sorted()
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+	return addrs
+}
+
+// The peers added with addpeer, a missing file means there are none
+func LoadPersistentPeers() ([]string, error) {
+	fileContent, err := os.ReadFile(persistentPeersPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []string
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&peers)
+	return peers, err
+}
+
+func savePersistentPeers(peers []string) error {
+	var content bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&content)
+	err := encoder.Encode(peers)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(persistentPeersPath()), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(persistentPeersPath()+".tmp", content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(persistentPeersPath()+".tmp", persistentPeersPath())
+}
+
+// Adds a peer the node always stays connected to, returns false if it was already added
+func AddPersistentPeer(address string) (bool, error) {
+	if !validAddress(address) {
+		return false, errors.New("address must be HOST:PORT")
+	}
+	peers, err := LoadPersistentPeers()
+	if err != nil {
+		return false, err
+	}
+	for _, peer := range peers {
+		if peer == address {
+			return false, nil
+		}
+	}
+	return true, savePersistentPeers(append(peers, address))
+}
+
+// Removes a persistent peer, returns false if it was not added
+func RemovePersistentPeer(address string) (bool, error) {
+	peers, err := LoadPersistentPeers()
+	if err != nil {
+		return false, err
+	}
+	for idx, peer := range peers {
+		if peer == address {
+			return true, savePersistentPeers(append(peers[:idx], peers[idx+1:]...))
+		}
+	}
+	return false, nil
+}
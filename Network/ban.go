@@ -0,0 +1,220 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+	Every connection has a misbehavior score. Protocol and consensus violations add to it, a peer reaching
+	banThreshold is disconnected and banned for banDuration. Bans are kept in temp so they survive a restart.
+	An outbound peer is banned by the address we dialed (host:port), an inbound one by the host it connects from,
+	the address a peer claims in its version is never trusted for a ban. Loopback hosts are never banned as a
+	whole, on a local cluster that would ban every node, so inbound loopback peers are only disconnected.
+*/
+
+var banListFile string //see nodeFile
+
+func banListPath() string {
+	return nodeFile(banListFile, "./temp/banned.data")
+}
+
+const (
+	banThreshold = 100
+	banDuration  = 24 * time.Hour
+
+	scoreMalformed      = 100 //payloads or frames that do not decode
+	scoreInvalidBlock   = 100
+	scoreInvalidHeader  = 100 //headers with a bad proof of work or that do not follow each other
+	scoreInvalidTx      = 10  //a relaying node should have checked the transaction, but nodes may differ in policy
+	scoreStalling       = 10  //requested data that did not arrive in time
+	scoreAddrFlood      = 20
+	scoreDuplicateHello = 1 //a second version or verack
+)
+
+// returned by message handlers, the peer is punished and only disconnected once it reaches the threshold
+type misbehavior struct {
+	score  int
+	reason string
+}
+
+func (err *misbehavior) Error() string {
+	return err.reason
+}
+
+func misbehaving(score int, format string, args ...interface{}) error {
+	return &misbehavior{score: score, reason: fmt.Sprintf(format, args...)}
+}
+
+// Reads the ban list, a missing file means nobody is banned
+func LoadBanList() (map[string]time.Time, error) {
+	var bans map[string]time.Time = make(map[string]time.Time)
+	fileContent, err := os.ReadFile(banListPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return bans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&bans)
+	return bans, err
+}
+
+// writes the ban list without the expired bans
+func saveBanList(bans map[string]time.Time) error {
+	for address, until := range bans {
+		if time.Now().After(until) {
+			delete(bans, address)
+		}
+	}
+	var content bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&content)
+	err := encoder.Encode(bans)
+	if err != nil {
+		return err
+	}
+	var file string = banListPath()
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file+".tmp", content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func Ban(address string, until time.Time) error {
+	bans, err := LoadBanList()
+	if err != nil {
+		return err
+	}
+	bans[address] = until
+	return saveBanList(bans)
+}
+
+// Lifts a ban, returns false if the address was not banned
+func Unban(address string) (bool, error) {
+	bans, err := LoadBanList()
+	if err != nil {
+		return false, err
+	}
+	until, found := bans[address]
+	if !found || time.Now().After(until) {
+		return false, nil
+	}
+	delete(bans, address)
+	return true, saveBanList(bans)
+}
+
+type BannedAddress struct {
+	Address string
+	Until   time.Time
+}
+
+// The bans in force, the ones ending first first
+func ListBanned() ([]BannedAddress, error) {
+	bans, err := LoadBanList()
+	if err != nil {
+		return nil, err
+	}
+	var banned []BannedAddress
+	for address, until := range bans {
+		if time.Now().Before(until) {
+			banned = append(banned, BannedAddress{Address: address, Until: until})
+		}
+	}
+	sort.Slice(banned, func(i, j int) bool { return banned[i].Until.Before(banned[j].Until) })
+	return banned, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	var ip net.IP = net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// whether the address or its host is banned, the caller holds peersMu
+func (node *Node) banned(address string) bool {
+	var now time.Time = time.Now()
+	if until, found := node.bans[address]; found && now.Before(until) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	until, found := node.bans[host]
+	return found && now.Before(until)
+}
+
+func (node *Node) isBanned(address string) bool {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	return node.banned(address)
+}
+
+// picks up bans lifted with unban while the node runs
+func (node *Node) reloadBans() {
+	bans, err := LoadBanList()
+	if err != nil {
+		fmt.Printf("Cannot load the ban list: %s\n", err)
+		return
+	}
+	node.peersMu.Lock()
+	node.bans = bans
+	node.peersMu.Unlock()
+}
+
+// the address a ban on the peer applies to, empty if the peer cannot be banned
+func (peer *Peer) banAddress() string {
+	if !peer.Inbound {
+		return peer.Address
+	}
+	host, _, err := net.SplitHostPort(peer.conn.RemoteAddr().String())
+	if err != nil || isLoopback(host) {
+		return ""
+	}
+	return host
+}
+
+// Adds to the peer's score, bans and disconnects it at the threshold. Returns whether the peer was disconnected.
+func (node *Node) punish(peer *Peer, score int, reason string) bool {
+	node.peersMu.Lock()
+	peer.score += score
+	var total int = peer.score
+	node.peersMu.Unlock()
+	fmt.Printf("%s misbehaved (+%d, score %d): %s\n", peer.Address, score, total, reason)
+	if total < banThreshold {
+		return false
+	}
+
+	var address string = peer.banAddress()
+	if address != "" {
+		var until time.Time = time.Now().Add(banDuration)
+		node.peersMu.Lock()
+		node.bans[address] = until
+		node.peersMu.Unlock()
+		err := Ban(address, until)
+		if err != nil {
+			fmt.Printf("Cannot save the ban of %s: %s\n", address, err)
+		}
+		if !peer.Inbound {
+			node.book.Remove(address) //an address we dialed, not one the peer claims
+		}
+		fmt.Printf("Banned %s until %s\n", address, until.Format("2006-01-02 15:04:05"))
+	}
+	peer.conn.Close()
+	return true
+}
@@ -0,0 +1,183 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Params"
+)
+
+// keeps the ban list of a test out of the node's temp directory
+func testBanList(t *testing.T) {
+	t.Helper()
+	var saved string = banListFile
+	banListFile = filepath.Join(t.TempDir(), "banned.data")
+	t.Cleanup(func() { banListFile = saved })
+}
+
+func TestBanListPersists(t *testing.T) {
+	testBanList(t)
+	var now time.Time = time.Now()
+	for address, until := range map[string]time.Time{
+		"10.0.0.1:3000": now.Add(2 * time.Hour),
+		"10.0.0.2":      now.Add(time.Hour),
+		"10.0.0.3:3000": now.Add(-time.Hour),
+	} {
+		err := Ban(address, until)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	banned, err := ListBanned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banned) != 2 || banned[0].Address != "10.0.0.2" || banned[1].Address != "10.0.0.1:3000" {
+		t.Fatalf("got %v, want the bans in force, ending first first", banned)
+	}
+	bans, err := LoadBanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := bans["10.0.0.3:3000"]; found {
+		t.Error("the expired ban was saved")
+	}
+
+	lifted, err := Unban("10.0.0.2")
+	if err != nil || !lifted {
+		t.Fatalf("unban: %v %v", lifted, err)
+	}
+	lifted, err = Unban("10.0.0.2")
+	if err != nil || lifted {
+		t.Errorf("unbanned an address twice: %v %v", lifted, err)
+	}
+}
+
+// a connection that reports the given remote address
+type remoteConn struct {
+	net.Conn
+	remote string
+}
+
+func (conn remoteConn) RemoteAddr() net.Addr {
+	address, _ := net.ResolveTCPAddr("tcp", conn.remote)
+	return address
+}
+
+func TestBanAddress(t *testing.T) {
+	var tests = []struct {
+		name    string
+		peer    *Peer
+		address string
+	}{
+		{"outbound", &Peer{Address: "10.0.0.1:3000"}, "10.0.0.1:3000"},
+		{"inbound", &Peer{conn: remoteConn{remote: "10.0.0.1:51234"}, Inbound: true, version: &Version{}}, "10.0.0.1"},
+		{"inbound claiming another address", &Peer{conn: remoteConn{remote: "10.0.0.1:51234"}, Inbound: true, version: &Version{AddrFrom: "10.0.0.9:3000"}}, "10.0.0.1"},
+		{"inbound from loopback", &Peer{conn: remoteConn{remote: "127.0.0.1:51234"}, Inbound: true, version: &Version{}}, ""},
+	}
+	for _, test := range tests {
+		if address := test.peer.banAddress(); address != test.address {
+			t.Errorf("%s: got %q, want %q", test.name, address, test.address)
+		}
+	}
+}
+
+func TestPunishBansAtThreshold(t *testing.T) {
+	testBanList(t)
+	var node *Node = newTestNode()
+	var peer *Peer
+	peer, remote := testPeer(t, node)
+	peer.Address = "10.0.0.1:3000"
+
+	if node.punish(peer, banThreshold-scoreInvalidTx, "test") {
+		t.Fatal("disconnected below the threshold")
+	}
+	if node.isBanned(peer.Address) {
+		t.Fatal("banned below the threshold")
+	}
+	if !node.punish(peer, scoreInvalidTx, "test") {
+		t.Fatal("kept the peer at the threshold")
+	}
+	if !node.isBanned("10.0.0.1:3000") || node.isBanned("10.0.0.1:3001") {
+		t.Error("did not ban exactly the peer's address")
+	}
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Error("the connection is still open")
+	}
+
+	//a restarted node keeps the ban
+	if !newTestNode().isBanned("10.0.0.1:3000") {
+		t.Error("the ban was not persisted")
+	}
+}
+
+func TestHostBanCoversEveryPort(t *testing.T) {
+	testBanList(t)
+	var node *Node = newTestNode()
+	node.bans = map[string]time.Time{"10.0.0.1": time.Now().Add(time.Hour), "10.0.0.2": time.Now().Add(-time.Hour)}
+	if !node.isBanned("10.0.0.1:3000") || !node.isBanned("10.0.0.1") {
+		t.Error("a host ban does not cover its addresses")
+	}
+	if node.isBanned("10.0.0.2:3000") {
+		t.Error("an expired ban is in force")
+	}
+}
+
+func TestProtocolViolationsAreScored(t *testing.T) {
+	var violation *misbehavior
+
+	var frame bytes.Buffer
+	binary.Write(&frame, binary.BigEndian, Params.Active.Magic)
+	binary.Write(&frame, binary.BigEndian, uint32(maxMessageSize+1))
+	frame.Write(make([]byte, 16))
+	_, _, err := readMessage(&frame)
+	if !errors.As(err, &violation) || violation.score != scoreMalformed {
+		t.Errorf("oversized frame: got %v", err)
+	}
+
+	//a node of another network is disconnected, not banned
+	frame.Reset()
+	binary.Write(&frame, binary.BigEndian, Params.Active.Magic+1)
+	binary.Write(&frame, binary.BigEndian, uint32(commandLength))
+	frame.Write(make([]byte, commandLength))
+	_, _, err = readMessage(&frame)
+	if err == nil || errors.As(err, &violation) {
+		t.Errorf("other network: got %v", err)
+	}
+
+	err = decodePayload([]byte("not gob"), &Version{})
+	if !errors.As(err, &violation) || violation.score != scoreMalformed {
+		t.Errorf("malformed payload: got %v", err)
+	}
+
+	var node *Node = newTestNode()
+	peer, _ := testPeer(t, node)
+	err = node.handleVerack(peer)
+	if !errors.As(err, &violation) || violation.score != scoreDuplicateHello {
+		t.Errorf("duplicate verack: got %v", err)
+	}
+
+	_, _, err = readMessage(bytes.NewReader(nil))
+	if errors.As(err, &violation) {
+		t.Error("a closed connection counted as misbehavior")
+	}
+}
+
+func TestPanicDisconnectsWithoutBanning(t *testing.T) {
+	var node *Node = newTestNode()
+	peer, _ := testPeer(t, node)
+	node.chain.LastHash = []byte{1} //there is no database to read it from
+
+	var err error = node.safeHandleMessage(peer, "getblocks", nil)
+	var violation *misbehavior
+	if err == nil || errors.As(err, &violation) {
+		t.Fatalf("got %v, want an error that disconnects without scoring the peer", err)
+	}
+}
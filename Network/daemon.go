@@ -0,0 +1,153 @@
+package Network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+	A running node owns the chain database. The PID file keeps a second node (or a CLI command) off the same files
+	and tells stopnode whom to signal, a file left behind by a killed node is taken over.
+	Shutdown stops the node in an order that leaves nothing half written: no new connections or requests, the
+	miner finishes or drops its block, peers are disconnected, the address book and the pool are saved and the
+	database is closed while the node holds the chain lock, which it keeps so no late handler touches the closed
+	database.
+*/
+
+var pidFile string //see nodeFile
+
+func pidPath() string {
+	return nodeFile(pidFile, "./temp/node.pid")
+}
+
+const shutdownTimeout = 10 * time.Second
+
+// Reads the PID of the running node, 0 if no node is running
+func RunningNodePID() (int, error) {
+	content, err := os.ReadFile(pidPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("%s does not hold a PID", pidPath())
+	}
+	if !processAlive(pid) {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// Writes our PID, fails if another node is running on the same files. The returned function removes the file.
+func LockNode() (func(), error) {
+	var path string = pidPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			pid, err := RunningNodePID()
+			if err != nil {
+				return nil, err
+			}
+			if pid != 0 && pid != os.Getpid() {
+				return nil, fmt.Errorf("a node is already running with PID %d", pid)
+			}
+			fmt.Printf("Removing the PID file of a node that did not shut down cleanly\n")
+			os.Remove(path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+		file.Close()
+		if err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		return func() { os.Remove(path) }, nil
+	}
+	return nil, fmt.Errorf("cannot create %s", path)
+}
+
+// registers an HTTP server to be shut down with the node
+func (node *Node) trackServer(server *http.Server) {
+	node.peersMu.Lock()
+	node.servers = append(node.servers, server)
+	node.peersMu.Unlock()
+}
+
+// Stops the node and closes the chain database, ListenAndServe returns once it is done. Safe to call more than once.
+func (node *Node) Shutdown() {
+	node.shutdownOnce.Do(func() {
+		close(node.quit)
+
+		node.peersMu.Lock()
+		if node.listener != nil {
+			node.listener.Close()
+		}
+		var servers []*http.Server = node.servers
+		node.peersMu.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		for _, server := range servers {
+			server.Shutdown(ctx) //waits for running requests, the event streams end on node.quit
+		}
+		cancel()
+
+		node.miners.Wait() //the miner drops the block it works on, or connects it if it was just found
+
+		node.peersMu.Lock()
+		for peer := range node.peers {
+			peer.conn.Close()
+		}
+		node.peersMu.Unlock()
+
+		err := node.book.Save()
+		if err != nil {
+			fmt.Printf("Cannot save the address book: %s\n", err)
+		}
+
+		node.mu.Lock() //never unlocked, see above
+		err = node.mempool.Save()
+		if err != nil {
+			fmt.Printf("Cannot save the mempool: %s\n", err)
+		}
+		err = node.chain.Database.Close()
+		if err != nil {
+			fmt.Printf("Cannot close the database: %s\n", err)
+		}
+		fmt.Println("Node stopped")
+		close(node.stopped)
+	})
+}
+
+func (node *Node) stopping() bool {
+	select {
+	case <-node.quit:
+		return true
+	default:
+		return false
+	}
+}
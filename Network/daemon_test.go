@@ -0,0 +1,87 @@
+package Network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testPIDFile(t *testing.T) {
+	t.Helper()
+	var saved string = pidFile
+	pidFile = filepath.Join(t.TempDir(), "node.pid")
+	t.Cleanup(func() { pidFile = saved })
+}
+
+func TestLockNode(t *testing.T) {
+	testPIDFile(t)
+	if pid, err := RunningNodePID(); pid != 0 || err != nil {
+		t.Fatalf("got %d, %v without a PID file", pid, err)
+	}
+
+	unlock, err := LockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(pidFile)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("the PID file holds %q: %v", content, err)
+	}
+	if pid, _ := RunningNodePID(); pid != os.Getpid() {
+		t.Errorf("got PID %d", pid)
+	}
+	unlock()
+	if _, err = os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Error("unlocking left the PID file")
+	}
+}
+
+func TestLockNodeRefusesARunningNode(t *testing.T) {
+	testPIDFile(t)
+	var other int = os.Getppid() //alive while the test runs
+	err := os.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", other)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockNode()
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(other)) {
+		t.Fatalf("got %v, want the running node refused", err)
+	}
+	content, _ := os.ReadFile(pidFile)
+	if strings.TrimSpace(string(content)) != strconv.Itoa(other) {
+		t.Error("the PID file of the running node was replaced")
+	}
+}
+
+func TestLockNodeTakesOverAStaleFile(t *testing.T) {
+	testPIDFile(t)
+	err := os.WriteFile(pidFile, []byte("2147483646\n"), 0644) //no such process
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := LockNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if pid, _ := RunningNodePID(); pid != os.Getpid() {
+		t.Errorf("got PID %d", pid)
+	}
+}
+
+func TestRunningNodePIDGarbage(t *testing.T) {
+	testPIDFile(t)
+	err := os.WriteFile(pidFile, []byte("not a pid"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = RunningNodePID(); err == nil {
+		t.Error("read a PID from garbage")
+	}
+	if _, err = LockNode(); err == nil {
+		t.Error("took over a PID file it cannot read")
+	}
+}
@@ -0,0 +1,249 @@
+package Network
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/*
+	Peers tell each other about the addresses they know: a node asks its outbound peers with getaddr after the
+	handshake and announces its own address to them with addr. Addresses a node has not heard of before are passed
+	on to a couple of peers, so a new node becomes known to the whole network without flooding it.
+	A loop keeps the outbound slots filled from the address book and reconnects to persistent peers.
+*/
+
+const (
+	DefaultMaxOutbound = 8
+	DefaultMaxInbound  = 32
+	maxAddrPerMsg      = 1000
+	maxAddrRelay       = 10 //larger addr messages answer a getaddr and are not passed on
+	addrRelayFanout    = 2
+	connectInterval    = 5 * time.Second
+)
+
+type NetAddress struct {
+	Address  string //host:port the peer accepts connections on
+	LastSeen int64  //unix time
+}
+
+type Addr struct {
+	Addresses []NetAddress
+}
+
+// whether we are connected or connecting to the address, the caller holds peersMu
+func (node *Node) connectedTo(address string) bool {
+	if address == node.Address || node.dialing[address] {
+		return true
+	}
+	for peer := range node.peers {
+		if peer.Address == address || peer.version != nil && peer.version.AddrFrom == address {
+			return true
+		}
+	}
+	return false
+}
+
+func (node *Node) peerCounts() (int, int) {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	var inbound, outbound int = 0, len(node.dialing)
+	for peer := range node.peers {
+		if peer.Inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
+
+// after the handshake: outbound peers learn our address and are asked for theirs, inbound peers tell us where
+// they accept connections
+func (node *Node) exchangeAddresses(peer *Peer) error {
+	if peer.Inbound {
+		if peer.version.AddrFrom != "" {
+			node.book.Add(peer.version.AddrFrom, "", time.Now())
+		}
+		return nil
+	}
+	node.book.Good(peer.Address)
+	err := peer.send("addr", Addr{Addresses: []NetAddress{{Address: node.Address, LastSeen: time.Now().Unix()}}})
+	if err != nil {
+		return err
+	}
+	if node.book.Count() < maxAddrPerMsg {
+		return peer.send("getaddr", nil)
+	}
+	return nil
+}
+
+// answers the first getaddr of a connection, more would only let a peer scrape our book
+func (node *Node) handleGetAddr(peer *Peer) error {
+	if peer.sentAddrs {
+		return nil
+	}
+	peer.sentAddrs = true
+	var addrs []NetAddress
+	for _, known := range node.book.Sample(maxAddrPerMsg) {
+		if known.Address == peer.Address {
+			continue
+		}
+		addrs = append(addrs, NetAddress{Address: known.Address, LastSeen: known.LastSeen.Unix()})
+	}
+	return peer.send("addr", Addr{Addresses: addrs})
+}
+
+func (node *Node) handleAddr(peer *Peer, payload []byte) error {
+	var addr Addr
+	err := decodePayload(payload, &addr)
+	if err != nil {
+		return err
+	}
+	if len(addr.Addresses) > maxAddrPerMsg {
+		return misbehaving(scoreAddrFlood, "addr with %d addresses", len(addr.Addresses))
+	}
+	var fresh []NetAddress
+	for _, address := range addr.Addresses {
+		peer.known.add(invKey("addr", []byte(address.Address)))
+		if address.Address == node.Address || node.isBanned(address.Address) {
+			continue
+		}
+		if node.book.Add(address.Address, peer.Address, time.Unix(address.LastSeen, 0)) {
+			fresh = append(fresh, address)
+		}
+	}
+	if len(addr.Addresses) <= maxAddrRelay {
+		node.relayAddresses(fresh, peer)
+	}
+	return nil
+}
+
+// passes new addresses on to a few random peers that do not know them yet
+func (node *Node) relayAddresses(addrs []NetAddress, from *Peer) {
+	if len(addrs) == 0 {
+		return
+	}
+	var peers []*Peer = node.readyPeers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	var relayed int = 0
+	for _, peer := range peers {
+		if relayed >= addrRelayFanout {
+			break
+		}
+		if peer == from {
+			continue
+		}
+		var unknown []NetAddress
+		for _, address := range addrs {
+			var key string = invKey("addr", []byte(address.Address))
+			if !peer.known.has(key) {
+				peer.known.add(key)
+				unknown = append(unknown, address)
+			}
+		}
+		if len(unknown) == 0 {
+			continue
+		}
+		err := peer.send("addr", Addr{Addresses: unknown})
+		if err != nil {
+			peer.conn.Close()
+		}
+		relayed++
+	}
+}
+
+// claims an outbound slot for the address, false if we are connected or connecting to it already
+func (node *Node) reserve(address string) bool {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	if node.connectedTo(address) || node.banned(address) {
+		return false
+	}
+	node.dialing[address] = true
+	return true
+}
+
+// connects to a reserved address
+func (node *Node) dial(address string) {
+	node.book.Attempt(address)
+	err := node.Connect(address)
+	node.peersMu.Lock()
+	delete(node.dialing, address)
+	node.peersMu.Unlock()
+	if err != nil {
+		fmt.Printf("Cannot connect to %s: %s\n", address, err)
+	}
+}
+
+// Keeps the outbound slots filled and the persistent peers connected, and saves the address book
+func (node *Node) connectLoop() {
+	for {
+		node.reloadBans()
+		node.connectPersistent()
+
+		_, outbound := node.peerCounts()
+		for free := node.MaxOutbound - outbound; free > 0; free-- {
+			node.peersMu.Lock()
+			address, found := node.book.Pick(func(address string) bool {
+				return node.connectedTo(address) || node.banned(address)
+			})
+			if found {
+				node.dialing[address] = true
+			}
+			node.peersMu.Unlock()
+			if !found {
+				break
+			}
+			go node.dial(address)
+		}
+
+		err := node.book.Save()
+		if err != nil {
+			fmt.Printf("Cannot save the address book: %s\n", err)
+		}
+		select {
+		case <-node.quit:
+			return //Shutdown saves the address book a last time
+		case <-time.After(connectInterval):
+		}
+	}
+}
+
+/*
+	Reloads the persistent peers, they can change while the node runs. New ones are dialed, removed ones are
+	disconnected and forgotten.
+*/
+func (node *Node) connectPersistent() {
+	peers, err := LoadPersistentPeers()
+	if err != nil {
+		fmt.Printf("Cannot load the persistent peers: %s\n", err)
+		return
+	}
+	var current map[string]bool = make(map[string]bool)
+	for _, address := range peers {
+		current[address] = true
+	}
+
+	node.peersMu.Lock()
+	for address := range node.persistent {
+		if current[address] {
+			continue
+		}
+		node.book.Remove(address)
+		for peer := range node.peers {
+			if !peer.Inbound && peer.Address == address {
+				peer.conn.Close()
+			}
+		}
+	}
+	node.persistent = current
+	node.peersMu.Unlock()
+
+	for _, address := range peers {
+		node.book.Add(address, "", time.Time{})
+		if node.reserve(address) {
+			go node.dial(address)
+		}
+	}
+}
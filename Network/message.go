@@ -0,0 +1,140 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/pred695/golang-blockchain/Params"
+)
+
+/*
+	Every message on the wire is a frame:
+	network magic (4 bytes) | length of the rest (4 bytes, big endian) | command (12 bytes, zero padded) | gob encoded payload
+	The magic is Params.Active.Magic, a frame of another network ends the connection before its payload is read.
+	verack and getblocks (asks for the hashes of all blocks, answered with an inv) have no payload.
+*/
+
+const (
+	protocolVersion    = 2
+	minProtocolVersion = 1 //peers speaking an older version are disconnected
+	headersVersion     = 2 //first version with getheaders and headers, older peers sync with getblocks
+	commandLength      = 12
+	maxMessageSize     = 32 << 20 //larger frames are rejected before they are read
+)
+
+// first message in both directions, the connection is usable once both sides sent version and verack
+type Version struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string //address the sender accepts connections on, empty for clients that only submit transactions
+	Nonce      uint64 //random per node, detects connections to ourselves
+}
+
+// announces blocks or transactions by their hash, the receiver asks for the ones it does not have
+type Inv struct {
+	Type  string //"block" or "tx"
+	Items [][]byte
+}
+
+type GetData struct {
+	Type string
+	ID   []byte
+}
+
+// tells the sender why its block or transaction was not accepted
+type Reject struct {
+	Type   string
+	ID     []byte
+	Reason string
+}
+
+type BlockMsg struct {
+	Block []byte //serialized block
+}
+
+type TxMsg struct {
+	Transaction []byte //serialized transaction
+}
+
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+	copy(bytes[:], command)
+	return bytes[:]
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+	return string(command)
+}
+
+func encodePayload(payload interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	var encoder *gob.Encoder = gob.NewEncoder(&buff)
+	err := encoder.Encode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// a payload that does not decode is a protocol violation
+func decodePayload(payload []byte, v interface{}) error {
+	var decoder *gob.Decoder = gob.NewDecoder(bytes.NewReader(payload))
+	err := decoder.Decode(v)
+	if err != nil {
+		return misbehaving(scoreMalformed, "malformed payload: %s", err)
+	}
+	return nil
+}
+
+func writeMessage(w io.Writer, command string, payload interface{}) error {
+	var encoded []byte
+	var err error
+	if payload != nil {
+		encoded, err = encodePayload(payload)
+		if err != nil {
+			return err
+		}
+	}
+	var frame []byte = make([]byte, 8, 8+commandLength+len(encoded))
+	binary.BigEndian.PutUint32(frame, Params.Active.Magic)
+	binary.BigEndian.PutUint32(frame[4:], uint32(commandLength+len(encoded)))
+	frame = append(frame, commandToBytes(command)...)
+	frame = append(frame, encoded...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// reads one frame and returns its command and raw payload
+func readMessage(r io.Reader) (string, []byte, error) {
+	var header [8]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return "", nil, err
+	}
+	if magic := binary.BigEndian.Uint32(header[:4]); magic != Params.Active.Magic {
+		return "", nil, fmt.Errorf("message for another network (magic %08x)", magic)
+	}
+	var length uint32 = binary.BigEndian.Uint32(header[4:])
+	if length < commandLength || length > maxMessageSize {
+		return "", nil, misbehaving(scoreMalformed, "invalid message length %d", length)
+	}
+	var frame []byte = make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return "", nil, err
+	}
+	var command string = bytesToCommand(frame[:commandLength])
+	if command == "" {
+		return "", nil, misbehaving(scoreMalformed, "message without a command")
+	}
+	return command, frame[commandLength:], nil
+}
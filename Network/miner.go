@@ -0,0 +1,96 @@
+package Network
+
+import (
+	"fmt"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+)
+
+/*
+	The miner service of a node started with a reward address. Whenever the pool has transactions (or always, with
+	MineEmptyBlocks) it mines a template on the tip without holding the chain lock, and drops the work as soon as
+	another block becomes the tip, the next template builds on that one. Nothing is mined while the node catches
+	up with its peers, a block on an old tip would leave the node on a branch of its own.
+	External miners get the same templates over RPC with getblocktemplate and hand their blocks to submitblock.
+*/
+
+func (node *Node) wakeMiner() {
+	select {
+	case node.mining <- struct{}{}:
+	default: //already awake
+	}
+}
+
+// called for every new tip, whoever connected it
+func (node *Node) tipChanged(Blockchain.Event) {
+	node.tipChanges.Add(1)
+	node.wakeMiner()
+}
+
+// mines blocks until the node shuts down, woken up by new transactions and new tips
+func (node *Node) miner() {
+	defer node.miners.Done()
+	node.wakeMiner() //there may be work already
+	for {
+		select {
+		case <-node.quit:
+			return
+		case <-node.mining:
+		}
+		block := node.mineBlock()
+		if block == nil {
+			continue
+		}
+		err := node.submitBlock(block)
+		if err != nil {
+			fmt.Printf("Dropped mined block %x: %s\n", block.Hash, err) //the tip changed after the last check
+			continue
+		}
+		fmt.Printf("Mined block %x at height %d with %d transaction(s)\n", block.Hash, block.Height, len(block.Transactions))
+	}
+}
+
+// mines one block on the tip, nil if there is nothing to mine or the tip changed (or the node stops) first
+func (node *Node) mineBlock() *Blockchain.Block {
+	if node.syncing() {
+		return nil
+	}
+	node.mu.Lock()
+	if len(node.chain.LastHash) == 0 || node.mempool.Count() == 0 && !node.MineEmptyBlocks {
+		node.mu.Unlock()
+		return nil
+	}
+	var tip uint64 = node.tipChanges.Load()
+	block, err := node.UTXO.NewBlockTemplate(node.mempool, node.MinerAddress)
+	node.mu.Unlock()
+	if err != nil {
+		fmt.Printf("Cannot build a block template: %s\n", err)
+		return nil
+	}
+	if len(block.Transactions) == 1 && !node.MineEmptyBlocks {
+		return nil //the pooled transactions are locked until a later block
+	}
+	var mined bool = block.Mine(func() bool {
+		return node.stopping() || node.tipChanges.Load() != tip
+	})
+	if !mined {
+		return nil
+	}
+	return block
+}
+
+// connects a block mined by this node or an external miner and announces it
+func (node *Node) submitBlock(block *Blockchain.Block) error {
+	added, err := node.connectBlock(block)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("block %x is already in the chain", block.Hash)
+	}
+	if !node.isTip(block.Hash) {
+		return fmt.Errorf("the tip moved on, block %x is kept on a side branch", block.Hash)
+	}
+	node.blockConnected(block, nil, true)
+	return nil
+}
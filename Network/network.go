@@ -0,0 +1,748 @@
+package Network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+/*
+	A node keeps persistent TCP connections to its peers. New blocks and transactions are announced with an inv,
+	peers that do not have them yet ask for them with getdata, see relay.go. A node that is behind after the
+	handshake catches up with a header first sync, see sync.go.
+*/
+
+const (
+	dialTimeout      = 5 * time.Second
+	handshakeTimeout = 30 * time.Second
+	writeTimeout     = 30 * time.Second
+)
+
+type Node struct {
+	Address         string //host:port other nodes reach the node on, advertised in version and addr messages
+	ListenAddress   string //host:port the listener binds to, Address if empty
+	MinerAddress    string //receives the rewards of the blocks this node mines, empty for nodes that do not mine
+	MineEmptyBlocks bool   //keep mining when the pool is empty, so the chain moves on and rewards mature
+	MaxOutbound     int    //connections the node opens itself
+	MaxInbound      int    //connections the node accepts, more are closed right away
+
+	Identity          *Identity       //signs the encrypted handshakes, nil for an anonymous node
+	RequireEncryption bool            //dial encrypted and refuse plain connections, see transport.go
+	Allowlist         map[string]bool //hex identity keys allowed to connect, nil allows everyone
+
+	mu      sync.Mutex //guards the chain and the mempool
+	chain   *Blockchain.Blockchain
+	UTXO    Blockchain.UTXOSet
+	mempool *Blockchain.Mempool
+
+	peersMu    sync.Mutex
+	peers      map[*Peer]bool
+	dialing    map[string]bool      //outbound connections being opened
+	persistent map[string]bool      //peers added with addpeer
+	bans       map[string]time.Time //banned address or host --> end of the ban
+	book       *AddrBook
+
+	sync          *syncState
+	relay         *relayState
+	subscriptions *subscriptions //clients of the event stream, see subscribe.go
+
+	nonce      uint64
+	mining     chan struct{} //wakes up the miner when transactions or blocks arrive
+	miners     sync.WaitGroup
+	tipChanges atomic.Uint64 //counts new tips, the miner drops its work when it changes, see miner.go
+
+	listener     net.Listener
+	servers      []*http.Server //RPC and REST, guarded by peersMu
+	quit         chan struct{}  //closed when the node starts shutting down
+	stopped      chan struct{}  //closed once the database is closed
+	shutdownOnce sync.Once
+}
+
+type Peer struct {
+	conn     net.Conn
+	Address  string //address we dialed, or the remote address of an inbound connection
+	Inbound  bool
+	Identity []byte //identity key the peer proved in the encrypted handshake, nil if it has none
+
+	version    *Version //set once the peer's version arrived, written under the node's peersMu
+	verack     bool     //set once the peer acknowledged our version, written under the node's peersMu
+	bestHeight int      //highest block the peer is known to have, guarded by the node's peersMu
+	sentAddrs  bool     //whether the peer's getaddr was answered, only used by the read loop
+	score      int      //misbehavior score, guarded by the node's peersMu
+
+	known     *inventorySet //blocks and transactions the peer has or was told about
+	txLimiter rateLimiter   //transactions the peer may announce or send, only used by the read loop
+	queueMu   sync.Mutex
+	txQueue   [][]byte //transaction announcements waiting for the next batch
+
+	writeMu sync.Mutex
+}
+
+func newPeer(conn net.Conn, address string, inbound bool) *Peer {
+	return &Peer{conn: conn, Address: address, Inbound: inbound, bestHeight: -1, known: newInventorySet(maxKnownInventory)}
+}
+
+func NewNode(address string, minerAddress string, chain *Blockchain.Blockchain) *Node {
+	var nonce [8]byte
+	_, err := rand.Read(nonce[:])
+	Blockchain.Handle(err)
+	book, err := LoadAddrBook()
+	if err != nil {
+		fmt.Printf("Cannot load the address book, starting with an empty one: %s\n", err)
+		book = &AddrBook{addrs: make(map[string]*KnownAddress)}
+	}
+	book.clearConnected()
+	bans, err := LoadBanList()
+	if err != nil {
+		fmt.Printf("Cannot load the ban list: %s\n", err)
+		bans = make(map[string]time.Time)
+	}
+	var UTXO Blockchain.UTXOSet = Blockchain.UTXOSet{Blockchain: chain}
+	mempool, err := UTXO.LoadMempool()
+	if err != nil {
+		fmt.Printf("Cannot load the mempool, starting with an empty one: %s\n", err)
+		mempool = Blockchain.NewMempool()
+	}
+	if mempool.Count() > 0 {
+		fmt.Printf("Loaded %d pooled transaction(s)\n", mempool.Count())
+	}
+	var node *Node = &Node{
+		Address:       address,
+		MinerAddress:  minerAddress,
+		MaxOutbound:   DefaultMaxOutbound,
+		MaxInbound:    DefaultMaxInbound,
+		chain:         chain,
+		UTXO:          UTXO,
+		mempool:       mempool,
+		peers:         make(map[*Peer]bool),
+		dialing:       make(map[string]bool),
+		persistent:    make(map[string]bool),
+		bans:          bans,
+		book:          book,
+		sync:          newSyncState(),
+		relay:         newRelayState(),
+		subscriptions: newSubscriptions(),
+		nonce:         binary.BigEndian.Uint64(nonce[:]),
+		mining:        make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	chain.Events.Subscribe(node.subscriptions.handle, Blockchain.TopicBlockConnected, Blockchain.TopicReorg, Blockchain.TopicTxAccepted)
+	chain.Events.Subscribe(node.tipChanged, Blockchain.TopicBlockConnected)
+	chain.Events.Subscribe(node.reorganized, Blockchain.TopicReorg)
+	Blockchain.WatchBalances(chain, walletAddresses())
+	chain.Events.Subscribe(func(event Blockchain.Event) {
+		var changed Blockchain.BalanceChanged = event.(Blockchain.BalanceChanged)
+		fmt.Printf("Balance of %s is now %d (%d immature)\n", changed.Address, changed.Balance, changed.Immature)
+	}, Blockchain.TopicBalanceChanged)
+	return node
+}
+
+// The addresses of the node's wallet file, whose balance changes the node reports. WatchBalances asks for them on
+// every block, the file is only read again when it was modified.
+func walletAddresses() func() []string {
+	var modified time.Time
+	var addresses []string
+	return func() []string {
+		info, err := os.Stat(Wallet.DefaultWalletFile())
+		if err != nil {
+			return nil //no wallet yet
+		}
+		if info.ModTime().Equal(modified) {
+			return addresses
+		}
+		wallets, err := Wallet.CreateWallets()
+		if err != nil {
+			return nil
+		}
+		modified = info.ModTime()
+		addresses = wallets.GetAllAddresses()
+		for address := range wallets.RedeemScripts {
+			addresses = append(addresses, address)
+		}
+		return addresses
+	}
+}
+
+// Connects to peers from the address book and the given seeds and serves incoming connections, returns once
+// Shutdown is done or if the listener fails
+func (node *Node) ListenAndServe(seeds []string) error {
+	var listenAddress string = node.ListenAddress
+	if listenAddress == "" {
+		listenAddress = node.Address
+	}
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	node.peersMu.Lock()
+	node.listener = listener
+	node.peersMu.Unlock()
+	fmt.Printf("Node listening on %s as %s (%s), height %d, %d known address(es)\n", listenAddress, node.Address, Params.Active.Name, node.bestHeight(), node.book.Count())
+
+	for _, address := range seeds {
+		if !node.book.Add(address, "", time.Time{}) && !validAddress(address) {
+			fmt.Printf("Ignoring invalid seed %q\n", address)
+		}
+	}
+	go node.connectLoop()
+	if node.MinerAddress != "" {
+		node.miners.Add(1)
+		go node.miner()
+	}
+	go node.syncLoop()
+	go node.relayLoop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil && node.stopping() {
+			<-node.stopped
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); !isLoopback(host) && node.isBanned(host) {
+			conn.Close()
+			continue
+		}
+		if inbound, _ := node.peerCounts(); inbound >= node.MaxInbound {
+			fmt.Printf("Refusing %s, all %d inbound slots are taken\n", conn.RemoteAddr(), node.MaxInbound)
+			conn.Close()
+			continue
+		}
+		var peer *Peer = newPeer(conn, conn.RemoteAddr().String(), true)
+		node.addPeer(peer)
+		go node.handlePeer(peer)
+	}
+}
+
+// Opens an outbound connection and starts the handshake
+func (node *Node) Connect(address string) error {
+	conn, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	secured, identity, err := node.secureOutbound(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var peer *Peer = newPeer(secured, address, false)
+	peer.Identity = identity
+	node.addPeer(peer)
+	err = node.sendVersion(peer)
+	if err != nil {
+		node.removePeer(peer)
+		return err
+	}
+	go node.handlePeer(peer)
+	return nil
+}
+
+func (node *Node) addPeer(peer *Peer) {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	if node.stopping() {
+		peer.conn.Close() //connected while shutting down, the handler sees the closed connection
+		return
+	}
+	node.peers[peer] = true
+}
+
+func (node *Node) removePeer(peer *Peer) {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	delete(node.peers, peer)
+	peer.conn.Close()
+	if !peer.Inbound {
+		node.book.Disconnected(peer.Address)
+	}
+}
+
+// the peers that finished the handshake
+func (node *Node) readyPeers() []*Peer {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	var peers []*Peer
+	for peer := range node.peers {
+		if peer.ready() {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (peer *Peer) ready() bool {
+	return peer.version != nil && peer.verack
+}
+
+func (node *Node) peerHeight(peer *Peer) int {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	return peer.bestHeight
+}
+
+// remembers that the peer has a block at the given height, e.g. because it sent or announced one
+func (node *Node) raisePeerHeight(peer *Peer, height int) {
+	node.peersMu.Lock()
+	defer node.peersMu.Unlock()
+	if height > peer.bestHeight {
+		peer.bestHeight = height
+	}
+}
+
+func (peer *Peer) send(command string, payload interface{}) error {
+	peer.writeMu.Lock()
+	defer peer.writeMu.Unlock()
+	peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(peer.conn, command, payload)
+}
+
+func (node *Node) bestHeight() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.chain.GetBestHeight()
+}
+
+func (node *Node) sendVersion(peer *Peer) error {
+	return peer.send("version", Version{Version: protocolVersion, BestHeight: node.bestHeight(), AddrFrom: node.Address, Nonce: node.nonce})
+}
+
+// reads messages until the connection fails or the peer breaks the protocol
+func (node *Node) handlePeer(peer *Peer) {
+	defer node.syncPeerGone(peer)
+	defer node.removePeer(peer)
+	peer.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if peer.Inbound {
+		secured, identity, err := node.secureInbound(peer.conn)
+		if err != nil {
+			fmt.Printf("Refusing %s: %s\n", peer.Address, err)
+			return
+		}
+		node.peersMu.Lock()
+		peer.conn = secured
+		peer.Identity = identity
+		node.peersMu.Unlock()
+	}
+	for {
+		command, payload, err := readMessage(peer.conn)
+		var violation *misbehavior
+		if errors.As(err, &violation) {
+			node.punish(peer, banThreshold, violation.reason) //the stream cannot be read any further
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("Connection to %s lost: %s\n", peer.Address, err)
+			}
+			return
+		}
+		err = node.safeHandleMessage(peer, command, payload)
+		if errors.As(err, &violation) {
+			if node.punish(peer, violation.score, fmt.Sprintf("%s: %s", command, violation.reason)) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Disconnecting %s: %s\n", peer.Address, err)
+			return
+		}
+	}
+}
+
+/*
+	A handler that panics on data we did not expect is a bug, but it must not take the node down with it. The bug
+	is ours rather than the peer's, so the peer is only disconnected, not banned.
+*/
+func (node *Node) safeHandleMessage(peer *Peer, command string, payload []byte) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			fmt.Printf("Handling %s from %s panicked: %v\n%s", command, peer.Address, recovered, debug.Stack())
+			err = fmt.Errorf("%s caused a panic: %v", command, recovered)
+		}
+	}()
+	return node.handleMessage(peer, command, payload)
+}
+
+func (node *Node) handleMessage(peer *Peer, command string, payload []byte) error {
+	if command != "version" && command != "verack" && !peer.ready() {
+		return fmt.Errorf("%s before the handshake", command)
+	}
+	switch command {
+	case "version":
+		return node.handleVersion(peer, payload)
+	case "verack":
+		return node.handleVerack(peer)
+	case "getblocks":
+		return node.handleGetBlocks(peer)
+	case "getheaders":
+		return node.handleGetHeaders(peer, payload)
+	case "headers":
+		return node.handleHeaders(peer, payload)
+	case "inv":
+		return node.handleInv(peer, payload)
+	case "getdata":
+		return node.handleGetData(peer, payload)
+	case "block":
+		return node.handleBlock(peer, payload)
+	case "tx":
+		return node.handleTx(peer, payload)
+	case "reject":
+		return node.handleReject(peer, payload)
+	case "getaddr":
+		return node.handleGetAddr(peer)
+	case "addr":
+		return node.handleAddr(peer, payload)
+	default:
+		fmt.Printf("Ignoring unknown command %q from %s\n", command, peer.Address)
+		return nil //newer peers may speak commands we do not know yet
+	}
+}
+
+func (node *Node) handleVersion(peer *Peer, payload []byte) error {
+	if peer.version != nil {
+		return misbehaving(scoreDuplicateHello, "duplicate version")
+	}
+	var version Version
+	err := decodePayload(payload, &version)
+	if err != nil {
+		return err
+	}
+	if version.Nonce == node.nonce {
+		if !peer.Inbound {
+			node.book.Remove(peer.Address) //one of our own addresses
+		}
+		return errors.New("connected to ourselves")
+	}
+	if version.Version < minProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old", version.Version)
+	}
+	if peer.Inbound && version.AddrFrom != "" && node.isBanned(version.AddrFrom) {
+		return fmt.Errorf("%s is banned", version.AddrFrom)
+	}
+	node.peersMu.Lock()
+	peer.version = &version
+	peer.bestHeight = version.BestHeight
+	node.peersMu.Unlock()
+
+	if peer.Inbound {
+		err = node.sendVersion(peer)
+		if err != nil {
+			return err
+		}
+	}
+	err = peer.send("verack", nil)
+	if err != nil {
+		return err
+	}
+	return node.onHandshake(peer)
+}
+
+func (node *Node) handleVerack(peer *Peer) error {
+	if peer.verack {
+		return misbehaving(scoreDuplicateHello, "duplicate verack")
+	}
+	node.peersMu.Lock()
+	peer.verack = true
+	node.peersMu.Unlock()
+	return node.onHandshake(peer)
+}
+
+// called after version and verack, whichever arrives last starts the sync
+func (node *Node) onHandshake(peer *Peer) error {
+	if !peer.ready() {
+		return nil
+	}
+	peer.conn.SetReadDeadline(time.Time{})
+	var transport string = "plain"
+	if peer.Identity != nil {
+		transport = fmt.Sprintf("encrypted, identity %x", peer.Identity)
+	} else if _, secure := peer.conn.(*secureConn); secure {
+		transport = "encrypted, anonymous"
+	}
+	fmt.Printf("Connected to %s (version %d, height %d, %s)\n", peer.Address, peer.version.Version, node.peerHeight(peer), transport)
+	err := node.exchangeAddresses(peer)
+	if err != nil {
+		return err
+	}
+	node.announcePool(peer)
+	if node.peerHeight(peer) > node.bestHeight() {
+		return node.startPeerSync(peer)
+	}
+	return nil
+}
+
+func (node *Node) handleGetBlocks(peer *Peer) error {
+	var hashes [][]byte
+	node.mu.Lock()
+	if len(node.chain.LastHash) != 0 {
+		var iter *Blockchain.BlockchainIterator = node.chain.Iterator()
+		for {
+			var block *Blockchain.Block = iter.Next()
+			hashes = append(hashes, block.Hash)
+			if len(block.PrevHash) == 0 {
+				break
+			}
+		}
+	}
+	node.mu.Unlock()
+	return peer.send("inv", Inv{Type: "block", Items: hashes})
+}
+
+/*
+	Requests the announced items we do not have and did not already ask another peer for.
+	Block hashes come newest first and are requested oldest first. Transaction announcements beyond the peer's
+	rate are dropped, the peer announces them again to the next node anyway.
+*/
+func (node *Node) handleInv(peer *Peer, payload []byte) error {
+	var inv Inv
+	err := decodePayload(payload, &inv)
+	if err != nil {
+		return err
+	}
+	var missing [][]byte
+	for idx := len(inv.Items) - 1; idx >= 0; idx-- {
+		var item []byte = inv.Items[idx]
+		var key string = invKey(inv.Type, item)
+		peer.known.add(key)
+		if node.haveItem(inv.Type, item) || node.isOrphan(inv.Type, item) {
+			continue
+		}
+		if inv.Type == "tx" && (node.relay.rejects.has(key) || !peer.txLimiter.allow(txRelayRate, txRelayBurst)) {
+			continue
+		}
+		if node.markRequested(key) {
+			missing = append(missing, item)
+		}
+	}
+
+	for _, item := range missing {
+		err := peer.send("getdata", GetData{Type: inv.Type, ID: item})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whether the block is in the chain or the sync is downloading it, or the transaction is in the pool
+func (node *Node) haveItem(invType string, hash []byte) bool {
+	if invType == "block" {
+		node.sync.mu.Lock()
+		var queued bool = node.sync.queued(hash)
+		node.sync.mu.Unlock()
+		if queued {
+			return true
+		}
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	switch invType {
+	case "block":
+		return node.chain.HasBlock(hash)
+	case "tx":
+		return node.mempool.Has(hash)
+	}
+	return true //unknown types are never requested
+}
+
+func (node *Node) handleGetData(peer *Peer, payload []byte) error {
+	var getData GetData
+	err := decodePayload(payload, &getData)
+	if err != nil {
+		return err
+	}
+	switch getData.Type {
+	case "block":
+		node.mu.Lock()
+		block, err := node.chain.GetBlock(getData.ID)
+		node.mu.Unlock()
+		if err != nil {
+			return nil //nothing to send, the peer asks someone else
+		}
+		peer.known.add(invKey("block", getData.ID))
+		return peer.send("block", BlockMsg{Block: block.Serialize()})
+	case "tx":
+		node.mu.Lock()
+		tx, found := node.mempool.Get(getData.ID)
+		node.mu.Unlock()
+		if !found {
+			return nil
+		}
+		peer.known.add(invKey("tx", getData.ID))
+		return peer.send("tx", TxMsg{Transaction: tx.Serialize()})
+	}
+	return nil
+}
+
+func (node *Node) handleBlock(peer *Peer, payload []byte) error {
+	var msg BlockMsg
+	err := decodePayload(payload, &msg)
+	if err != nil {
+		return err
+	}
+	block, err := Blockchain.DeserializeBlock(msg.Block)
+	if err != nil {
+		return misbehaving(scoreMalformed, "malformed block: %s", err)
+	}
+	peer.known.add(invKey("block", block.Hash))
+	node.takeRequested(invKey("block", block.Hash))
+	if node.syncBlock(peer, block) {
+		return nil
+	}
+
+	added, err := node.connectBlock(block)
+	if err == errOrphanBlock {
+		return node.addOrphanBlock(peer, block)
+	}
+	if err != nil {
+		fmt.Printf("Rejected block %x from %s: %s\n", block.Hash, peer.Address, err)
+		sendErr := peer.send("reject", Reject{Type: "block", ID: block.Hash, Reason: err.Error()})
+		if sendErr != nil || Blockchain.IsContextError(err) {
+			return sendErr
+		}
+		return misbehaving(scoreInvalidBlock, "invalid block %x: %s", block.Hash, err)
+	}
+	if !added {
+		return nil
+	}
+	if !node.isTip(block.Hash) {
+		fmt.Printf("Added block %x at height %d from %s to a side branch\n", block.Hash, block.Height, peer.Address)
+	} else {
+		fmt.Printf("Added block %x at height %d from %s\n", block.Hash, block.Height, peer.Address)
+	}
+	node.raisePeerHeight(peer, block.Height)
+	node.blockConnected(block, peer, true)
+	return nil
+}
+
+func (node *Node) handleTx(peer *Peer, payload []byte) error {
+	var msg TxMsg
+	err := decodePayload(payload, &msg)
+	if err != nil {
+		return err
+	}
+	tx, err := Blockchain.DeserializeTransaction(msg.Transaction)
+	if err != nil {
+		return misbehaving(scoreMalformed, "malformed transaction: %s", err)
+	}
+	var key string = invKey("tx", tx.ID)
+	peer.known.add(key)
+	var requested bool = node.takeRequested(key)
+	if !requested && !peer.txLimiter.allow(txRelayRate, txRelayBurst) {
+		return nil //unsolicited and over the peer's rate
+	}
+	if node.relay.rejects.has(key) || node.isOrphan("tx", tx.ID) {
+		return nil
+	}
+
+	if node.haveItem("tx", tx.ID) {
+		return nil
+	}
+	parents, err := node.acceptTx(tx)
+	if len(parents) > 0 {
+		return node.addOrphanTx(peer, tx, parents)
+	}
+	if err != nil {
+		fmt.Printf("Rejected transaction %x from %s: %s\n", tx.ID, peer.Address, err)
+		node.relay.rejects.add(key)
+		sendErr := peer.send("reject", Reject{Type: "tx", ID: tx.ID, Reason: err.Error()})
+		if sendErr != nil || Blockchain.IsContextError(err) {
+			return sendErr
+		}
+		return misbehaving(scoreInvalidTx, "invalid transaction %x: %s", tx.ID, err)
+	}
+	fmt.Printf("Accepted transaction %x from %s\n", tx.ID, peer.Address)
+	node.txAccepted(tx, peer)
+	return nil
+}
+
+func (node *Node) handleReject(peer *Peer, payload []byte) error {
+	var reject Reject
+	err := decodePayload(payload, &reject)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s rejected %s %x: %s\n", peer.Address, reject.Type, reject.ID, reject.Reason)
+	return nil
+}
+
+/*
+	Hands a transaction to a running node, for wallets that are not nodes themselves.
+	The connection is always encrypted, the identity may be nil unless the node has an allowlist.
+	Returns the node's reason if it rejects the transaction.
+*/
+func SendTransaction(address string, tx *Blockchain.Transaction, identity *Identity) error {
+	plain, err := net.DialTimeout("tcp", address, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer plain.Close()
+	plain.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, _, err := secureHandshake(plain, true, identity, nil)
+	if err != nil {
+		return err
+	}
+
+	var nonce [8]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		return err
+	}
+	err = writeMessage(conn, "version", Version{Version: protocolVersion, BestHeight: -1, Nonce: binary.BigEndian.Uint64(nonce[:])})
+	if err != nil {
+		return err
+	}
+	for {
+		command, _, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		if command == "version" {
+			break
+		}
+	}
+	err = writeMessage(conn, "verack", nil)
+	if err != nil {
+		return err
+	}
+	err = writeMessage(conn, "tx", TxMsg{Transaction: tx.Serialize()})
+	if err != nil {
+		return err
+	}
+	conn.CloseWrite() //the node handles the transaction and then closes the connection
+
+	for {
+		command, payload, err := readMessage(conn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if command != "reject" {
+			continue
+		}
+		var reject Reject
+		err = decodePayload(payload, &reject)
+		if err == nil && reject.Type == "tx" {
+			return errors.New(reject.Reason)
+		}
+	}
+}
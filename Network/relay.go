@@ -0,0 +1,441 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+)
+
+/*
+	Relay is announce then fetch: a node sends the hash of a new block or transaction in an inv and only peers that
+	do not have it ask for the body. Every peer remembers what it has seen from us and what it told us about, so no
+	item is announced to a peer twice, and every item is requested from one peer at a time.
+	Transaction announcements are collected and sent in batches, block announcements go out right away.
+	Blocks and transactions whose parents are missing are kept aside until the parents arrive.
+*/
+
+const (
+	maxKnownInventory  = 10000 //per peer, the oldest entries are forgotten first
+	maxRecentRejects   = 5000
+	maxInvPerMsg       = 1000
+	invTrickleInterval = 200 * time.Millisecond
+	requestTimeout     = 30 * time.Second //after this an item may be requested from another peer
+	txRelayRate        = 50               //transactions per second a peer may announce or send us
+	txRelayBurst       = 200
+	maxOrphanTxs       = 100
+	maxOrphanTxSize    = 100000
+	orphanTxExpiry     = 20 * time.Minute
+	maxOrphanBlockSize = 16 << 20 //serialized size of all orphan blocks together
+)
+
+func invKey(invType string, hash []byte) string {
+	return invType + ":" + hex.EncodeToString(hash)
+}
+
+// a bounded set of inventory keys
+type inventorySet struct {
+	mu    sync.Mutex
+	items map[string]bool
+	order []string
+	max   int
+}
+
+func newInventorySet(max int) *inventorySet {
+	return &inventorySet{items: make(map[string]bool), max: max}
+}
+
+func (set *inventorySet) add(key string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.items[key] {
+		return
+	}
+	if len(set.order) >= set.max {
+		delete(set.items, set.order[0])
+		set.order = set.order[1:]
+	}
+	set.items[key] = true
+	set.order = append(set.order, key)
+}
+
+func (set *inventorySet) has(key string) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.items[key]
+}
+
+func (set *inventorySet) reset() {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.items = make(map[string]bool)
+	set.order = nil
+}
+
+// token bucket, only used from the peer's read loop
+type rateLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (limiter *rateLimiter) allow(rate float64, burst float64) bool {
+	var now time.Time = time.Now()
+	if limiter.last.IsZero() {
+		limiter.tokens = burst
+	} else {
+		limiter.tokens += now.Sub(limiter.last).Seconds() * rate
+		if limiter.tokens > burst {
+			limiter.tokens = burst
+		}
+	}
+	limiter.last = now
+	if limiter.tokens < 1 {
+		return false
+	}
+	limiter.tokens--
+	return true
+}
+
+type orphanTx struct {
+	tx    *Blockchain.Transaction
+	from  *Peer
+	added time.Time
+}
+
+type relayState struct {
+	mu           sync.Mutex
+	requested    map[string]time.Time //inv key --> when it was requested, from whichever peer
+	rejects      *inventorySet        //transactions that failed validation, forgotten when a block arrives
+	orphanTxs    map[string]orphanTx
+	orphanBlocks map[string]receivedBlock
+	orphanSize   int //serialized size of the orphan blocks
+}
+
+func newRelayState() *relayState {
+	return &relayState{
+		requested:    make(map[string]time.Time),
+		rejects:      newInventorySet(maxRecentRejects),
+		orphanTxs:    make(map[string]orphanTx),
+		orphanBlocks: make(map[string]receivedBlock),
+	}
+}
+
+// Marks the item as requested unless another request for it is still pending, returns false in that case
+func (node *Node) markRequested(key string) bool {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	if sent, found := node.relay.requested[key]; found && time.Since(sent) < requestTimeout {
+		return false
+	}
+	node.relay.requested[key] = time.Now()
+	return true
+}
+
+// Forgets the request for an item that arrived, returns whether it was requested at all
+func (node *Node) takeRequested(key string) bool {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	_, found := node.relay.requested[key]
+	delete(node.relay.requested, key)
+	return found
+}
+
+// Announces an item to every peer that does not know it yet
+func (node *Node) announce(invType string, hash []byte, except *Peer) {
+	var key string = invKey(invType, hash)
+	for _, peer := range node.readyPeers() {
+		if peer == except || peer.known.has(key) {
+			continue
+		}
+		peer.known.add(key)
+		if invType == "block" {
+			err := peer.send("inv", Inv{Type: invType, Items: [][]byte{hash}})
+			if err != nil {
+				peer.conn.Close()
+			}
+			continue
+		}
+		peer.queueMu.Lock()
+		peer.txQueue = append(peer.txQueue, hash)
+		peer.queueMu.Unlock()
+	}
+}
+
+// sends the queued transaction announcements of every peer in batches
+func (node *Node) relayLoop() {
+	var ticker *time.Ticker = time.NewTicker(invTrickleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, peer := range node.readyPeers() {
+			peer.queueMu.Lock()
+			var queue [][]byte = peer.txQueue
+			peer.txQueue = nil
+			peer.queueMu.Unlock()
+
+			for len(queue) > 0 {
+				var batch [][]byte = queue
+				if len(batch) > maxInvPerMsg {
+					batch = batch[:maxInvPerMsg]
+				}
+				queue = queue[len(batch):]
+				err := peer.send("inv", Inv{Type: "tx", Items: batch})
+				if err != nil {
+					peer.conn.Close()
+					break
+				}
+			}
+		}
+		node.expireOrphanTxs()
+	}
+}
+
+// Keeps a transaction whose parents we do not have and asks the peer for them
+func (node *Node) addOrphanTx(peer *Peer, tx *Blockchain.Transaction, parents [][]byte) error {
+	if len(tx.Serialize()) > maxOrphanTxSize {
+		return nil
+	}
+	node.relay.mu.Lock()
+	if len(node.relay.orphanTxs) >= maxOrphanTxs {
+		for id := range node.relay.orphanTxs { //map order is random, so is the evicted orphan
+			delete(node.relay.orphanTxs, id)
+			break
+		}
+	}
+	node.relay.orphanTxs[hex.EncodeToString(tx.ID)] = orphanTx{tx: tx, from: peer, added: time.Now()}
+	node.relay.mu.Unlock()
+	fmt.Printf("Transaction %x from %s is an orphan, waiting for %d parent(s)\n", tx.ID, peer.Address, len(parents))
+
+	for _, parent := range parents {
+		node.mu.Lock()
+		var pooled bool = node.mempool.Has(parent)
+		node.mu.Unlock()
+		if pooled || !node.markRequested(invKey("tx", parent)) {
+			continue //the parent is known, the orphan has to wait for it to be mined
+		}
+		err := peer.send("getdata", GetData{Type: "tx", ID: parent})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *Node) expireOrphanTxs() {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	for id, orphan := range node.relay.orphanTxs {
+		if time.Since(orphan.added) > orphanTxExpiry {
+			delete(node.relay.orphanTxs, id)
+		}
+	}
+}
+
+// a transaction entered the pool: peers hear about it and the miner wakes up
+func (node *Node) txAccepted(tx *Blockchain.Transaction, from *Peer) {
+	node.announce("tx", tx.ID, from)
+	node.wakeMiner()
+}
+
+// queues the whole pool for a new peer, so transactions that arrived while nobody was connected spread too
+func (node *Node) announcePool(peer *Peer) {
+	node.mu.Lock()
+	var txs []*Blockchain.Transaction = node.mempool.Transactions()
+	node.mu.Unlock()
+	peer.queueMu.Lock()
+	defer peer.queueMu.Unlock()
+	for _, tx := range txs {
+		var key string = invKey("tx", tx.ID)
+		if !peer.known.has(key) {
+			peer.known.add(key)
+			peer.txQueue = append(peer.txQueue, tx.ID)
+		}
+	}
+}
+
+// Tries the orphan transactions again after their parents may have arrived
+func (node *Node) retryOrphanTxs() {
+	node.relay.mu.Lock()
+	var orphans []orphanTx
+	for _, orphan := range node.relay.orphanTxs {
+		orphans = append(orphans, orphan)
+	}
+	node.relay.mu.Unlock()
+
+	for _, orphan := range orphans {
+		parents, err := node.acceptTx(orphan.tx)
+		if len(parents) > 0 {
+			continue
+		}
+
+		node.relay.mu.Lock()
+		delete(node.relay.orphanTxs, hex.EncodeToString(orphan.tx.ID))
+		node.relay.mu.Unlock()
+		if err != nil {
+			node.relay.rejects.add(invKey("tx", orphan.tx.ID))
+			continue
+		}
+		fmt.Printf("Accepted orphan transaction %x\n", orphan.tx.ID)
+		node.txAccepted(orphan.tx, nil)
+	}
+}
+
+func (node *Node) isOrphan(invType string, hash []byte) bool {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	if invType == "block" {
+		return node.relay.orphanBlocks[hex.EncodeToString(hash)].block != nil
+	}
+	_, found := node.relay.orphanTxs[hex.EncodeToString(hash)]
+	return found
+}
+
+/*
+	Keeps a block whose parent we do not have, the parent is fetched by syncing with the peer that sent it.
+	Its header is checked first, so the cache only holds blocks with a valid proof of work. The cache is bounded
+	by the size of its blocks, random orphans make room, and a block too big for the whole cache is not kept.
+*/
+func (node *Node) addOrphanBlock(peer *Peer, block *Blockchain.Block) error {
+	var header Blockchain.BlockHeader = block.Header()
+	if !header.Validate() {
+		return misbehaving(scoreInvalidBlock, "orphan block %x has an invalid proof of work", block.Hash)
+	}
+	var size int = len(block.Serialize())
+	node.relay.mu.Lock()
+	if size <= maxOrphanBlockSize {
+		for key := range node.relay.orphanBlocks { //map order is random, so are the evicted orphans
+			if node.relay.orphanSize+size <= maxOrphanBlockSize {
+				break
+			}
+			node.removeOrphanBlock(key)
+		}
+		node.removeOrphanBlock(hex.EncodeToString(block.Hash))
+		node.relay.orphanBlocks[hex.EncodeToString(block.Hash)] = receivedBlock{block: block, from: peer}
+		node.relay.orphanSize += size
+	}
+	node.relay.mu.Unlock()
+
+	fmt.Printf("Block %x at height %d from %s is an orphan, fetching its parents\n", block.Hash, block.Height, peer.Address)
+	node.raisePeerHeight(peer, block.Height)
+	return node.startPeerSync(peer)
+}
+
+// drops an orphan block from the cache, the caller holds relay.mu
+func (node *Node) removeOrphanBlock(key string) {
+	var orphan receivedBlock = node.relay.orphanBlocks[key]
+	if orphan.block == nil {
+		return
+	}
+	node.relay.orphanSize -= len(orphan.block.Serialize())
+	delete(node.relay.orphanBlocks, key)
+}
+
+// Hands out an orphan block, for the sync that downloads the blocks before it
+func (node *Node) takeOrphanBlock(hash []byte) receivedBlock {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	var key string = hex.EncodeToString(hash)
+	var orphan receivedBlock = node.relay.orphanBlocks[key]
+	node.removeOrphanBlock(key)
+	return orphan
+}
+
+// the orphan blocks that build on the given block
+func (node *Node) orphanChildren(hash []byte) []receivedBlock {
+	node.relay.mu.Lock()
+	defer node.relay.mu.Unlock()
+	var children []receivedBlock
+	for key, orphan := range node.relay.orphanBlocks {
+		if hex.EncodeToString(orphan.block.PrevHash) == hex.EncodeToString(hash) {
+			children = append(children, orphan)
+			node.removeOrphanBlock(key)
+		}
+	}
+	return children
+}
+
+// a block whose parent we do not have yet, it waits with the orphans
+var errOrphanBlock error = &Blockchain.ContextError{Reason: "the parent block is unknown"}
+
+/*
+	Connects a block, or stores it on a side branch, and drops its transactions from the pool if it extends the tip
+	(a reorganisation updates the pool in reorganized). False if the block is known already.
+	The chain code still panics on some errors, the unlock is deferred so a panic recovered by the message handler
+	does not leave the node locked.
+*/
+func (node *Node) connectBlock(block *Blockchain.Block) (bool, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.chain.HasBlock(block.Hash) {
+		return false, nil
+	}
+	if len(node.chain.LastHash) == 0 && len(block.PrevHash) != 0 || len(node.chain.LastHash) != 0 && !node.chain.HasBlock(block.PrevHash) {
+		return false, errOrphanBlock
+	}
+	var extends bool = bytes.Equal(block.PrevHash, node.chain.LastHash)
+	err := node.chain.ConnectBlock(block)
+	if err != nil {
+		return false, err
+	}
+	if extends {
+		node.UTXO.UpdateMempool(node.mempool, block)
+	}
+	return true, nil
+}
+
+// whether the block is our tip, blocks on side branches are not announced
+func (node *Node) isTip(hash []byte) bool {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return bytes.Equal(node.chain.LastHash, hash)
+}
+
+// called under the chain lock when a branch with more work replaced our tip
+func (node *Node) reorganized(event Blockchain.Event) {
+	var reorg Blockchain.Reorg = event.(Blockchain.Reorg)
+	fmt.Printf("Reorganised at %x: disconnected %d block(s), connected %d\n", reorg.Fork, len(reorg.Disconnected), len(reorg.Connected))
+	node.UTXO.ReorgMempool(node.mempool, reorg)
+}
+
+// Puts a transaction into the pool, an orphan is not checked and the parents it waits for are returned instead
+func (node *Node) acceptTx(tx *Blockchain.Transaction) ([][]byte, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if len(node.chain.LastHash) == 0 {
+		return nil, &Blockchain.ContextError{Reason: "node has no chain yet"}
+	}
+	if parents := node.UTXO.MissingParents(tx); len(parents) > 0 {
+		return parents, nil
+	}
+	return nil, node.UTXO.AcceptToMempool(node.mempool, tx)
+}
+
+/*
+	Everything that follows a new block: announcing it if it is the new tip (unless we are still catching up),
+	forgetting rejected transactions since they may be valid now, and connecting orphans that were waiting for it.
+*/
+func (node *Node) blockConnected(block *Blockchain.Block, from *Peer, relay bool) {
+	node.relay.rejects.reset()
+	if relay && node.isTip(block.Hash) {
+		node.announce("block", block.Hash, from)
+	}
+	for _, orphan := range node.orphanChildren(block.Hash) {
+		var child *Blockchain.Block = orphan.block
+		added, err := node.connectBlock(child)
+		if err != nil {
+			fmt.Printf("Dropped orphan block %x: %s\n", child.Hash, err)
+			if !Blockchain.IsContextError(err) {
+				node.punish(orphan.from, scoreInvalidBlock, fmt.Sprintf("invalid block %x: %s", child.Hash, err))
+			}
+			continue
+		}
+		if !added {
+			continue
+		}
+		fmt.Printf("Added orphan block %x at height %d\n", child.Hash, child.Height)
+		node.blockConnected(child, nil, relay)
+	}
+	node.retryOrphanTxs()
+}
@@ -0,0 +1,224 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+)
+
+// a peer that finished the handshake, the test plays the remote side on the returned end of the pipe
+func testPeer(t *testing.T, node *Node) (*Peer, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	var peer *Peer = newPeer(local, "test", false)
+	peer.version = &Version{Version: protocolVersion}
+	peer.verack = true
+	node.addPeer(peer)
+	return peer, remote
+}
+
+// a node without a chain database, enough for everything that does not read the chain
+func newTestNode() *Node {
+	return NewNode("", "", &Blockchain.Blockchain{Events: Blockchain.NewEventBus()})
+}
+
+// runs fn and fails if it does not return quickly, i.e. if it blocks sending to a peer nobody reads from
+func returnsWithoutSending(t *testing.T, what string, fn func()) {
+	t.Helper()
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Errorf("%s: tried to send to the peer", what)
+	}
+}
+
+func readInv(t *testing.T, conn net.Conn, want string) [][]byte {
+	t.Helper()
+	command, payload, err := readMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if command != want {
+		t.Fatalf("got %s, want %s", command, want)
+	}
+	switch want {
+	case "inv":
+		var inv Inv
+		err = decodePayload(payload, &inv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inv.Items
+	default:
+		var getData GetData
+		err = decodePayload(payload, &getData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return [][]byte{getData.ID}
+	}
+}
+
+func TestInventorySetForgetsOldest(t *testing.T) {
+	var set *inventorySet = newInventorySet(2)
+	set.add("a")
+	set.add("b")
+	set.add("a") //already known, does not count twice
+	set.add("c")
+	if set.has("a") || !set.has("b") || !set.has("c") {
+		t.Errorf("got %v, want the oldest entry forgotten", set.items)
+	}
+	set.reset()
+	if set.has("b") {
+		t.Error("reset kept an entry")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var limiter rateLimiter
+	for i := 0; i < 3; i++ {
+		if !limiter.allow(1, 3) {
+			t.Fatalf("denied message %d of the burst", i+1)
+		}
+	}
+	if limiter.allow(1, 3) {
+		t.Error("allowed more than the burst")
+	}
+	limiter.last = limiter.last.Add(-2 * time.Second)
+	if !limiter.allow(1, 3) || !limiter.allow(1, 3) || limiter.allow(1, 3) {
+		t.Error("did not refill at the rate")
+	}
+}
+
+func TestAnnounceOncePerPeer(t *testing.T) {
+	var node *Node = newTestNode()
+	first, firstRemote := testPeer(t, node)
+	second, _ := testPeer(t, node)
+	var hash []byte = bytes.Repeat([]byte{1}, 32)
+
+	go node.announce("block", hash, second)
+	if items := readInv(t, firstRemote, "inv"); len(items) != 1 || !bytes.Equal(items[0], hash) {
+		t.Fatalf("got %x", items)
+	}
+	if second.known.has(invKey("block", hash)) {
+		t.Error("the block was announced to the peer it came from")
+	}
+	returnsWithoutSending(t, "announcing a known block", func() { node.announce("block", hash, second) })
+
+	node.announce("tx", hash, nil)
+	node.announce("tx", hash, nil)
+	for _, peer := range []*Peer{first, second} {
+		if len(peer.txQueue) != 1 || !bytes.Equal(peer.txQueue[0], hash) {
+			t.Errorf("queued %x, want the transaction once", peer.txQueue)
+		}
+	}
+}
+
+func TestInvRequestsOnce(t *testing.T) {
+	var node *Node = newTestNode()
+	first, firstRemote := testPeer(t, node)
+	second, _ := testPeer(t, node)
+	var hash []byte = bytes.Repeat([]byte{1}, 32)
+	payload, err := encodePayload(Inv{Type: "tx", Items: [][]byte{hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go node.handleInv(first, payload)
+	if items := readInv(t, firstRemote, "getdata"); !bytes.Equal(items[0], hash) {
+		t.Fatalf("requested %x", items[0])
+	}
+	returnsWithoutSending(t, "an item requested from another peer", func() { node.handleInv(second, payload) })
+	if !second.known.has(invKey("tx", hash)) {
+		t.Error("the announcement was not remembered")
+	}
+
+	var rejected []byte = bytes.Repeat([]byte{2}, 32)
+	node.relay.rejects.add(invKey("tx", rejected))
+	payload, err = encodePayload(Inv{Type: "tx", Items: [][]byte{rejected}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnsWithoutSending(t, "a rejected transaction", func() { node.handleInv(first, payload) })
+
+	second.txLimiter = rateLimiter{tokens: 0, last: time.Now()}
+	payload, err = encodePayload(Inv{Type: "tx", Items: [][]byte{bytes.Repeat([]byte{3}, 32)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnsWithoutSending(t, "an announcement beyond the rate", func() { node.handleInv(second, payload) })
+}
+
+func testTransaction(seed byte) *Blockchain.Transaction {
+	return &Blockchain.Transaction{ID: bytes.Repeat([]byte{seed}, 32), Outputs: []Blockchain.TxOutput{{Value: 1}}}
+}
+
+func TestOrphanTxPoolIsBounded(t *testing.T) {
+	var node *Node = newTestNode()
+	var peer *Peer = newPeer(nil, "test", false)
+	for i := 0; i <= maxOrphanTxs; i++ {
+		err := node.addOrphanTx(peer, testTransaction(byte(i)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(node.relay.orphanTxs) != maxOrphanTxs {
+		t.Errorf("kept %d orphans", len(node.relay.orphanTxs))
+	}
+
+	var large *Blockchain.Transaction = testTransaction(0xff)
+	large.Outputs[0].Script = make([]byte, maxOrphanTxSize)
+	err := node.addOrphanTx(peer, large, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.isOrphan("tx", large.ID) {
+		t.Error("kept an orphan above the size limit")
+	}
+
+	for id, orphan := range node.relay.orphanTxs {
+		orphan.added = time.Now().Add(-orphanTxExpiry - time.Second)
+		node.relay.orphanTxs[id] = orphan
+		break
+	}
+	node.expireOrphanTxs()
+	if len(node.relay.orphanTxs) != maxOrphanTxs-1 {
+		t.Errorf("kept %d orphans, want the expired one dropped", len(node.relay.orphanTxs))
+	}
+}
+
+func TestOrphanBlockChildren(t *testing.T) {
+	var node *Node = newTestNode()
+	var parent []byte = bytes.Repeat([]byte{1}, 32)
+	var blocks []*Blockchain.Block = []*Blockchain.Block{
+		{Hash: bytes.Repeat([]byte{2}, 32), PrevHash: parent},
+		{Hash: bytes.Repeat([]byte{3}, 32), PrevHash: parent},
+		{Hash: bytes.Repeat([]byte{4}, 32), PrevHash: bytes.Repeat([]byte{2}, 32)},
+	}
+	for _, block := range blocks {
+		node.relay.orphanBlocks[hex.EncodeToString(block.Hash)] = receivedBlock{block: block}
+	}
+
+	if children := node.orphanChildren(parent); len(children) != 2 {
+		t.Errorf("got %d children", len(children))
+	}
+	if !node.isOrphan("block", blocks[2].Hash) || node.isOrphan("block", blocks[0].Hash) {
+		t.Error("the children were not taken out, or the grandchild was")
+	}
+	if node.takeOrphanBlock(blocks[2].Hash).block != blocks[2] || node.takeOrphanBlock(blocks[2].Hash).block != nil {
+		t.Error("an orphan block was not handed out exactly once")
+	}
+}
@@ -0,0 +1,267 @@
+package Network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+/*
+	Read-only REST API for explorers and dashboards, it needs no credentials since it cannot change anything.
+	GET /chain/tip                   the newest block
+	GET /blocks?offset=&limit=       block summaries, newest first, offset counts blocks below the tip
+	GET /blocks/{hash}               a block, its transactions are paged with offset and limit
+	GET /blocks/height/{n}           the same by height
+	GET /tx/{id}                     a transaction from the pool or the chain
+	GET /address/{addr}/utxos        unspent outputs of an address, paged
+	GET /address/{addr}/balance      spendable and immature balance
+	GET /events                      server-sent events, see subscribe.go
+	Errors are {"error": "..."} with a 4xx status.
+*/
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type PageJSON struct {
+	Items  interface{} `json:"items"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Total  int         `json:"total"`
+}
+
+type BlockSummaryJSON struct {
+	Hash      string `json:"hash"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	TxCount   int    `json:"txcount"`
+}
+
+type TipJSON struct {
+	Hash      string `json:"hash"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Mempool   int    `json:"mempool"` //transactions waiting for a block
+}
+
+type restError struct {
+	Error string `json:"error"`
+}
+
+// Serves the REST API on the address until the listener fails or the node shuts down
+func (node *Node) ServeREST(address string) error {
+	var mux *http.ServeMux = http.NewServeMux()
+	mux.HandleFunc("GET /chain/tip", node.restTip)
+	mux.HandleFunc("GET /blocks", node.restBlocks)
+	mux.HandleFunc("GET /blocks/{hash}", node.restBlock)
+	mux.HandleFunc("GET /blocks/height/{n}", node.restBlock)
+	mux.HandleFunc("GET /tx/{id}", node.restTransaction)
+	mux.HandleFunc("GET /address/{addr}/utxos", node.restUTXOs)
+	mux.HandleFunc("GET /address/{addr}/balance", node.restBalance)
+	mux.HandleFunc("GET /events", node.restEvents)
+	var server *http.Server = &http.Server{
+		Addr:         address,
+		Handler:      mux,
+		ReadTimeout:  rpcTimeout,
+		WriteTimeout: rpcTimeout,
+	}
+	node.trackServer(server)
+	fmt.Printf("REST server listening on %s\n", address)
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil //the node shut down
+	}
+	return err
+}
+
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Access-Control-Allow-Origin", "*") //read-only data, any page may show it
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
+
+func writeError(writer http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(writer, status, restError{Error: fmt.Sprintf(format, args...)})
+}
+
+// reads offset and limit from the query, false after answering a bad request
+func pageParams(writer http.ResponseWriter, request *http.Request, defaultLimit int) (int, int, bool) {
+	var offset, limit int = 0, defaultLimit
+	var err error
+	if value := request.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			writeError(writer, http.StatusBadRequest, "offset must be a non-negative number")
+			return 0, 0, false
+		}
+	}
+	if value := request.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			writeError(writer, http.StatusBadRequest, "limit must be between 1 and %d", maxPageSize)
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+// the part of a slice of length total a page covers
+func pageBounds(offset, limit, total int) (int, int) {
+	if offset > total {
+		offset = total
+	}
+	var end int = offset + limit
+	if end > total {
+		end = total
+	}
+	return offset, end
+}
+
+func (node *Node) restTip(writer http.ResponseWriter, request *http.Request) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if len(node.chain.LastHash) == 0 {
+		writeError(writer, http.StatusNotFound, "node has no chain yet")
+		return
+	}
+	block, err := node.chain.GetBlock(node.chain.LastHash)
+	if err != nil {
+		writeError(writer, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeJSON(writer, http.StatusOK, TipJSON{
+		Hash:      hex.EncodeToString(block.Hash),
+		Height:    block.Height,
+		Timestamp: block.Timestamp,
+		Mempool:   node.mempool.Count(),
+	})
+}
+
+func (node *Node) restBlocks(writer http.ResponseWriter, request *http.Request) {
+	offset, limit, ok := pageParams(writer, request, defaultPageSize)
+	if !ok {
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	var page PageJSON = PageJSON{Offset: offset, Limit: limit, Total: node.chain.GetBestHeight() + 1}
+	var blocks []BlockSummaryJSON = []BlockSummaryJSON{}
+	if offset < page.Total {
+		var iter *Blockchain.BlockchainIterator = node.chain.Iterator()
+		for skipped := 0; len(blocks) < limit; skipped++ {
+			var block *Blockchain.Block = iter.Next()
+			if skipped >= offset {
+				blocks = append(blocks, BlockSummaryJSON{
+					Hash:      hex.EncodeToString(block.Hash),
+					Height:    block.Height,
+					Timestamp: block.Timestamp,
+					TxCount:   len(block.Transactions),
+				})
+			}
+			if len(block.PrevHash) == 0 {
+				break //reached the genesis block
+			}
+		}
+	}
+	page.Items = blocks
+	writeJSON(writer, http.StatusOK, page)
+}
+
+// serves /blocks/{hash} and /blocks/height/{n}
+func (node *Node) restBlock(writer http.ResponseWriter, request *http.Request) {
+	offset, limit, ok := pageParams(writer, request, maxPageSize)
+	if !ok {
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	var block Blockchain.Block
+	if value := request.PathValue("n"); value != "" {
+		height, err := strconv.Atoi(value)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, "height must be a number")
+			return
+		}
+		block, err = node.chain.GetBlockByHeight(height)
+		if err != nil {
+			writeError(writer, http.StatusNotFound, "%s", err)
+			return
+		}
+	} else {
+		hash, err := hex.DecodeString(request.PathValue("hash"))
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, "hash is not hex")
+			return
+		}
+		block, err = node.chain.GetBlock(hash)
+		if err != nil {
+			writeError(writer, http.StatusNotFound, "no block %s", request.PathValue("hash"))
+			return
+		}
+	}
+	start, end := pageBounds(offset, limit, len(block.Transactions))
+	var view BlockJSON = NewBlockJSON(&block, node.chain.GetBestHeight())
+	view.Transactions = view.Transactions[start:end]
+	writeJSON(writer, http.StatusOK, PageJSON{Items: view, Offset: offset, Limit: limit, Total: len(block.Transactions)})
+}
+
+func (node *Node) restTransaction(writer http.ResponseWriter, request *http.Request) {
+	txID, err := hex.DecodeString(request.PathValue("id"))
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "transaction id is not hex")
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	tx, found := node.findTransaction(txID)
+	if !found {
+		writeError(writer, http.StatusNotFound, "no transaction %s", request.PathValue("id"))
+		return
+	}
+	writeJSON(writer, http.StatusOK, tx)
+}
+
+// the address of /address/{addr}/..., false after answering a bad request
+func addressParam(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	var address string = request.PathValue("addr")
+	if !Wallet.ValidateAddress(address) {
+		writeError(writer, http.StatusBadRequest, "address %s is not valid", address)
+		return "", false
+	}
+	return address, true
+}
+
+func (node *Node) restUTXOs(writer http.ResponseWriter, request *http.Request) {
+	address, ok := addressParam(writer, request)
+	if !ok {
+		return
+	}
+	offset, limit, ok := pageParams(writer, request, defaultPageSize)
+	if !ok {
+		return
+	}
+	node.mu.Lock()
+	var utxos []UTXOJSON = AddressUTXOs(node.UTXO, address)
+	node.mu.Unlock()
+	start, end := pageBounds(offset, limit, len(utxos))
+	writeJSON(writer, http.StatusOK, PageJSON{Items: utxos[start:end], Offset: offset, Limit: limit, Total: len(utxos)})
+}
+
+func (node *Node) restBalance(writer http.ResponseWriter, request *http.Request) {
+	address, ok := addressParam(writer, request)
+	if !ok {
+		return
+	}
+	node.mu.Lock()
+	var balance BalanceJSON = AddressBalance(node.UTXO, address)
+	node.mu.Unlock()
+	writeJSON(writer, http.StatusOK, balance)
+}
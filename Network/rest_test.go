@@ -0,0 +1,153 @@
+package Network
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+	"github.com/pred695/golang-blockchain/Params"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// a node on a regtest chain of three blocks in a temporary directory, every block pays the returned address
+func newTestChainNode(t *testing.T) (*Node, string) {
+	t.Helper()
+	var active *Params.ChainParams = Params.Active
+	var regtest Params.ChainParams = Params.Regtest
+	Params.Active = &regtest
+	t.Cleanup(func() { Params.Active = active })
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir()) //the chain lives in ./temp
+	if err == nil {
+		err = os.Mkdir("temp", 0755)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	var address string = string(Wallet.MakeWallet().CreateAddress())
+	var chain *Blockchain.Blockchain = Blockchain.InitBlockChain(address)
+	t.Cleanup(func() { chain.Database.Close() })
+	chain.AddBlock([]*Blockchain.Transaction{Blockchain.CoinbaseTx(address, "", chain.GetBestHeight()+1)})
+	chain.AddBlock([]*Blockchain.Transaction{Blockchain.CoinbaseTx(address, "", chain.GetBestHeight()+1)})
+	var node *Node = NewNode("", "", chain)
+	node.UTXO.Reindex()
+	return node, address
+}
+
+func restGet(t *testing.T, handler http.HandlerFunc, path string, pathValues map[string]string, status int, into interface{}) {
+	t.Helper()
+	var request *http.Request = httptest.NewRequest(http.MethodGet, path, nil)
+	for name, value := range pathValues {
+		request.SetPathValue(name, value)
+	}
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != status {
+		t.Fatalf("GET %s: got %d, want %d: %s", path, recorder.Code, status, recorder.Body)
+	}
+	if into != nil {
+		err := json.Unmarshal(recorder.Body.Bytes(), into)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	var tests = []struct {
+		query         string
+		ok            bool
+		offset, limit int
+	}{
+		{"", true, 0, defaultPageSize},
+		{"offset=5&limit=10", true, 5, 10},
+		{"limit=100", true, 0, maxPageSize},
+		{"offset=-1", false, 0, 0},
+		{"offset=x", false, 0, 0},
+		{"limit=0", false, 0, 0},
+		{"limit=101", false, 0, 0},
+	}
+	for _, test := range tests {
+		var request *http.Request = httptest.NewRequest(http.MethodGet, "/blocks?"+test.query, nil)
+		var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+		offset, limit, ok := pageParams(recorder, request, defaultPageSize)
+		if ok != test.ok || offset != test.offset || limit != test.limit {
+			t.Errorf("%q: got %d %d %v", test.query, offset, limit, ok)
+		}
+		if !ok && recorder.Code != http.StatusBadRequest {
+			t.Errorf("%q: answered %d", test.query, recorder.Code)
+		}
+	}
+}
+
+func TestPageBounds(t *testing.T) {
+	var tests = []struct{ offset, limit, total, start, end int }{
+		{0, 20, 5, 0, 5},
+		{2, 2, 5, 2, 4},
+		{4, 20, 5, 4, 5},
+		{5, 20, 5, 5, 5},
+		{9, 20, 5, 5, 5},
+	}
+	for _, test := range tests {
+		start, end := pageBounds(test.offset, test.limit, test.total)
+		if start != test.start || end != test.end {
+			t.Errorf("%d+%d of %d: got [%d:%d]", test.offset, test.limit, test.total, start, end)
+		}
+	}
+}
+
+func TestRESTAddressValidation(t *testing.T) {
+	var node *Node = newTestNode()
+	var body restError
+	for _, handler := range []http.HandlerFunc{node.restUTXOs, node.restBalance} {
+		restGet(t, handler, "/address/x", map[string]string{"addr": "notanaddress"}, http.StatusBadRequest, &body)
+		if body.Error == "" {
+			t.Error("no error message")
+		}
+	}
+}
+
+func TestRESTPagination(t *testing.T) {
+	node, address := newTestChainNode(t)
+
+	var page struct {
+		Items []BlockSummaryJSON
+		Total int
+	}
+	restGet(t, node.restBlocks, "/blocks?offset=1&limit=1", nil, http.StatusOK, &page)
+	if page.Total != 3 || len(page.Items) != 1 || page.Items[0].Height != 1 {
+		t.Errorf("got %+v, want the block below the tip", page)
+	}
+	restGet(t, node.restBlocks, "/blocks?offset=1", nil, http.StatusOK, &page)
+	if len(page.Items) != 2 || page.Items[1].Height != 0 {
+		t.Errorf("got %+v, want the rest down to the genesis block", page)
+	}
+	restGet(t, node.restBlocks, "/blocks?offset=3", nil, http.StatusOK, &page)
+	if len(page.Items) != 0 {
+		t.Errorf("got %+v past the genesis block", page)
+	}
+
+	var utxos struct {
+		Items  []UTXOJSON
+		Offset int
+		Total  int
+	}
+	var path string = "/address/" + url.PathEscape(address) + "/utxos"
+	restGet(t, node.restUTXOs, path+"?offset=2&limit=2", map[string]string{"addr": address}, http.StatusOK, &utxos)
+	if utxos.Total != 3 || utxos.Offset != 2 || len(utxos.Items) != 1 {
+		t.Errorf("got %+v, want the last of three outputs", utxos)
+	}
+	restGet(t, node.restUTXOs, path+"?limit=101", map[string]string{"addr": address}, http.StatusBadRequest, nil)
+
+	restGet(t, node.restBlock, "/blocks/height/9", map[string]string{"n": "9"}, http.StatusNotFound, nil)
+	restGet(t, node.restBlock, "/blocks/zz", map[string]string{"hash": "zz"}, http.StatusBadRequest, nil)
+}
@@ -0,0 +1,136 @@
+package Network
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func rpcPost(handler http.Handler, body string, setup func(*http.Request)) *httptest.ResponseRecorder {
+	var request *http.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if setup != nil {
+		setup(request)
+	}
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRPCAuth(t *testing.T) {
+	var node *Node = newTestNode()
+	var tests = []struct {
+		name   string
+		auth   RPCAuth
+		setup  func(*http.Request)
+		status int
+	}{
+		{"no credentials", RPCAuth{User: "user", Password: "secret"}, nil, http.StatusUnauthorized},
+		{"basic auth", RPCAuth{User: "user", Password: "secret"}, func(r *http.Request) { r.SetBasicAuth("user", "secret") }, http.StatusOK},
+		{"wrong password", RPCAuth{User: "user", Password: "secret"}, func(r *http.Request) { r.SetBasicAuth("user", "guess") }, http.StatusUnauthorized},
+		{"wrong user", RPCAuth{User: "user", Password: "secret"}, func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusUnauthorized},
+		{"token", RPCAuth{Token: "cookie"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer cookie") }, http.StatusOK},
+		{"wrong token", RPCAuth{Token: "cookie"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer biscuit") }, http.StatusUnauthorized},
+		{"empty basic auth on a token node", RPCAuth{Token: "cookie"}, func(r *http.Request) { r.SetBasicAuth("", "") }, http.StatusUnauthorized},
+		{"empty token on a password node", RPCAuth{User: "user", Password: "secret"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		var recorder *httptest.ResponseRecorder = rpcPost(node.rpcHandler(test.auth), `{"jsonrpc": "2.0", "id": 1, "method": "nosuchmethod"}`, test.setup)
+		if recorder.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if test.status == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no challenge", test.name)
+		}
+	}
+
+	var request *http.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Authorization", "Bearer cookie")
+	var recorder *httptest.ResponseRecorder = httptest.NewRecorder()
+	node.rpcHandler(RPCAuth{Token: "cookie"}).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got %d", recorder.Code)
+	}
+
+	if node.ServeRPC("127.0.0.1:0", RPCAuth{User: "user"}) == nil {
+		t.Error("served RPC without a password")
+	}
+}
+
+func TestHandleRPCErrors(t *testing.T) {
+	var node *Node = newTestNode()
+	var tests = []struct {
+		name string
+		body string
+		code int
+	}{
+		{"not json", `{"jsonrpc"`, rpcParseError},
+		{"not 2.0", `{"jsonrpc": "1.0", "id": 1, "method": "getbalance"}`, rpcInvalidRequest},
+		{"unknown method", `{"jsonrpc": "2.0", "id": 1, "method": "nosuchmethod"}`, rpcMethodNotFound},
+		{"unknown param", `{"jsonrpc": "2.0", "id": 1, "method": "getbalance", "params": {"addr": "x"}}`, rpcInvalidParams},
+		{"missing address", `{"jsonrpc": "2.0", "id": 1, "method": "getbalance", "params": {}}`, rpcInvalidParams},
+		{"invalid address", `{"jsonrpc": "2.0", "id": 1, "method": "getbalance", "params": {"address": "x"}}`, rpcServerError},
+		{"negative amount", `{"jsonrpc": "2.0", "id": 1, "method": "send", "params": {"amount": -1}}`, rpcInvalidParams},
+	}
+	for _, test := range tests {
+		var response rpcResponse = node.handleRPC([]byte(test.body))
+		if response.Error == nil || response.Error.Code != test.code {
+			t.Errorf("%s: got %v, want code %d", test.name, response.Error, test.code)
+		}
+	}
+}
+
+func TestCallRPC(t *testing.T) {
+	rpcMethods["echo"] = func(node *Node, params json.RawMessage) (interface{}, error) {
+		var p GetBalanceParams
+		err := decodeParams(params, &p)
+		return p, err
+	}
+	defer delete(rpcMethods, "echo")
+	var server *httptest.Server = httptest.NewServer(newTestNode().rpcHandler(RPCAuth{Token: "cookie"}))
+	defer server.Close()
+
+	var result GetBalanceParams
+	err := CallRPC(server.URL, "cookie", "echo", GetBalanceParams{Address: "x"}, &result)
+	if err != nil || result.Address != "x" {
+		t.Fatalf("got %v, %v", result, err)
+	}
+	var rpcErr *RPCError
+	err = CallRPC(server.URL, "cookie", "nosuchmethod", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpcMethodNotFound {
+		t.Errorf("got %v, want the node's error", err)
+	}
+	if CallRPC(server.URL, "biscuit", "echo", nil, nil) == nil {
+		t.Error("a wrong token was accepted")
+	}
+}
+
+func TestRPCCookie(t *testing.T) {
+	var saved string = rpcCookieFile
+	rpcCookieFile = filepath.Join(t.TempDir(), "rpc.cookie")
+	defer func() { rpcCookieFile = saved }()
+
+	token, err := WriteRPCCookie()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(rpcCookieFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("cookie file mode %v, want 0600", info.Mode().Perm())
+	}
+	read, err := ReadRPCCookie()
+	if err != nil || read != token || len(token) != 64 {
+		t.Errorf("read %q, wrote %q: %v", read, token, err)
+	}
+	second, _ := WriteRPCCookie()
+	if second == token {
+		t.Error("the token did not change")
+	}
+}
@@ -0,0 +1,335 @@
+package Network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+/*
+	Pushes chain activity to clients as server-sent events, served by the REST server on
+	GET /events?topics=blocks,reorgs,txs,addresses&address=ADDRESS[,ADDRESS]
+	blocks:    every new tip, a BlockSummaryJSON
+	reorgs:    a branch with more work replaced the tip, a ReorgJSON, sent after the blocks events of the blocks
+	           it connected. Transactions of the disconnected blocks that are still valid come back as txs events.
+	txs:       every transaction accepted into the pool, a TxJSON
+	addresses: transactions paying to or spending from a watched address, once when they enter the pool and once
+	           when they are confirmed, an AddressEventJSON
+	Without topics a client gets blocks, reorgs and txs, plus addresses if it watches any.
+	A client that does not keep up is dropped rather than slowing the node down, it reconnects and asks the REST
+	API for what it missed.
+*/
+
+const (
+	subscriberBuffer  = 256
+	maxWatchedAddrs   = 1000
+	keepaliveInterval = 15 * time.Second
+)
+
+var eventTopics map[string]bool = map[string]bool{"blocks": true, "reorgs": true, "txs": true, "addresses": true}
+
+type ReorgJSON struct {
+	Fork         string             `json:"fork"`         //hash of the last block both branches share
+	Disconnected []BlockSummaryJSON `json:"disconnected"` //newest first
+	Connected    []BlockSummaryJSON `json:"connected"`    //oldest first
+}
+
+type AddressEventJSON struct {
+	Address       string `json:"address"`
+	TxID          string `json:"txid"`
+	Received      int    `json:"received"` //value of the outputs paying to the address
+	Spends        int    `json:"spends"`   //inputs spending outputs of the address
+	Confirmations int    `json:"confirmations"`
+	BlockHash     string `json:"blockhash,omitempty"`
+	Height        *int   `json:"height,omitempty"`
+}
+
+type event struct {
+	topic   string
+	address string //for address events, the watched address
+	data    []byte //JSON
+}
+
+type subscriber struct {
+	topics    map[string]bool
+	addresses map[string]bool
+	events    chan event
+}
+
+func (sub *subscriber) wants(e event) bool {
+	if !sub.topics[e.topic] {
+		return false
+	}
+	return e.topic != "addresses" || sub.addresses[e.address]
+}
+
+type subscriptions struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]bool
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subscribers: make(map[*subscriber]bool)}
+}
+
+func (subs *subscriptions) add(sub *subscriber) {
+	subs.mu.Lock()
+	subs.subscribers[sub] = true
+	subs.mu.Unlock()
+}
+
+func (subs *subscriptions) remove(sub *subscriber) {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	if subs.subscribers[sub] {
+		delete(subs.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// whether anyone listens for the topic, saves building events nobody reads
+func (subs *subscriptions) watched(topic string) bool {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	for sub := range subs.subscribers {
+		if sub.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// the watched addresses among the given ones
+func (subs *subscriptions) watchedAddresses(addresses map[string]bool) map[string]bool {
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	var watched map[string]bool = make(map[string]bool)
+	for sub := range subs.subscribers {
+		if !sub.topics["addresses"] {
+			continue
+		}
+		for address := range addresses {
+			if sub.addresses[address] {
+				watched[address] = true
+			}
+		}
+	}
+	return watched
+}
+
+func (subs *subscriptions) publish(topic string, address string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Printf("Cannot encode a %s event: %s\n", topic, err)
+		return
+	}
+	var e event = event{topic: topic, address: address, data: data}
+	subs.mu.Lock()
+	defer subs.mu.Unlock()
+	for sub := range subs.subscribers {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default: //too slow, the closed stream tells the client to catch up
+			delete(subs.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// the addresses a transaction pays to and the inputs it spends from each of them
+func txAddresses(tx *Blockchain.Transaction) (map[string]int, map[string]int) {
+	var received, spends map[string]int = make(map[string]int), make(map[string]int)
+	for _, output := range tx.Outputs {
+		if address := ScriptAddress(output.Script); address != "" {
+			received[address] += output.Value
+		}
+	}
+	if !tx.Is_Coinbase() {
+		for _, input := range tx.Inputs {
+			if address := InputAddress(input.Script); address != "" {
+				spends[address]++
+			}
+		}
+	}
+	return received, spends
+}
+
+// sends address events for a transaction, block is nil while it is in the pool
+func (subs *subscriptions) publishAddressActivity(tx *Blockchain.Transaction, block *Blockchain.Block) {
+	received, spends := txAddresses(tx)
+	var involved map[string]bool = make(map[string]bool)
+	for address := range received {
+		involved[address] = true
+	}
+	for address := range spends {
+		involved[address] = true
+	}
+	for address := range subs.watchedAddresses(involved) {
+		var activity AddressEventJSON = AddressEventJSON{
+			Address:  address,
+			TxID:     hex.EncodeToString(tx.ID),
+			Received: received[address],
+			Spends:   spends[address],
+		}
+		if block != nil {
+			var height int = block.Height
+			activity.Confirmations = 1
+			activity.BlockHash = hex.EncodeToString(block.Hash)
+			activity.Height = &height
+		}
+		subs.publish("addresses", address, activity)
+	}
+}
+
+// feeds the streams from the chain's event bus
+func (subs *subscriptions) handle(event Blockchain.Event) {
+	switch event := event.(type) {
+	case Blockchain.BlockConnected:
+		subs.blockConnected(event.Block)
+	case Blockchain.Reorg:
+		subs.reorganized(event)
+	case Blockchain.TxAccepted:
+		subs.txAccepted(event.Tx)
+	}
+}
+
+func blockSummary(block *Blockchain.Block) BlockSummaryJSON {
+	return BlockSummaryJSON{
+		Hash:      hex.EncodeToString(block.Hash),
+		Height:    block.Height,
+		Timestamp: block.Timestamp,
+		TxCount:   len(block.Transactions),
+	}
+}
+
+func (subs *subscriptions) blockConnected(block *Blockchain.Block) {
+	if subs.watched("blocks") {
+		subs.publish("blocks", "", blockSummary(block))
+	}
+	if subs.watched("addresses") {
+		for _, tx := range block.Transactions {
+			subs.publishAddressActivity(tx, block)
+		}
+	}
+}
+
+func (subs *subscriptions) reorganized(reorg Blockchain.Reorg) {
+	if !subs.watched("reorgs") {
+		return
+	}
+	var summary ReorgJSON = ReorgJSON{Fork: hex.EncodeToString(reorg.Fork)}
+	for _, block := range reorg.Disconnected {
+		summary.Disconnected = append(summary.Disconnected, blockSummary(block))
+	}
+	for _, block := range reorg.Connected {
+		summary.Connected = append(summary.Connected, blockSummary(block))
+	}
+	subs.publish("reorgs", "", summary)
+}
+
+func (subs *subscriptions) txAccepted(tx *Blockchain.Transaction) {
+	if subs.watched("txs") {
+		subs.publish("txs", "", NewTxJSON(tx))
+	}
+	if subs.watched("addresses") {
+		subs.publishAddressActivity(tx, nil)
+	}
+}
+
+// splits comma separated and repeated query values
+func queryList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// serves GET /events
+func (node *Node) restEvents(writer http.ResponseWriter, request *http.Request) {
+	var sub *subscriber = &subscriber{
+		topics:    make(map[string]bool),
+		addresses: make(map[string]bool),
+		events:    make(chan event, subscriberBuffer),
+	}
+	for _, address := range queryList(request.URL.Query()["address"]) {
+		if !Wallet.ValidateAddress(address) {
+			writeError(writer, http.StatusBadRequest, "address %s is not valid", address)
+			return
+		}
+		sub.addresses[address] = true
+	}
+	if len(sub.addresses) > maxWatchedAddrs {
+		writeError(writer, http.StatusBadRequest, "at most %d addresses can be watched", maxWatchedAddrs)
+		return
+	}
+	var topics []string = queryList(request.URL.Query()["topics"])
+	if len(topics) == 0 {
+		topics = []string{"blocks", "reorgs", "txs"}
+		if len(sub.addresses) > 0 {
+			topics = append(topics, "addresses")
+		}
+	}
+	for _, topic := range topics {
+		if !eventTopics[topic] {
+			writeError(writer, http.StatusBadRequest, "unknown topic %s", topic)
+			return
+		}
+		sub.topics[topic] = true
+	}
+	if sub.topics["addresses"] && len(sub.addresses) == 0 {
+		writeError(writer, http.StatusBadRequest, "the addresses topic needs at least one address")
+		return
+	}
+
+	var controller *http.ResponseController = http.NewResponseController(writer)
+	controller.SetWriteDeadline(time.Time{}) //the stream outlives the server's write timeout
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	writer.WriteHeader(http.StatusOK)
+	err := controller.Flush()
+	if err != nil {
+		return
+	}
+
+	node.subscriptions.add(sub)
+	defer node.subscriptions.remove(sub)
+	var keepalive *time.Ticker = time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, open := <-sub.events:
+			if !open {
+				return //dropped for being too slow
+			}
+			_, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", e.topic, e.data)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(writer, ": keepalive\n\n") //keeps proxies from closing an idle stream
+		case <-request.Context().Done():
+			return
+		case <-node.quit:
+			return
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
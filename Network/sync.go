@@ -0,0 +1,428 @@
+package Network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+)
+
+/*
+	Header first synchronization: a node that is behind first downloads the headers from one peer, which is cheap
+	and lets it check the proof of work of the whole chain before fetching anything big. The block bodies are then
+	requested from every peer that has them, a few at a time per peer, and connected strictly in header order.
+*/
+
+const (
+	maxHeadersPerMsg         = 2000
+	maxBlocksInFlightPerPeer = 16
+	blockRequestTimeout      = 20 * time.Second
+	syncCheckInterval        = 5 * time.Second
+)
+
+type GetHeaders struct {
+	Locator [][]byte //hashes from our tip backwards, the peer answers with the headers after the first one it knows
+}
+
+type Headers struct {
+	Headers []Blockchain.BlockHeader //oldest first
+}
+
+type blockRequest struct {
+	peer *Peer
+	sent time.Time
+}
+
+// a block and the peer that sent it, which is held responsible if the block turns out invalid
+type receivedBlock struct {
+	block *Blockchain.Block
+	from  *Peer
+}
+
+type syncState struct {
+	mu          sync.Mutex
+	headerPeer  *Peer                    //peer the headers are downloaded from, nil when no headers are expected
+	headersSent time.Time                //when the headers were last requested from headerPeer
+	fullLocator bool                     //whether that request carried the full locator of our chain
+	headers     []Blockchain.BlockHeader //validated headers after our tip whose blocks are not connected yet
+	inFlight    map[string]blockRequest  //hex block hash --> outstanding getdata
+	downloaded  map[string]receivedBlock //blocks waiting for their predecessors
+}
+
+func newSyncState() *syncState {
+	return &syncState{inFlight: make(map[string]blockRequest), downloaded: make(map[string]receivedBlock)}
+}
+
+func (state *syncState) queued(hash []byte) bool {
+	for _, header := range state.headers {
+		if bytes.Equal(header.Hash, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hashes of our chain, the last ten blocks and then exponentially further apart down to the genesis block,
+// so a peer finds where our chains meet even if we are far behind
+func (node *Node) blockLocator() [][]byte {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	var locator [][]byte
+	if len(node.chain.LastHash) == 0 {
+		return locator
+	}
+	var headers []Blockchain.BlockHeader = node.chain.GetHeaders(0)
+	var step int = 1
+	for height := len(headers) - 1; height >= 0; height -= step {
+		locator = append(locator, headers[height].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if !bytes.Equal(locator[len(locator)-1], headers[0].Hash) {
+		locator = append(locator, headers[0].Hash)
+	}
+	return locator
+}
+
+// the last header we know of, queued for download or connected, the caller holds node.sync.mu
+func (node *Node) bestHeader() (Blockchain.BlockHeader, bool) {
+	if len(node.sync.headers) > 0 {
+		return node.sync.headers[len(node.sync.headers)-1], true
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if len(node.chain.LastHash) == 0 {
+		return Blockchain.BlockHeader{}, false
+	}
+	block, err := node.chain.GetBlock(node.chain.LastHash)
+	Blockchain.Handle(err)
+	return block.Header(), true
+}
+
+// asks the peer for the headers after our best header, unless headers are already being downloaded
+func (node *Node) startSync(peer *Peer) error {
+	node.sync.mu.Lock()
+	if node.sync.headerPeer != nil {
+		node.sync.mu.Unlock()
+		return nil
+	}
+	node.sync.headerPeer = peer
+	node.sync.headersSent = time.Now()
+	var locator [][]byte
+	if best, found := node.bestHeader(); found && len(node.sync.headers) > 0 {
+		locator = [][]byte{best.Hash}
+		node.sync.fullLocator = false
+	} else {
+		locator = node.blockLocator()
+		node.sync.fullLocator = true
+	}
+	node.sync.mu.Unlock()
+
+	fmt.Printf("Syncing headers from %s (height %d)\n", peer.Address, node.peerHeight(peer))
+	return peer.send("getheaders", GetHeaders{Locator: locator})
+}
+
+func (node *Node) handleGetHeaders(peer *Peer, payload []byte) error {
+	var getHeaders GetHeaders
+	err := decodePayload(payload, &getHeaders)
+	if err != nil {
+		return err
+	}
+	var fromHeight int = 0
+	node.mu.Lock()
+	for _, hash := range getHeaders.Locator {
+		if !node.chain.IsMainChain(hash) {
+			continue //unknown or on a side branch, our headers continue from where the two chains meet
+		}
+		block, err := node.chain.GetBlock(hash)
+		Blockchain.Handle(err)
+		fromHeight = block.Height + 1
+		break
+	}
+	var headers []Blockchain.BlockHeader
+	if len(node.chain.LastHash) != 0 {
+		headers = node.chain.GetHeaders(fromHeight)
+	}
+	node.mu.Unlock()
+
+	if len(headers) > maxHeadersPerMsg {
+		headers = headers[:maxHeadersPerMsg]
+	}
+	return peer.send("headers", Headers{Headers: headers})
+}
+
+// the header of a block we have, on the chain or on a side branch
+func (node *Node) knownHeader(hash []byte) (Blockchain.BlockHeader, bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	block, err := node.chain.GetBlock(hash)
+	if err != nil {
+		return Blockchain.BlockHeader{}, false
+	}
+	return block.Header(), true
+}
+
+/*
+	Checks that the headers continue our best header and queues them for download. The first headers of a sync may
+	also branch off below our tip, from a block both chains share, the branch replaces our tip once its blocks
+	are connected if it has more work. Headers of blocks we have already (on a side branch) are skipped.
+	Only headers that are invalid by themselves are held against the peer: a bad proof of work, or headers of
+	one message that do not follow each other. A first header that does not connect is no proof of anything,
+	see headersUnconnected.
+*/
+func (node *Node) handleHeaders(peer *Peer, payload []byte) error {
+	var msg Headers
+	err := decodePayload(payload, &msg)
+	if err != nil {
+		return err
+	}
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+	if node.sync.headerPeer != peer {
+		return nil //not asked for, e.g. the answer to a request that timed out
+	}
+
+	best, found := node.bestHeader()
+	for idx, header := range msg.Headers {
+		var follows bool = found && header.Height == best.Height+1 && bytes.Equal(header.PrevHash, best.Hash)
+		if idx > 0 && !follows {
+			node.sync.headerPeer = nil
+			return misbehaving(scoreInvalidHeader, "header %x does not follow the header before it", header.Hash)
+		}
+		if idx == 0 && !follows {
+			var connects bool = false
+			if !found {
+				connects = header.Height == 0 && len(header.PrevHash) == 0
+			} else if len(node.sync.headers) == 0 {
+				if parent, known := node.knownHeader(header.PrevHash); known {
+					if header.Height != parent.Height+1 {
+						node.sync.headerPeer = nil
+						return misbehaving(scoreInvalidHeader, "header %x does not follow its parent's height %d", header.Hash, parent.Height)
+					}
+					connects = true
+				}
+			}
+			if !connects {
+				return node.headersUnconnected(peer)
+			}
+		}
+		if !header.Validate() {
+			node.sync.headerPeer = nil
+			return misbehaving(scoreInvalidHeader, "header %x has an invalid proof of work", header.Hash)
+		}
+		best, found = header, true
+		if _, known := node.knownHeader(header.Hash); known {
+			continue
+		}
+		node.sync.headers = append(node.sync.headers, header)
+	}
+
+	if len(msg.Headers) == maxHeadersPerMsg { //there are more
+		fmt.Printf("Received headers up to height %d\n", best.Height)
+		node.sync.headersSent = time.Now()
+		node.sync.fullLocator = false
+		return peer.send("getheaders", GetHeaders{Locator: [][]byte{best.Hash}})
+	}
+	node.sync.headerPeer = nil
+	if len(node.sync.headers) > 0 {
+		fmt.Printf("Received headers up to height %d, downloading %d block(s)\n", best.Height, len(node.sync.headers))
+	}
+	node.requestBlocks()
+	return nil
+}
+
+/*
+	The headers do not connect to anything we know. That happens to honest peers: the locator of a continued sync
+	is just our last queued header, which the peer no longer has if its chain moved to another branch. So the
+	queued headers are dropped and the peer is asked again with the full locator of our chain. A peer whose
+	headers do not connect even to that is on another chain, we stop syncing from it without punishing it.
+	The caller holds node.sync.mu
+*/
+func (node *Node) headersUnconnected(peer *Peer) error {
+	if node.sync.fullLocator {
+		node.sync.headerPeer = nil
+		fmt.Printf("Headers from %s do not connect to our chain\n", peer.Address)
+		return nil
+	}
+	node.sync.headers = nil
+	node.sync.inFlight = make(map[string]blockRequest)
+	node.sync.downloaded = make(map[string]receivedBlock)
+	node.sync.headersSent = time.Now()
+	node.sync.fullLocator = true
+	return peer.send("getheaders", GetHeaders{Locator: node.blockLocator()})
+}
+
+// Spreads the missing blocks over the peers that have them, the caller holds node.sync.mu
+func (node *Node) requestBlocks() {
+	var load map[*Peer]int = make(map[*Peer]int)
+	for _, request := range node.sync.inFlight {
+		load[request.peer]++
+	}
+	var peers []*Peer = node.readyPeers()
+	var heights map[*Peer]int = make(map[*Peer]int)
+	for _, peer := range peers {
+		heights[peer] = node.peerHeight(peer)
+	}
+
+	for _, header := range node.sync.headers {
+		var hash string = hex.EncodeToString(header.Hash)
+		if _, requested := node.sync.inFlight[hash]; requested || node.sync.downloaded[hash].block != nil {
+			continue
+		}
+		if orphan := node.takeOrphanBlock(header.Hash); orphan.block != nil {
+			node.sync.downloaded[hash] = orphan //announced to us before we had its parents
+			continue
+		}
+		var chosen *Peer
+		for _, peer := range peers {
+			if heights[peer] < header.Height || load[peer] >= maxBlocksInFlightPerPeer {
+				continue
+			}
+			if chosen == nil || load[peer] < load[chosen] {
+				chosen = peer
+			}
+		}
+		if chosen == nil {
+			return //every peer is busy, more blocks are requested as they arrive
+		}
+		err := chosen.send("getdata", GetData{Type: "block", ID: header.Hash})
+		if err != nil {
+			chosen.conn.Close()
+			continue
+		}
+		node.sync.inFlight[hash] = blockRequest{peer: chosen, sent: time.Now()}
+		load[chosen]++
+	}
+}
+
+// Takes a block that belongs to the queued headers, returns false for blocks that are not part of the sync
+func (node *Node) syncBlock(peer *Peer, block *Blockchain.Block) bool {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+	var hash string = hex.EncodeToString(block.Hash)
+	if !node.sync.queued(block.Hash) {
+		return false
+	}
+	var header Blockchain.BlockHeader = block.Header()
+	if !header.Validate() {
+		//the request stays in flight and times out, the block is fetched from someone else
+		node.punish(peer, scoreInvalidBlock, fmt.Sprintf("block does not match the header %x", block.Hash))
+		return true
+	}
+	delete(node.sync.inFlight, hash)
+	node.sync.downloaded[hash] = receivedBlock{block: block, from: peer}
+	node.connectDownloaded()
+	node.requestBlocks()
+	return true
+}
+
+// Connects the downloaded blocks that are next in line, the caller holds node.sync.mu
+func (node *Node) connectDownloaded() {
+	var connected int = 0
+	for len(node.sync.headers) > 0 {
+		var header Blockchain.BlockHeader = node.sync.headers[0]
+		var hash string = hex.EncodeToString(header.Hash)
+		var received receivedBlock = node.sync.downloaded[hash]
+		var block *Blockchain.Block = received.block
+		if block == nil {
+			break
+		}
+		delete(node.sync.downloaded, hash)
+
+		added, err := node.connectBlock(block) //not added if it was connected meanwhile as the child of an orphan
+
+		if err != nil {
+			//the headers were fine but the block is not, everything built on it is worthless
+			fmt.Printf("Block %x at height %d is invalid, dropping %d queued header(s): %s\n", header.Hash, header.Height, len(node.sync.headers), err)
+			node.sync.headers = nil
+			node.sync.inFlight = make(map[string]blockRequest)
+			node.sync.downloaded = make(map[string]receivedBlock)
+			if !Blockchain.IsContextError(err) {
+				node.punish(received.from, scoreInvalidBlock, fmt.Sprintf("invalid block %x: %s", header.Hash, err))
+			}
+			return
+		}
+		node.sync.headers = node.sync.headers[1:]
+		connected++
+		if added {
+			node.blockConnected(block, nil, len(node.sync.headers) == 0) //only the new tip is announced
+		}
+		if len(node.sync.headers) == 0 || header.Height%100 == 0 {
+			var target int = header.Height + len(node.sync.headers)
+			fmt.Printf("Synced block %d of %d (%.1f%%)\n", header.Height, target, 100*float64(header.Height+1)/float64(target+1))
+		}
+	}
+	if connected > 0 && len(node.sync.headers) == 0 && node.sync.headerPeer == nil {
+		fmt.Printf("Sync complete at height %d\n", node.bestHeight())
+	}
+}
+
+// Forgets the requests of a peer that went away, they are sent to other peers
+func (node *Node) syncPeerGone(peer *Peer) {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+	for hash, request := range node.sync.inFlight {
+		if request.peer == peer {
+			delete(node.sync.inFlight, hash)
+		}
+	}
+	if node.sync.headerPeer == peer {
+		node.sync.headerPeer = nil
+	}
+	node.requestBlocks()
+}
+
+// whether headers or blocks are still being downloaded, the node's tip is not the network's then
+func (node *Node) syncing() bool {
+	node.sync.mu.Lock()
+	defer node.sync.mu.Unlock()
+	return node.sync.headerPeer != nil || len(node.sync.headers) > 0
+}
+
+// Re-requests blocks that take too long and starts a new sync whenever a peer is ahead of us
+func (node *Node) syncLoop() {
+	var ticker *time.Ticker = time.NewTicker(syncCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		node.sync.mu.Lock()
+		for hash, request := range node.sync.inFlight {
+			if time.Since(request.sent) > blockRequestTimeout {
+				delete(node.sync.inFlight, hash)
+				node.punish(request.peer, scoreStalling, fmt.Sprintf("did not deliver block %s in time", hash))
+			}
+		}
+		if node.sync.headerPeer != nil && time.Since(node.sync.headersSent) > blockRequestTimeout {
+			node.punish(node.sync.headerPeer, scoreStalling, "did not answer getheaders in time")
+			node.sync.headerPeer = nil //the next sync asks someone else
+		}
+		node.requestBlocks()
+		var syncing bool = node.sync.headerPeer != nil
+		var bestHeight int = -1
+		if best, found := node.bestHeader(); found {
+			bestHeight = best.Height
+		}
+		node.sync.mu.Unlock()
+
+		if syncing {
+			continue
+		}
+		for _, peer := range node.readyPeers() {
+			if node.peerHeight(peer) > bestHeight {
+				node.startPeerSync(peer)
+				break
+			}
+		}
+	}
+}
+
+// peers of the first protocol version do not know headers and get the old getblocks request
+func (node *Node) startPeerSync(peer *Peer) error {
+	if peer.version.Version < headersVersion {
+		return peer.send("getblocks", nil)
+	}
+	return node.startSync(peer)
+}
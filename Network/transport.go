@@ -0,0 +1,341 @@
+package Network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+	The encrypted transport wraps a TCP connection before the version handshake, everything after it is sealed.
+	Handshake, started by the dialing side:
+	initiator: magic (8 bytes) | ephemeral X25519 public key (32 bytes)
+	responder: ephemeral X25519 public key (32 bytes)
+	Both derive one key per direction with HKDF-SHA256 from the shared secret, salted with the hash of the
+	transcript above. The first sealed record of each side is its identity: a flag byte, its ed25519 identity key
+	and a signature over its role and the transcript hash, so the keys cannot be replayed in another session.
+	Clients without an identity send the flag 0 and nothing else.
+	Records: length of the sealed data (4 bytes, big endian) | ChaCha20-Poly1305 sealed data, the nonce is a
+	counter per direction and the length is authenticated as additional data.
+	Every node understands the encrypted transport on inbound connections, a node that requires it dials encrypted
+	and refuses plain connections.
+*/
+
+var identityFile string //see nodeFile
+
+func identityPath() string {
+	return nodeFile(identityFile, "./temp/identity.key")
+}
+
+const (
+	transportMagic = "BCSECUR1"
+	maxRecordSize  = 1 << 16 //plaintext bytes per record
+	roleInitiator  = 0x01
+	roleResponder  = 0x02
+)
+
+// the static key a node is known by, allowlists are made of their public halves
+type Identity struct {
+	PrivateKey ed25519.PrivateKey
+}
+
+func (identity *Identity) PublicKey() []byte {
+	return identity.PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// Loads the node's identity key, returns nil if the node has none yet
+func LoadIdentity() (*Identity, error) {
+	seed, err := os.ReadFile(identityPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not an identity key", identityPath())
+	}
+	return &Identity{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Loads the node's identity key, creating it on first use
+func LoadOrCreateIdentity() (*Identity, error) {
+	identity, err := LoadIdentity()
+	if identity != nil || err != nil {
+		return identity, err
+	}
+	var seed []byte = make([]byte, ed25519.SeedSize)
+	_, err = rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(identityPath()), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(identityPath(), seed, 0600) //the key is the node's identity, only its owner may read it
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{PrivateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Reads an allowlist, one hex identity key per line, empty lines and lines starting with # are skipped
+func LoadAllowlist(file string) (map[string]bool, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var allowed map[string]bool = make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%q is not a hex identity key", line)
+		}
+		allowed[hex.EncodeToString(key)] = true
+	}
+	return allowed, nil
+}
+
+// a connection whose traffic is sealed, deadlines and closing go to the underlying connection
+type secureConn struct {
+	net.Conn
+	sendCipher cipher.AEAD
+	recvCipher cipher.AEAD
+	sendNonce  uint64
+	recvNonce  uint64
+	pending    []byte //opened plaintext not read yet
+}
+
+func nonceBytes(counter uint64) []byte {
+	var nonce []byte = make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce, counter)
+	return nonce
+}
+
+func (conn *secureConn) Write(data []byte) (int, error) {
+	var written int = 0
+	for written < len(data) {
+		var chunk []byte = data[written:]
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(chunk)+chacha20poly1305.Overhead))
+		var record []byte = conn.sendCipher.Seal(length[:], nonceBytes(conn.sendNonce), chunk, length[:])
+		conn.sendNonce++
+		_, err := conn.Conn.Write(record)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (conn *secureConn) Read(data []byte) (int, error) {
+	if len(conn.pending) == 0 {
+		var length [4]byte
+		_, err := io.ReadFull(conn.Conn, length[:])
+		if err != nil {
+			return 0, err
+		}
+		var size uint32 = binary.BigEndian.Uint32(length[:])
+		if size < chacha20poly1305.Overhead || size > maxRecordSize+chacha20poly1305.Overhead {
+			return 0, misbehaving(scoreMalformed, "invalid record length %d", size)
+		}
+		var sealed []byte = make([]byte, size)
+		_, err = io.ReadFull(conn.Conn, sealed)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		opened, err := conn.recvCipher.Open(nil, nonceBytes(conn.recvNonce), sealed, length[:])
+		if err != nil {
+			return 0, misbehaving(scoreMalformed, "record does not authenticate")
+		}
+		conn.recvNonce++
+		conn.pending = opened
+	}
+	var n int = copy(data, conn.pending)
+	conn.pending = conn.pending[n:]
+	return n, nil
+}
+
+// half closes the connection, SendTransaction uses it to tell the node it is done
+func (conn *secureConn) CloseWrite() error {
+	if tcp, ok := conn.Conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
+	}
+	return nil
+}
+
+// gives back the bytes read to detect the transport before the plain protocol reads them
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixConn) Read(data []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		var n int = copy(data, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(data)
+}
+
+/*
+	Runs the handshake on a fresh connection and returns the sealed connection and the identity key of the other
+	side, nil if it sent none. A nil allowlist accepts everyone, otherwise the other side needs a listed identity.
+*/
+func secureHandshake(conn net.Conn, initiator bool, identity *Identity, allowed map[string]bool) (*secureConn, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ours []byte = ephemeral.PublicKey().Bytes()
+	var theirs []byte = make([]byte, 32)
+	if initiator {
+		_, err = conn.Write(append([]byte(transportMagic), ours...))
+		if err == nil {
+			_, err = io.ReadFull(conn, theirs)
+		}
+	} else {
+		_, err = io.ReadFull(conn, theirs) //the magic was read by the caller
+		if err == nil {
+			_, err = conn.Write(ours)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	theirKey, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := ephemeral.ECDH(theirKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var initiatorKey, responderKey []byte = ours, theirs
+	var ourRole, theirRole byte = roleInitiator, roleResponder
+	if !initiator {
+		initiatorKey, responderKey = theirs, ours
+		ourRole, theirRole = roleResponder, roleInitiator
+	}
+	var transcript [32]byte = sha256.Sum256(bytes.Join([][]byte{[]byte(transportMagic), initiatorKey, responderKey}, nil))
+	var keys []byte = make([]byte, 2*chacha20poly1305.KeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, transcript[:], []byte("golang-blockchain transport v1")), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	initiatorCipher, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	responderCipher, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+	var secure *secureConn = &secureConn{Conn: conn, sendCipher: initiatorCipher, recvCipher: responderCipher}
+	if !initiator {
+		secure.sendCipher, secure.recvCipher = responderCipher, initiatorCipher
+	}
+
+	var auth []byte = []byte{0}
+	if identity != nil {
+		auth = append([]byte{1}, identity.PublicKey()...)
+		auth = append(auth, ed25519.Sign(identity.PrivateKey, append([]byte{ourRole}, transcript[:]...))...)
+	}
+	_, err = secure.Write(auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	var flag [1]byte
+	_, err = io.ReadFull(secure, flag[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	var peerIdentity []byte
+	if flag[0] == 1 {
+		var signed []byte = make([]byte, ed25519.PublicKeySize+ed25519.SignatureSize)
+		_, err = io.ReadFull(secure, signed)
+		if err != nil {
+			return nil, nil, err
+		}
+		peerIdentity = signed[:ed25519.PublicKeySize]
+		if !ed25519.Verify(peerIdentity, append([]byte{theirRole}, transcript[:]...), signed[ed25519.PublicKeySize:]) {
+			return nil, nil, misbehaving(scoreMalformed, "identity signature does not verify")
+		}
+	} else if flag[0] != 0 {
+		return nil, nil, misbehaving(scoreMalformed, "invalid identity flag")
+	}
+	if allowed != nil && (peerIdentity == nil || !allowed[hex.EncodeToString(peerIdentity)]) {
+		return nil, nil, fmt.Errorf("identity %x is not on the allowlist", peerIdentity)
+	}
+	return secure, peerIdentity, nil
+}
+
+// an allowlist is useless on plain connections, so it implies encryption
+func (node *Node) encrypted() bool {
+	return node.RequireEncryption || node.Allowlist != nil
+}
+
+// the dialing side of a connection, encrypted if the node requires it
+func (node *Node) secureOutbound(conn net.Conn) (net.Conn, []byte, error) {
+	if !node.encrypted() {
+		return conn, nil, nil
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	secure, identity, err := secureHandshake(conn, true, node.Identity, node.Allowlist)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secure, identity, nil
+}
+
+// the accepting side: detects the transport from the first bytes, plain connections are refused if the node
+// requires encryption
+func (node *Node) secureInbound(conn net.Conn) (net.Conn, []byte, error) {
+	var magic []byte = make([]byte, len(transportMagic))
+	_, err := io.ReadFull(conn, magic)
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(magic) != transportMagic {
+		if node.encrypted() {
+			return nil, nil, errors.New("plain connection to a node that requires encryption")
+		}
+		return &prefixConn{Conn: conn, prefix: magic}, nil, nil
+	}
+	secure, identity, err := secureHandshake(conn, false, node.Identity, node.Allowlist)
+	if err != nil {
+		return nil, nil, err
+	}
+	return secure, identity, nil
+}
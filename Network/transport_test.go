@@ -0,0 +1,190 @@
+package Network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Identity{PrivateKey: privateKey}
+}
+
+type handshakeResult struct {
+	conn     net.Conn
+	identity []byte
+	err      error
+}
+
+// connects the dialer to the acceptor over loopback TCP and runs both sides of the transport handshake
+func testHandshake(t *testing.T, dialer *Node, acceptor *Node) (handshakeResult, handshakeResult) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted chan handshakeResult = make(chan handshakeResult, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- handshakeResult{err: err}
+			return
+		}
+		secure, identity, err := acceptor.secureInbound(conn)
+		if err != nil {
+			conn.Close()
+		}
+		accepted <- handshakeResult{conn: secure, identity: identity, err: err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, identity, err := dialer.secureOutbound(conn)
+	if err != nil {
+		conn.Close()
+	}
+	var client handshakeResult = handshakeResult{conn: secure, identity: identity, err: err}
+	var server handshakeResult = <-accepted
+	t.Cleanup(func() {
+		conn.Close()
+		if server.conn != nil {
+			server.conn.Close()
+		}
+	})
+	return client, server
+}
+
+func TestSecureHandshakeExchangesIdentities(t *testing.T) {
+	var dialer *Node = &Node{Identity: newTestIdentity(t), RequireEncryption: true}
+	var acceptor *Node = &Node{Identity: newTestIdentity(t), RequireEncryption: true}
+	client, server := testHandshake(t, dialer, acceptor)
+	if client.err != nil || server.err != nil {
+		t.Fatalf("handshake failed: %v / %v", client.err, server.err)
+	}
+	if !bytes.Equal(client.identity, acceptor.Identity.PublicKey()) || !bytes.Equal(server.identity, dialer.Identity.PublicKey()) {
+		t.Fatal("the sides do not see each other's identity")
+	}
+
+	var message []byte = make([]byte, 3*maxRecordSize+5) //spans several records
+	_, err := rand.Read(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written chan error = make(chan error, 1)
+	go func() {
+		_, err := client.conn.Write(message)
+		written <- err
+	}()
+	var received []byte = make([]byte, len(message))
+	_, err = io.ReadFull(server.conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, message) {
+		t.Error("the message arrived changed")
+	}
+}
+
+func TestSecureHandshakeAllowlist(t *testing.T) {
+	var listed, unlisted *Identity = newTestIdentity(t), newTestIdentity(t)
+	var acceptor *Node = &Node{Identity: newTestIdentity(t), Allowlist: map[string]bool{hex.EncodeToString(listed.PublicKey()): true}}
+
+	_, server := testHandshake(t, &Node{Identity: listed, RequireEncryption: true}, acceptor)
+	if server.err != nil {
+		t.Errorf("a listed identity was refused: %s", server.err)
+	}
+	_, server = testHandshake(t, &Node{Identity: unlisted, RequireEncryption: true}, acceptor)
+	if server.err == nil {
+		t.Error("an identity that is not listed was accepted")
+	}
+	_, server = testHandshake(t, &Node{RequireEncryption: true}, acceptor)
+	if server.err == nil {
+		t.Error("a client without identity was accepted")
+	}
+}
+
+func TestSecureHandshakeAnonymousClient(t *testing.T) {
+	client, server := testHandshake(t, &Node{RequireEncryption: true}, &Node{Identity: newTestIdentity(t)})
+	if client.err != nil || server.err != nil {
+		t.Fatalf("handshake failed: %v / %v", client.err, server.err)
+	}
+	if server.identity != nil {
+		t.Errorf("got identity %x for an anonymous client", server.identity)
+	}
+}
+
+// a plain client sends its first message without a handshake, the acceptor reads it to detect the transport
+func plainInbound(t *testing.T, acceptor *Node, message []byte) (net.Conn, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accepted.Close() })
+	secure, _, err := acceptor.secureInbound(accepted)
+	return secure, err
+}
+
+func TestPlainConnections(t *testing.T) {
+	var message []byte = []byte("version and the rest of a plain message")
+	if _, err := plainInbound(t, &Node{RequireEncryption: true}, message); err == nil {
+		t.Error("a node that requires encryption accepted a plain connection")
+	}
+
+	conn, err := plainInbound(t, &Node{}, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []byte = make([]byte, len(message))
+	_, err = io.ReadFull(conn, received)
+	if err != nil || !bytes.Equal(received, message) {
+		t.Errorf("the bytes read to detect the transport were lost: %q %v", received, err)
+	}
+}
+
+func TestSecureConnRejectsTamperedRecord(t *testing.T) {
+	client, server := testHandshake(t, &Node{RequireEncryption: true}, &Node{})
+	if client.err != nil || server.err != nil {
+		t.Fatalf("handshake failed: %v / %v", client.err, server.err)
+	}
+	var record []byte = make([]byte, 4+32)
+	binary.BigEndian.PutUint32(record, 32)
+	_, err := client.conn.(*secureConn).Conn.Write(record) //a record the client's cipher did not seal
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.conn.Read(make([]byte, 16))
+	if _, isMisbehavior := err.(*misbehavior); !isMisbehavior {
+		t.Errorf("got %v, want a misbehavior", err)
+	}
+}
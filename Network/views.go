@@ -0,0 +1,182 @@
+package Network
+
+import (
+	"encoding/hex"
+
+	"github.com/pred695/golang-blockchain/Blockchain"
+	"github.com/pred695/golang-blockchain/Wallet"
+)
+
+// JSON representations of chain data, shared by the RPC and REST servers. Hashes and scripts are hex.
+
+type BlockJSON struct {
+	Hash          string   `json:"hash"`
+	PrevHash      string   `json:"prevhash"`
+	Height        int      `json:"height"`
+	Timestamp     int64    `json:"timestamp"`
+	Nonce         int      `json:"nonce"`
+	MerkleRoot    string   `json:"merkleroot"`
+	Confirmations int      `json:"confirmations"`
+	Transactions  []TxJSON `json:"transactions"`
+}
+
+type TxJSON struct {
+	TxID          string         `json:"txid"`
+	Inputs        []TxInputJSON  `json:"inputs"`
+	Outputs       []TxOutputJSON `json:"outputs"`
+	LockTime      int64          `json:"locktime"`
+	BlockHash     string         `json:"blockhash,omitempty"`
+	Height        *int           `json:"height,omitempty"`
+	Confirmations int            `json:"confirmations"` //0 for transactions in the pool
+}
+
+type TxInputJSON struct {
+	TxID     string `json:"txid"` //empty for the coinbase
+	Vout     int    `json:"vout"`
+	Script   string `json:"script"`
+	Sequence int    `json:"sequence"`
+	Address  string `json:"address,omitempty"` //the address the input spends from, if the unlocking script tells
+}
+
+type TxOutputJSON struct {
+	Value   int    `json:"value"`
+	Script  string `json:"script"`
+	Address string `json:"address,omitempty"` //empty for outputs that do not pay to an address
+	Data    string `json:"data,omitempty"`    //hex payload of data outputs
+}
+
+type UTXOJSON struct {
+	TxID   string `json:"txid"`
+	Vout   int    `json:"vout"`
+	Value  int    `json:"value"`
+	Height int    `json:"height"`
+	Mature bool   `json:"mature"`
+}
+
+type BalanceJSON struct {
+	Address  string `json:"address"`
+	Balance  int    `json:"balance"`
+	Immature int    `json:"immature"` //coinbase rewards waiting for Params.Active.CoinbaseMaturity confirmations
+}
+
+// The address a locking script pays to, looking through time locks, empty if it does not pay to an address
+func ScriptAddress(script []byte) string {
+	_, _, inner := Blockchain.SplitTimelockScript(script)
+	if pubKeyHash := Blockchain.ExtractPubKeyHash(inner); pubKeyHash != nil {
+		return string(Wallet.PubKeyHashAddress(pubKeyHash))
+	}
+	if scriptHash := Blockchain.ExtractScriptHash(inner); scriptHash != nil {
+		return string(Wallet.ScriptHashAddress(scriptHash))
+	}
+	return ""
+}
+
+/*
+	The address an unlocking script spends from, empty if it cannot be told from the script alone: a signature and
+	a public key spend a pay to public key hash output, a push-only script ending in a multisig redeem script
+	spends a pay to script hash output.
+*/
+func InputAddress(script []byte) string {
+	ops, err := Blockchain.ParseScript(script)
+	if err != nil || len(ops) < 2 {
+		return ""
+	}
+	for _, op := range ops {
+		if op.Data == nil && op.Opcode != Blockchain.OP_0 {
+			return "" //not push-only
+		}
+	}
+	var last []byte = ops[len(ops)-1].Data
+	if _, _, isMultisig := Blockchain.ParseMultisigScript(last); isMultisig {
+		return string(Wallet.ScriptAddress(last))
+	}
+	if len(ops) == 2 && len(last) > 0 {
+		return string(Wallet.PubKeyHashAddress(Wallet.CreatePubKeyHash(last)))
+	}
+	return ""
+}
+
+func NewTxJSON(tx *Blockchain.Transaction) TxJSON {
+	var view TxJSON = TxJSON{TxID: hex.EncodeToString(tx.ID), LockTime: tx.LockTime}
+	for _, input := range tx.Inputs {
+		var inputView TxInputJSON = TxInputJSON{
+			TxID:     hex.EncodeToString(input.ID),
+			Vout:     input.OutputIdx,
+			Script:   hex.EncodeToString(input.Script),
+			Sequence: input.Sequence,
+		}
+		if !tx.Is_Coinbase() { //the coinbase script is arbitrary data
+			inputView.Address = InputAddress(input.Script)
+		}
+		view.Inputs = append(view.Inputs, inputView)
+	}
+	for _, output := range tx.Outputs {
+		var outputView TxOutputJSON = TxOutputJSON{Value: output.Value, Script: hex.EncodeToString(output.Script)}
+		if data, isData := Blockchain.ExtractData(output.Script); isData {
+			outputView.Data = hex.EncodeToString(data)
+		} else {
+			outputView.Address = ScriptAddress(output.Script)
+		}
+		view.Outputs = append(view.Outputs, outputView)
+	}
+	return view
+}
+
+// a transaction of the given block, bestHeight is the height of our tip
+func NewConfirmedTxJSON(tx *Blockchain.Transaction, block *Blockchain.Block, bestHeight int) TxJSON {
+	var view TxJSON = NewTxJSON(tx)
+	var height int = block.Height
+	view.BlockHash = hex.EncodeToString(block.Hash)
+	view.Height = &height
+	view.Confirmations = bestHeight - block.Height + 1
+	return view
+}
+
+func NewBlockJSON(block *Blockchain.Block, bestHeight int) BlockJSON {
+	var view BlockJSON = BlockJSON{
+		Hash:          hex.EncodeToString(block.Hash),
+		PrevHash:      hex.EncodeToString(block.PrevHash),
+		Height:        block.Height,
+		Timestamp:     block.Timestamp,
+		Nonce:         block.Nonce,
+		MerkleRoot:    hex.EncodeToString(block.HashTransactions()),
+		Confirmations: bestHeight - block.Height + 1,
+	}
+	for _, tx := range block.Transactions {
+		view.Transactions = append(view.Transactions, NewConfirmedTxJSON(tx, block, bestHeight))
+	}
+	return view
+}
+
+// looks in the pool first, then in the chain, the caller holds node.mu
+func (node *Node) findTransaction(txID []byte) (TxJSON, bool) {
+	if tx, found := node.mempool.Get(txID); found {
+		return NewTxJSON(tx), true
+	}
+	tx, block, err := node.chain.FindTransactionBlock(txID)
+	if err != nil {
+		return TxJSON{}, false
+	}
+	return NewConfirmedTxJSON(&tx, block, node.chain.GetBestHeight()), true
+}
+
+// The spendable and immature balance of an address
+func AddressBalance(UTXO Blockchain.UTXOSet, address string) BalanceJSON {
+	var balance Blockchain.Balance = UTXO.Balances([]string{address})[address]
+	return BalanceJSON{Address: address, Balance: balance.Spendable, Immature: balance.Immature}
+}
+
+func AddressUTXOs(UTXO Blockchain.UTXOSet, address string) []UTXOJSON {
+	var nextHeight int = UTXO.Blockchain.GetBestHeight() + 1
+	var utxos []UTXOJSON = []UTXOJSON{}
+	for _, entry := range UTXO.FindUnspentOutputs(Blockchain.AddressScript([]byte(address))) {
+		utxos = append(utxos, UTXOJSON{
+			TxID:   hex.EncodeToString(entry.TxID),
+			Vout:   entry.OutputIdx,
+			Value:  entry.Output.Value,
+			Height: entry.Height,
+			Mature: entry.IsMatureAt(nextHeight),
+		})
+	}
+	return utxos
+}
@@ -0,0 +1,189 @@
+package Params
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	The consensus and network values of a chain. Peers only talk to each other with the same magic bytes, addresses
+	start with the network's version bytes and every network but mainnet keeps its files in a directory of its own
+	(e.g. ./temp/testnet/blocks), so separate networks cannot be mixed up.
+	The network is picked with NETWORK (mainnet, testnet or regtest, mainnet if unset), or loaded from the JSON file
+	named by CHAIN_PARAMS, see Select and Load.
+	The difficulty of a network is fixed, there is no retargeting: every block has the same target, and the fork
+	choice (chainWork in Blockchain/reorg.go) counts blocks on that assumption. A network that wants a different
+	block rate picks another difficulty and starts over.
+*/
+
+type ChainParams struct {
+	Name              string `json:"name"`              //also the directory of the network's files
+	Magic             uint32 `json:"magic"`             //starts every message on the wire
+	PubKeyHashVersion byte   `json:"pubkeyhashversion"` //first byte of the addresses of keys
+	ScriptHashVersion byte   `json:"scripthashversion"` //first byte of the addresses of redeem scripts (multisig)
+
+	GenesisMessage string `json:"genesismessage"` //carried by the coinbase of the genesis block
+	GenesisTime    int64  `json:"genesistime"`    //unix time of the genesis block, 0 for when the chain is created
+	GenesisAddress string `json:"genesisaddress"` //receives the genesis reward, empty for the address given to createblockchain
+	GenesisHash    string `json:"genesishash"`    //hex, pinned by full nodes and light clients, empty if the genesis is not fixed
+
+	Difficulty       int `json:"difficulty"`       //leading zero bits of a block hash, the same for every block
+	InitialSubsidy   int `json:"initialsubsidy"`   //coins created by the coinbase of a block
+	HalvingInterval  int `json:"halvinginterval"`  //blocks after which the subsidy halves, 0 to never halve
+	CoinbaseMaturity int `json:"coinbasematurity"` //confirmations before a coinbase output can be spent
+}
+
+/*
+	The magic bytes spell go plus the network ("gomn", "gotn", "gort") and the version bytes make the addresses of
+	keys start with G, t or R, so neither can be taken for another chain's. Mainnet keeps the consensus values
+	chains were created with before networks existed, its genesis belongs to whoever creates the chain. Testnet
+	has a fixed genesis, so every testnet node builds the same one, paying to the hash of its message which no key
+	is known for.
+*/
+var Mainnet ChainParams = ChainParams{
+	Name:              "mainnet",
+	Magic:             0x676f6d6e,
+	PubKeyHashVersion: 0x26,
+	ScriptHashVersion: 0x3f,
+	GenesisMessage:    "First Transaction from Genesis",
+	Difficulty:        18,
+	InitialSubsidy:    50,
+	HalvingInterval:   210000,
+	CoinbaseMaturity:  10,
+}
+
+var Testnet ChainParams = ChainParams{
+	Name:              "testnet",
+	Magic:             0x676f746e,
+	PubKeyHashVersion: 0x7f,
+	ScriptHashVersion: 0x82,
+	GenesisMessage:    "golang-blockchain testnet genesis",
+	GenesisTime:       1767225600, //2026-01-01
+	GenesisAddress:    "t7MDBxekkuiPbjJF2XAR1LoqUtbYqcehKs",
+	GenesisHash:       "0000bc133bdc717d4766cda066b3eadb4d354f67bb8055325a45bf0ef4530c2a",
+	Difficulty:        16,
+	InitialSubsidy:    50,
+	HalvingInterval:   210000,
+	CoinbaseMaturity:  10,
+}
+
+// for local testing, blocks are found in an instant
+var Regtest ChainParams = ChainParams{
+	Name:              "regtest",
+	Magic:             0x676f7274,
+	PubKeyHashVersion: 0x3c,
+	ScriptHashVersion: 0x7a,
+	GenesisMessage:    "golang-blockchain regtest genesis",
+	Difficulty:        8,
+	InitialSubsidy:    50,
+	HalvingInterval:   150,
+	CoinbaseMaturity:  10,
+}
+
+var presets map[string]ChainParams = map[string]ChainParams{
+	Mainnet.Name: Mainnet,
+	Testnet.Name: Testnet,
+	Regtest.Name: Regtest,
+}
+
+// no amount, single or summed up, can be larger, so adding two valid amounts never overflows. The mainnet subsidy
+// schedule creates just under 21 million coins in total.
+const MaxMoney = 21000000
+
+// the parameters of the network this process runs on, mainnet until Select picks another one at start up
+var Active *ChainParams = &Mainnet
+
+// Makes the network named by NETWORK and CHAIN_PARAMS the active one, see Load. It has to run before any file of
+// the node is opened, the files are kept in the directory of the network.
+func Select() error {
+	params, err := Load(os.Getenv("NETWORK"), os.Getenv("CHAIN_PARAMS"))
+	if err != nil {
+		return err
+	}
+	Active = params
+	return nil
+}
+
+/*
+	The parameters of a preset, or of a JSON file if one is given. Fields the file leaves out keep the values of the
+	preset (mainnet without one), so a file only needs what makes its network different, which should include at
+	least a new name and magic.
+*/
+func Load(network string, file string) (*ChainParams, error) {
+	if network == "" {
+		network = Mainnet.Name
+	}
+	params, found := presets[network]
+	if !found {
+		return nil, fmt.Errorf("unknown network %q, use mainnet, testnet or regtest", network)
+	}
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var decoder *json.Decoder = json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&params)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if preset, found := presets[params.Name]; found && params != preset {
+			return nil, fmt.Errorf("%s changes %s, give the network a name of its own", file, params.Name)
+		}
+	}
+	err := params.validate()
+	if err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func (params *ChainParams) validate() error {
+	if params.Name == "" || strings.ContainsAny(params.Name, `/\.`) {
+		return fmt.Errorf("network name %q cannot be used as a directory", params.Name)
+	}
+	if hash, err := hex.DecodeString(params.GenesisHash); err != nil || (len(hash) != 0 && len(hash) != 32) {
+		return errors.New("the genesis hash has to be 32 bytes of hex")
+	}
+	if params.PubKeyHashVersion == params.ScriptHashVersion {
+		return errors.New("the two address versions have to differ")
+	}
+	if params.Difficulty < 1 || params.Difficulty > 255 {
+		return errors.New("difficulty has to be between 1 and 255")
+	}
+	if params.InitialSubsidy <= 0 || params.HalvingInterval < 0 || params.CoinbaseMaturity < 0 {
+		return errors.New("subsidy, halving interval and maturity cannot be negative, the subsidy not zero")
+	}
+	if params.InitialSubsidy > MaxMoney {
+		return fmt.Errorf("the subsidy cannot be larger than %d", MaxMoney)
+	}
+	return nil
+}
+
+// coins created by the coinbase of the block at the height
+func (params *ChainParams) Subsidy(height int) int {
+	if params.HalvingInterval == 0 {
+		return params.InitialSubsidy
+	}
+	var halvings int = height / params.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return params.InitialSubsidy >> halvings
+}
+
+// Puts a file of ./temp into the directory of the network, mainnet files stay where they always were. The directory
+// is not created, whoever writes the file does that.
+func DataPath(path string) string {
+	if Active.Name == Mainnet.Name {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), Active.Name, filepath.Base(path))
+}
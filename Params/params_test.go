@@ -0,0 +1,143 @@
+package Params
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeParams(t *testing.T, content string) string {
+	t.Helper()
+	var file string = filepath.Join(t.TempDir(), "params.json")
+	err := os.WriteFile(file, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadPresets(t *testing.T) {
+	for network, want := range map[string]ChainParams{"": Mainnet, "mainnet": Mainnet, "testnet": Testnet, "regtest": Regtest} {
+		params, err := Load(network, "")
+		if err != nil {
+			t.Fatalf("%q: %s", network, err)
+		}
+		if *params != want {
+			t.Errorf("%q: got %s", network, params.Name)
+		}
+	}
+	if _, err := Load("simnet", ""); err == nil || !strings.Contains(err.Error(), "unknown network") {
+		t.Errorf("got %v, want an unknown network", err)
+	}
+}
+
+func TestPresetsDiffer(t *testing.T) {
+	var presets []ChainParams = []ChainParams{Mainnet, Testnet, Regtest}
+	for i := range presets {
+		for _, other := range presets[i+1:] {
+			var params ChainParams = presets[i]
+			if params.Magic == other.Magic {
+				t.Errorf("%s and %s share their magic", params.Name, other.Name)
+			}
+			for _, version := range []byte{other.PubKeyHashVersion, other.ScriptHashVersion} {
+				if version == params.PubKeyHashVersion || version == params.ScriptHashVersion {
+					t.Errorf("%s and %s share the address version %#x", params.Name, other.Name, version)
+				}
+			}
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	var active *ChainParams = Active
+	t.Cleanup(func() { Active = active })
+
+	t.Setenv("NETWORK", "regtest")
+	err := Select()
+	if err != nil || Active.Name != Regtest.Name {
+		t.Fatalf("got %s, %v, want regtest", Active.Name, err)
+	}
+	t.Setenv("NETWORK", "simnet")
+	if Select() == nil {
+		t.Fatal("selected an unknown network")
+	}
+	if Active.Name != Regtest.Name {
+		t.Errorf("a failed Select changed the network to %s", Active.Name)
+	}
+}
+
+func TestDataPath(t *testing.T) {
+	var active *ChainParams = Active
+	t.Cleanup(func() { Active = active })
+	var dir string = t.TempDir()
+
+	Active = &Mainnet
+	if path := DataPath(filepath.Join(dir, "blocks")); path != filepath.Join(dir, "blocks") {
+		t.Errorf("mainnet: got %s", path)
+	}
+	Active = &Testnet
+	if path := DataPath(filepath.Join(dir, "blocks")); path != filepath.Join(dir, "testnet", "blocks") {
+		t.Errorf("testnet: got %s", path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "testnet")); !os.IsNotExist(err) {
+		t.Error("DataPath created the directory")
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	params, err := Load("regtest", writeParams(t, `{"name": "devnet", "magic": 1, "difficulty": 4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Name != "devnet" || params.Magic != 1 || params.Difficulty != 4 {
+		t.Errorf("the file was not applied: %+v", params)
+	}
+	if params.PubKeyHashVersion != Regtest.PubKeyHashVersion || params.HalvingInterval != Regtest.HalvingInterval {
+		t.Errorf("fields the file leaves out lost the preset's values: %+v", params)
+	}
+
+	var tests = []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"unknown field", `{"name": "devnet", "blocktime": 10}`, "unknown field"},
+		{"not json", `{"name"`, "params.json"},
+		{"changed preset", `{"difficulty": 4}`, "give the network a name of its own"},
+		{"same address versions", `{"name": "devnet", "scripthashversion": 60}`, "address versions"},
+		{"name with a path", `{"name": "../devnet"}`, "directory"},
+		{"difficulty out of range", `{"name": "devnet", "difficulty": 0}`, "difficulty"},
+		{"no subsidy", `{"name": "devnet", "initialsubsidy": 0}`, "subsidy"},
+		{"subsidy above max money", `{"name": "devnet", "initialsubsidy": 21000001}`, "subsidy"},
+		{"genesis hash not hex", `{"name": "devnet", "genesishash": "genesis"}`, "genesis hash"},
+		{"short genesis hash", `{"name": "devnet", "genesishash": "00ff"}`, "genesis hash"},
+	}
+	for _, test := range tests {
+		_, err := Load("regtest", writeParams(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+	if _, err := Load("regtest", filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestSubsidyHalves(t *testing.T) {
+	var tests = []struct {
+		interval, height, subsidy int
+	}{
+		{0, 1000000, 50},
+		{150, 149, 50},
+		{150, 150, 25},
+		{150, 450, 6},
+		{150, 150 * 63, 0},
+	}
+	for _, test := range tests {
+		var params ChainParams = ChainParams{InitialSubsidy: 50, HalvingInterval: test.interval}
+		if subsidy := params.Subsidy(test.height); subsidy != test.subsidy {
+			t.Errorf("interval %d, height %d: got %d, want %d", test.interval, test.height, subsidy, test.subsidy)
+		}
+	}
+}
@@ -10,13 +10,13 @@ import (
 	"log"
 	"math/big"
 
+	"github.com/mr-tron/base58"
+	"github.com/pred695/golang-blockchain/Params"
 	"golang.org/x/crypto/ripemd160"
 )
 
-const (
-	version        = byte(0x00)
-	ChecksumLength = 4 //in bytes.
-)
+//the version bytes are the network's: Params.Active.PubKeyHashVersion for keys, ScriptHashVersion for redeem scripts (multisig)
+const ChecksumLength = 4 //in bytes.
 
 type Wallet struct {
 	PrivateKey PrivateKey
@@ -38,11 +38,7 @@ type PrivateKey struct {
 func (w Wallet) CreateAddress() []byte {
 	var pubHash []byte = CreatePubKeyHash(w.PublicKey)
 
-	var versionHash []byte = append([]byte{version}, pubHash...)
-	var checksum []byte = Checksum(versionHash)
-
-	var fullHash []byte = append(versionHash, checksum...)
-	var address []byte = Base58Encode(fullHash)
+	var address []byte = encodeAddress(Params.Active.PubKeyHashVersion, pubHash)
 
 	// fmt.Printf("Private Key: %x\n", w.PrivateKey)
 	// fmt.Printf("Public Key: %x\n", w.PublicKey)
@@ -53,10 +49,47 @@ func (w Wallet) CreateAddress() []byte {
 	return address
 }
 
+// The address of a redeem script, coins sent to it can only be spent by satisfying the script
+func ScriptAddress(redeemScript []byte) []byte {
+	return encodeAddress(Params.Active.ScriptHashVersion, CreatePubKeyHash(redeemScript))
+}
+
+// The address of a public key hash taken from a locking script
+func PubKeyHashAddress(pubKeyHash []byte) []byte {
+	return encodeAddress(Params.Active.PubKeyHashVersion, pubKeyHash)
+}
+
+// The address of a script hash taken from a P2SH locking script
+func ScriptHashAddress(scriptHash []byte) []byte {
+	return encodeAddress(Params.Active.ScriptHashVersion, scriptHash)
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	var versionHash []byte = append([]byte{version}, hash...)
+	var checksum []byte = Checksum(versionHash)
+
+	var fullHash []byte = append(versionHash, checksum...)
+	return Base58Encode(fullHash)
+}
+
+// true for addresses created by ScriptAddress
+func IsScriptAddress(address []byte) bool {
+	var fullHash []byte = Base58Decode(address)
+	return len(fullHash) > 0 && fullHash[0] == Params.Active.ScriptHashVersion
+}
+
+// true for a well formed address of this network
 func ValidateAddress(address string) bool {
-	var pubKeyHash []byte = Base58Decode([]byte(address))
+	decoded, err := base58.Decode(address)
+	if err != nil || len(decoded) != 1+20+ChecksumLength {
+		return false
+	}
+	var pubKeyHash []byte = decoded
 	var actualChecksum []byte = pubKeyHash[(len(pubKeyHash) - ChecksumLength):] //taking the last ChecksumLength bytes
 	var version byte = pubKeyHash[0]
+	if version != Params.Active.PubKeyHashVersion && version != Params.Active.ScriptHashVersion {
+		return false //an address of another network, coins sent to it would be lost
+	}
 	pubKeyHash = pubKeyHash[1:(len(pubKeyHash) - ChecksumLength)] //taking the bytes between version and checksum
 	var targetChecksum []byte = Checksum(append([]byte{version}, pubKeyHash...))
 	return bytes.Compare(actualChecksum, targetChecksum) == 0
@@ -69,7 +102,9 @@ func NewKeyPair() (PrivateKey, []byte) {
 	var err error
 	Priv, err = ecdsa.GenerateKey(curve, rand.Reader)
 	Handle(err)
-	var PublicKey []byte = append(Priv.PublicKey.X.Bytes(), Priv.PublicKey.Y.Bytes()...)
+	var PublicKey []byte = make([]byte, 64)
+	Priv.PublicKey.X.FillBytes(PublicKey[:32]) //fixed width coordinates, the key is split in the middle during verification
+	Priv.PublicKey.Y.FillBytes(PublicKey[32:])
 	return PrivateKey{D: Priv.D, X: Priv.PublicKey.X, Y: Priv.PublicKey.Y}, PublicKey
 }
 func MakeWallet() *Wallet {
@@ -6,19 +6,50 @@ import (
 	"encoding/gob"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pred695/golang-blockchain/Params"
 )
 
-const walletFile = "./temp/wallets.data"
+var walletFile string //replaces the wallet file of the network when set
+
+// The path if it is set, otherwise the file in the directory of the network. Every node on a machine has its own
+// wallet file when NODE_ID is set, e.g. ./temp/wallets_3001.data
+func nodeFile(path string, file string) string {
+	if path != "" {
+		return path
+	}
+	file = Params.DataPath(file)
+	var nodeID string = os.Getenv("NODE_ID")
+	if nodeID == "" {
+		return file
+	}
+	var ext string = filepath.Ext(file)
+	return strings.TrimSuffix(file, ext) + "_" + nodeID + ext
+}
 
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets       map[string]*Wallet
+	RedeemScripts map[string][]byte //multisig address --> redeem script, no private key is stored for these
+}
+
+// the wallet file of this node, found when it is used as the network is only selected at start up
+func DefaultWalletFile() string {
+	return nodeFile(walletFile, "./temp/wallets.data")
 }
 
 func CreateWallets() (*Wallets, error) {
+	return LoadWallets(DefaultWalletFile())
+}
+
+// loads the wallets from any wallet file, e.g. one copied to an offline signing machine
+func LoadWallets(file string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.RedeemScripts = make(map[string][]byte)
 
-	err := wallets.LoadFile()
+	err := wallets.loadFrom(file)
 
 	return &wallets, err
 }
@@ -32,6 +63,15 @@ func (ws *Wallets) AddWallet() string {
 	return address
 }
 
+// remembers a redeem script (e.g. a multisig) and returns its address
+func (ws *Wallets) AddRedeemScript(redeemScript []byte) string {
+	address := string(ScriptAddress(redeemScript))
+
+	ws.RedeemScripts[address] = redeemScript
+
+	return address
+}
+
 func (ws *Wallets) GetAllAddresses() []string {
 	var addresses []string
 
@@ -47,12 +87,16 @@ func (ws Wallets) GetWallet(address string) Wallet {
 }
 
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	return ws.loadFrom(DefaultWalletFile())
+}
+
+func (ws *Wallets) loadFrom(file string) error {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
 		return err
 	}
 
 	var wallets Wallets
-	fileContent, err := os.ReadFile(walletFile)
+	fileContent, err := os.ReadFile(file)
 	if err != nil {
 		return err
 	}
@@ -64,7 +108,15 @@ func (ws *Wallets) LoadFile() error {
 		return err
 	}
 
-	ws.Wallets = wallets.Wallets
+	//keyed by the addresses of the current version bytes, files written before they changed have the old ones
+	ws.Wallets = make(map[string]*Wallet)
+	ws.RedeemScripts = make(map[string][]byte)
+	for _, wallet := range wallets.Wallets {
+		ws.Wallets[string(wallet.CreateAddress())] = wallet
+	}
+	for _, redeemScript := range wallets.RedeemScripts { //older wallet files have no redeem scripts
+		ws.RedeemScripts[string(ScriptAddress(redeemScript))] = redeemScript
+	}
 
 	return nil
 }
@@ -80,7 +132,12 @@ func (ws *Wallets) SaveFile() {
 		log.Panic(err)
 	}
 
-	err = os.WriteFile(walletFile, content.Bytes(), 0644)
+	var file string = DefaultWalletFile()
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = os.WriteFile(file, content.Bytes(), 0644)
 	if err != nil {
 		log.Panic(err)
 	}